@@ -10,6 +10,7 @@ import (
 	"path"
 	"plugin"
 	"runtime"
+	"strings"
 	"time"
 	/// our packages:
 	"objvalmo" // import "github.com/bstarynk/monimelt/objvalmo"
@@ -21,9 +22,21 @@ func main() {
 	hasSerialPtr := flag.Bool("serial", false, "generate serials and obids")
 	nbSerialPtr := flag.Int("nb-serial", 3, "number of serials")
 	loadPtr := flag.String("load", "", "initial load directory")
+	loadTextPtr := flag.String("load-text", "", "initial load directory, in the textual one-file-per-object format")
+	loadWorkersPtr := flag.Int("load-workers", objvalmo.LoadWorkers, "number of workers filling the loaded objects")
+	fsckPtr := flag.String("fsck", "", "check the consistency of a dump directory, then exit")
+	diffPtr := flag.String("diff", "", "OLDDIR,NEWDIR: show the differences between two dump directories, then exit")
+	diffJsonPtr := flag.Bool("diff-json", false, "show the -diff as JSON")
+	diffNamesPtr := flag.Bool("diff-names", false, "show the names of objects in the -diff")
+	restoreSqlPtr := flag.String("restore-sql", "", "directory whose databases are restored from their .sql files, before loading")
 	tinyDump1Ptr := flag.String("tiny-dump1", "", "directory to dump with DoTinyDump1")
 	pluginRunPtr := flag.String("run-plugin", "", "Go source file to compile and load as plugin")
 	finalDumpPtr := flag.String("final-dump", "", "final dump directory")
+	finalDumpTextPtr := flag.String("final-dump-text", "", "final dump directory, in the textual one-file-per-object format")
+	autosavePtr := flag.String("autosave", "", "state directory autosaved in the background")
+	autosavePeriodPtr := flag.Duration("autosave-period", 5*time.Minute, "period of the -autosave, or 0")
+	autosaveModifsPtr := flag.Int("autosave-modifs", 0, "autosave after that many modifications, or 0")
+	autosaveBackupsPtr := flag.Int("autosave-backups", 5, "number of timestamped backups kept by the -autosave")
 	flag.Parse()
 	log.Printf("Monimelt starting pid %d, Go version %s\n", os.Getpid(), runtime.Version())
 	if *hasSerialPtr {
@@ -43,10 +56,71 @@ func main() {
 		}
 	}
 	//
+	if len(*fsckPtr) > 0 {
+		log.Printf("monimelt should check %s\n", *fsckPtr)
+		rep, err := objvalmo.FsckDirectory(*fsckPtr)
+		if err != nil {
+			log.Fatalf("monimelt failed to check %s: %v\n", *fsckPtr, err)
+		}
+		for _, prob := range rep.Problems {
+			fmt.Println(prob.String())
+		}
+		fmt.Printf("monimelt checked %s: %d objects, %d globals, %d problems\n",
+			*fsckPtr, rep.NbObjects, rep.NbGlobals, len(rep.Problems))
+		if !rep.Ok() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(*diffPtr) > 0 {
+		dirs := strings.Split(*diffPtr, ",")
+		if len(dirs) != 2 {
+			log.Fatalf("monimelt bad -diff %q, expecting OLDDIR,NEWDIR\n", *diffPtr)
+		}
+		diff, err := objvalmo.DiffDirectories(dirs[0], dirs[1], objvalmo.DiffOptionsMo{Names: *diffNamesPtr})
+		if err != nil {
+			log.Fatalf("monimelt failed to diff %s: %v\n", *diffPtr, err)
+		}
+		if *diffJsonPtr {
+			err = diff.WriteJson(os.Stdout)
+		} else {
+			err = diff.WriteText(os.Stdout)
+		}
+		if err != nil {
+			log.Fatalf("monimelt failed to write diff: %v\n", err)
+		}
+		// like diff(1), the exit status tells if the dumps differ
+		if !diff.Empty() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(*restoreSqlPtr) > 0 {
+		log.Printf("monimelt should restore from SQL files in %s\n", *restoreSqlPtr)
+		if err := objvalmo.RestoreDirectoryFromSql(*restoreSqlPtr); err != nil {
+			log.Fatalf("monimelt failed to restore from SQL files in %s: %v\n", *restoreSqlPtr, err)
+		}
+		log.Printf("monimelt did restore from SQL files in %s\n", *restoreSqlPtr)
+	}
 	if len(*loadPtr) > 0 {
 		log.Printf("monimelt should initial load from %s\n", *loadPtr)
+		objvalmo.LoadWorkers = *loadWorkersPtr
 		objvalmo.LoadFromDirectory(*loadPtr)
 		log.Printf("monimelt did initial load from %s\n", *loadPtr)
+	} else if len(*loadTextPtr) > 0 {
+		log.Printf("monimelt should initial load from text %s\n", *loadTextPtr)
+		objvalmo.LoadWorkers = *loadWorkersPtr
+		objvalmo.LoadFromTextDirectory(*loadTextPtr)
+		log.Printf("monimelt did initial load from text %s\n", *loadTextPtr)
+	}
+	var autosaver *objvalmo.AutosaverMo
+	if len(*autosavePtr) > 0 {
+		autosaver = objvalmo.StartAutosave(objvalmo.AutosaveOptionsMo{
+			Dirname:   *autosavePtr,
+			Period:    *autosavePeriodPtr,
+			NbModifs:  *autosaveModifsPtr,
+			NbBackups: *autosaveBackupsPtr,
+		})
 	}
 	//
 	time.Sleep(30 * time.Millisecond)
@@ -117,11 +191,24 @@ func main() {
 	pluginend:
 	}
 	//
+	if autosaver != nil {
+		autosaver.Stop()
+		if objvalmo.NbDirtyObjects() > 0 {
+			if err := autosaver.Save(); err != nil {
+				log.Printf("monimelt failed last autosave: %v\n", err)
+			}
+		}
+	}
 	if len(*finalDumpPtr) > 0 {
 		time.Sleep(10 * time.Millisecond)
 		log.Printf("monimelt should final dump in %s\n", *finalDumpPtr)
 		objvalmo.DumpIntoDirectory(*finalDumpPtr)
 		log.Printf("monimelt did final dump in %s\n", *finalDumpPtr)
 	}
+	if len(*finalDumpTextPtr) > 0 {
+		log.Printf("monimelt should final text dump in %s\n", *finalDumpTextPtr)
+		objvalmo.DumpIntoTextDirectory(*finalDumpTextPtr)
+		log.Printf("monimelt did final text dump in %s\n", *finalDumpTextPtr)
+	}
 	log.Printf("Monimelt ending pid %d\n", os.Getpid())
 }
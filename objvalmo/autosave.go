@@ -0,0 +1,289 @@
+// file objvalmo/autosave.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//// the autosaver dumps incrementally the world into a state directory
+//// in the background, every period or after some number of
+//// modifications, when there are dirty objects. A rebound global
+//// variable is not a modification of an object, so it is autosaved
+//// only at the next period, even without dirty objects; rebind global
+//// variables with SetGlobalVariable while autosaving. After each successful
+//// autosave, a copy of the state directory is kept as a timestamped
+//// backup, and the oldest backups are pruned. A crash loses at most one
+//// period of work. Dumps are serialized by dump_mtx, so an autosave
+//// never runs together with another dump.
+
+type AutosaveOptionsMo struct {
+	Dirname   string        // the state directory, dumped incrementally
+	Period    time.Duration // autosave period, or 0
+	NbModifs  int           // autosave after that many modifications, or 0
+	BackupDir string        // defaults to Dirname + "-backups"
+	NbBackups int           // the number of kept backups, 0 for no backups
+}
+
+// the format of the timestamped backup subdirectories, in UTC so sorted
+// by time even across daylight saving changes
+const AutosaveBackupFormat = "20060102-150405.000"
+
+type AutosaverMo struct {
+	asopts      AutosaveOptionsMo
+	asstop      chan struct{}
+	asdone      chan struct{}
+	asmtx       sync.Mutex           // for the fields below
+	aslastmodif uint64               // NbModifications at the start of the last successful autosave
+	aslastglobs map[string]*ObjectMo // the global variables at that start
+	asnbsaves   int
+	aslasterr   error
+}
+
+// the files of a Sqlite store copied into a backup
+var autosave_backup_files = []string{
+	DefaultGlobalDbname + ".sqlite", DefaultGlobalDbname + ".sql",
+	DefaultUserDbname + ".sqlite", DefaultUserDbname + ".sql",
+}
+
+var autosave_mtx sync.Mutex
+var autosave_running *AutosaverMo
+
+// StartAutosave starts the only autosaver; Stop it before starting
+// another one
+func StartAutosave(opts AutosaveOptionsMo) *AutosaverMo {
+	if !validpath(opts.Dirname) || opts.Dirname == "" {
+		panic(fmt.Errorf("StartAutosave invalid dirname %q", opts.Dirname))
+	}
+	if opts.Period < 0 || opts.NbModifs < 0 || opts.NbBackups < 0 {
+		panic(fmt.Errorf("StartAutosave negative options %+v", opts))
+	}
+	if opts.Period == 0 && opts.NbModifs == 0 {
+		panic(fmt.Errorf("StartAutosave without period nor number of modifications for %s", opts.Dirname))
+	}
+	if opts.BackupDir == "" {
+		opts.BackupDir = strings.TrimRight(opts.Dirname, "/") + "-backups"
+	}
+	if !validpath(opts.BackupDir) {
+		panic(fmt.Errorf("StartAutosave invalid backup dir %q", opts.BackupDir))
+	}
+	autosave_mtx.Lock()
+	defer autosave_mtx.Unlock()
+	if autosave_running != nil {
+		panic(fmt.Errorf("StartAutosave in %s while autosaving in %s", opts.Dirname, autosave_running.asopts.Dirname))
+	}
+	as := &AutosaverMo{asopts: opts, asstop: make(chan struct{}), asdone: make(chan struct{}),
+		aslastmodif: NbModifications(), aslastglobs: globalVariablesBindings()}
+	autosave_running = as
+	log.Printf("StartAutosave %+v\n", opts)
+	go as.loop()
+	return as
+} // end StartAutosave
+
+func (as *AutosaverMo) loop() {
+	defer close(as.asdone)
+	var tickch <-chan time.Time
+	if as.asopts.Period > 0 {
+		ticker := time.NewTicker(as.asopts.Period)
+		defer ticker.Stop()
+		tickch = ticker.C
+	}
+	for {
+		select {
+		case <-as.asstop:
+			return
+		case <-tickch:
+			if NbDirtyObjects() > 0 || as.globalsRebound() {
+				as.save()
+			}
+		case <-dirty_nudge:
+			if as.asopts.NbModifs > 0 && NbDirtyObjects() > 0 &&
+				NbModifications()-as.lastModif() >= uint64(as.asopts.NbModifs) {
+				as.save()
+			}
+		}
+	}
+} // end loop
+
+func (as *AutosaverMo) lastModif() uint64 {
+	as.asmtx.Lock()
+	defer as.asmtx.Unlock()
+	return as.aslastmodif
+}
+
+// is some global variable bound to another object since the start of
+// the last successful autosave?
+func (as *AutosaverMo) globalsRebound() bool {
+	globs := globalVariablesBindings()
+	as.asmtx.Lock()
+	defer as.asmtx.Unlock()
+	if len(globs) != len(as.aslastglobs) {
+		return true
+	}
+	for gname, gpob := range globs {
+		if as.aslastglobs[gname] != gpob {
+			return true
+		}
+	}
+	return false
+} // end globalsRebound
+
+// Save autosaves now, even without changes, and then makes a backup
+func (as *AutosaverMo) Save() error {
+	return as.save()
+}
+
+func (as *AutosaverMo) save() (err error) {
+	nbmodifs := NbModifications()
+	globs := globalVariablesBindings()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("autosave into %s failed - %v", as.asopts.Dirname, r)
+		}
+		as.asmtx.Lock()
+		defer as.asmtx.Unlock()
+		as.aslasterr = err
+		// after a failure, the next modification retries
+		if err == nil {
+			as.aslastmodif = nbmodifs
+			as.aslastglobs = globs
+			as.asnbsaves++
+		} else {
+			log.Printf("autosave failed: %v\n", err)
+		}
+	}()
+	nbupserted, nbdeleted := DumpIncrementallyIntoDirectory(as.asopts.Dirname)
+	log.Printf("autosave into %s upserted %d deleted %d objects\n", as.asopts.Dirname, nbupserted, nbdeleted)
+	if as.asopts.NbBackups > 0 {
+		if err := as.backup(time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+} // end save
+
+// copy the state directory into a timestamped backup, then prune the
+// oldest backups
+func (as *AutosaverMo) backup(now time.Time) error {
+	if err := os.MkdirAll(as.asopts.BackupDir, 0750); err != nil {
+		return fmt.Errorf("autosave failed to make backup dir %s - %v", as.asopts.BackupDir, err)
+	}
+	// a backup dir is never reused: if it exists, e.g. for two saves in
+	// the same millisecond, the next millisecond is tried
+	var bakdir string
+	for {
+		bakdir = fmt.Sprintf("%s/%s", as.asopts.BackupDir, now.UTC().Format(AutosaveBackupFormat))
+		err := os.Mkdir(bakdir, 0750)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("autosave failed to make backup dir %s - %v", bakdir, err)
+		}
+		now = now.Add(time.Millisecond)
+	}
+	{
+		// a concurrent dump could change the files being copied
+		dump_mtx.Lock()
+		defer dump_mtx.Unlock()
+		for _, fname := range autosave_backup_files {
+			srcpath := as.asopts.Dirname + "/" + fname
+			if !isRegularFile(srcpath) {
+				continue
+			}
+			if err := copyFile(srcpath, bakdir+"/"+fname); err != nil {
+				return fmt.Errorf("autosave failed to backup %s - %v", srcpath, err)
+			}
+		}
+	}
+	log.Printf("autosave did backup %s\n", bakdir)
+	return as.prune()
+} // end backup
+
+// AutosaveBackups gives the sorted timestamped backup subdirectories
+// of bakdir, the oldest first
+func AutosaveBackups(bakdir string) ([]string, error) {
+	ents, err := ioutil.ReadDir(bakdir)
+	if err != nil {
+		return nil, err
+	}
+	baks := make([]string, 0, len(ents))
+	for _, ent := range ents {
+		if !ent.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(AutosaveBackupFormat, ent.Name()); err != nil {
+			continue
+		}
+		baks = append(baks, ent.Name())
+	}
+	sort.Strings(baks)
+	return baks, nil
+} // end AutosaveBackups
+
+func (as *AutosaverMo) prune() error {
+	baks, err := AutosaveBackups(as.asopts.BackupDir)
+	if err != nil {
+		return fmt.Errorf("autosave failed to list backups - %v", err)
+	}
+	for len(baks) > as.asopts.NbBackups {
+		oldpath := as.asopts.BackupDir + "/" + baks[0]
+		log.Printf("autosave pruning backup %s\n", oldpath)
+		if err := os.RemoveAll(oldpath); err != nil {
+			return fmt.Errorf("autosave failed to prune backup %s - %v", oldpath, err)
+		}
+		baks = baks[1:]
+	}
+	return nil
+} // end prune
+
+func copyFile(srcpath string, dstpath string) error {
+	src, err := os.Open(srcpath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(dstpath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+} // end copyFile
+
+// Stop stops the autosaver, waiting for its running autosave
+func (as *AutosaverMo) Stop() {
+	autosave_mtx.Lock()
+	defer autosave_mtx.Unlock()
+	if autosave_running != as {
+		return
+	}
+	autosave_running = nil
+	close(as.asstop)
+	<-as.asdone
+	log.Printf("autosave stopped in %s after %d saves\n", as.asopts.Dirname, as.NbSaves())
+} // end Stop
+
+func (as *AutosaverMo) NbSaves() int {
+	as.asmtx.Lock()
+	defer as.asmtx.Unlock()
+	return as.asnbsaves
+}
+
+// LastError gives the error of the last autosave, or nil
+func (as *AutosaverMo) LastError() error {
+	as.asmtx.Lock()
+	defer as.asmtx.Unlock()
+	return as.aslasterr
+}
@@ -0,0 +1,448 @@
+// file objvalmo/diff.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"serialmo" // import "github.com/bstarynk/monimelt/serialmo"
+)
+
+//// the semantic diff of two dumps: their rows are read without
+//// loading them into the live world, and their objects are matched by
+//// id. The values are compared by their JSON, and shown in the textual
+//// syntax of values, where objects may be followed by their name
+//// (their string value for the name predefined attribute).
+
+type DiffOptionsMo struct {
+	Names bool // show the names of the objects
+}
+
+// a change of a value, in the textual syntax; an empty Old or New
+// means an absent value
+type ValueChangeMo struct {
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+type AttrDiffMo struct {
+	Attr string `json:"attr"`
+	ValueChangeMo
+}
+
+type CompDiffMo struct {
+	Rank int `json:"rank"`
+	ValueChangeMo
+}
+
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+type ObjectDiffMo struct {
+	Id      string         `json:"id"`
+	Name    string         `json:"name,omitempty"`
+	Status  string         `json:"status"` // DiffAdded, DiffRemoved or DiffChanged
+	Space   *ValueChangeMo `json:"space,omitempty"`
+	Class   *ValueChangeMo `json:"class,omitempty"`
+	Attrs   []AttrDiffMo   `json:"attrs,omitempty"`
+	Comps   []CompDiffMo   `json:"comps,omitempty"`
+	Payload *ValueChangeMo `json:"payload,omitempty"`
+}
+
+type GlobalDiffMo struct {
+	Global string `json:"global"`
+	ValueChangeMo
+}
+
+type DumpDiffMo struct {
+	Old     string         `json:"old"`
+	New     string         `json:"new"`
+	Objects []ObjectDiffMo `json:"objects"`
+	Globals []GlobalDiffMo `json:"globals"`
+}
+
+// an object of a dump, with its values as parsed JSON
+type diffObjectMo struct {
+	dfspace string // "global" or "user"
+	dfclass string
+	dfattrs map[string]interface{}
+	dfcomps []interface{}
+	dfpayl  string // the kind and the compact JSON of the payload
+}
+
+type diffDumpMo struct {
+	ddobjects map[string]*diffObjectMo
+	ddglobals map[string]string
+}
+
+// a parser of values giving detached objects, not in the live world
+type detachedParserMo struct{}
+
+func (detachedParserMo) ParseObjptr(idstr string) (*ObjectMo, error) {
+	oid, err := serialmo.IdFromString(idstr)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectMo{obid: oid}, nil
+}
+
+func compactJson(data []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return strings.TrimSpace(string(data))
+	}
+	return buf.String()
+}
+
+// the canonical JSON of a parsed value, to compare values
+func canonicalJson(jv interface{}) string {
+	data, err := json.Marshal(jv)
+	if err != nil {
+		return fmt.Sprintf("%#v", jv)
+	}
+	return string(data)
+}
+
+func readDiffDump(st StoreMo) (*diffDumpMo, error) {
+	dd := &diffDumpMo{ddobjects: make(map[string]*diffObjectMo), ddglobals: make(map[string]string)}
+	globflags := []bool{GlobalObjects}
+	if st.HasUser() {
+		globflags = append(globflags, UserObjects)
+	}
+	for _, globflag := range globflags {
+		err := st.ObjectRows(globflag, func(row *ObjectRowMo) {
+			dob := &diffObjectMo{dfspace: databaseName(globflag), dfattrs: make(map[string]interface{})}
+			var jcont jsonObContent
+			if err := json.Unmarshal([]byte(row.JsonCont), &jcont); err != nil {
+				// shown as a class change, so not hidden
+				log.Printf("readDiffDump %v bad content of %s - %v\n", st, row.Id, err)
+				dob.dfclass = "?bad JSON content"
+			} else {
+				dob.dfclass = jcont.Jclass
+				for _, jat := range jcont.Jattrs {
+					dob.dfattrs[jat.Jat] = jat.Jva
+				}
+				dob.dfcomps = jcont.Jcomps
+			}
+			if row.PaylKind != "" {
+				dob.dfpayl = row.PaylKind + " " + compactJson([]byte(row.PaylCont))
+			}
+			dd.ddobjects[row.Id] = dob
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the %s objects of %v - %v", databaseName(globflag), st, err)
+		}
+		err = st.GlobalRows(globflag, func(globname string, idstr string) {
+			dd.ddglobals[globname] = idstr
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the %s globals of %v - %v", databaseName(globflag), st, err)
+		}
+	}
+	return dd, nil
+} // end readDiffDump
+
+// the names of the objects of a dump
+func (dd *diffDumpMo) names(names map[string]string) {
+	nameid := Predef_02hL3RuX4x6_6y6PTK9vZs7().ToString()
+	for idstr, dob := range dd.ddobjects {
+		if name, ok := dob.dfattrs[nameid].(string); ok {
+			names[idstr] = name
+		}
+	}
+}
+
+type diffRendererMo struct {
+	dfnames map[string]string // nil without names
+}
+
+func (dr *diffRendererMo) label(idstr string) string {
+	if name, found := dr.dfnames[idstr]; found {
+		return fmt.Sprintf("%s(%s)", idstr, name)
+	}
+	return idstr
+}
+
+// show a parsed JSON value in the textual syntax
+func (dr *diffRendererMo) value(jv interface{}) (text string) {
+	defer func() {
+		// some malformed values make the parser panic
+		if r := recover(); r != nil {
+			text = canonicalJson(jv)
+		}
+	}()
+	v, err := JasonParseVal(detachedParserMo{}, jv)
+	if err != nil {
+		return canonicalJson(jv)
+	}
+	return dr.valueText(v)
+}
+
+func (dr *diffRendererMo) valueText(v ValueMo) string {
+	seqtext := func(sq SequenceV, begc string, endc string) string {
+		elems := make([]string, sq.Length())
+		for ix := range elems {
+			elems[ix] = dr.label(sq.At(ix).ToString())
+		}
+		return begc + strings.Join(elems, " ") + endc
+	}
+	switch tv := v.(type) {
+	case nil:
+		return "~"
+	case RefobV:
+		return dr.label(tv.IdOb().ToString())
+	case SetV:
+		return seqtext(tv.SequenceV, "{", "}")
+	case TupleV:
+		return seqtext(tv.SequenceV, "[", "]")
+	case NodeV:
+		sons := make([]string, len(tv.nsons))
+		for ix, son := range tv.nsons {
+			sons[ix] = dr.valueText(son)
+		}
+		return "*" + dr.label(tv.ConnId().ToString()) + "(" + strings.Join(sons, " ") + ")"
+	}
+	return ValueString(v)
+} // end valueText
+
+func (dr *diffRendererMo) diffObject(idstr string, olddob *diffObjectMo, newdob *diffObjectMo) *ObjectDiffMo {
+	od := &ObjectDiffMo{Id: idstr, Name: dr.dfnames[idstr], Status: DiffChanged}
+	switch {
+	case olddob == nil:
+		od.Status = DiffAdded
+		olddob = &diffObjectMo{}
+	case newdob == nil:
+		od.Status = DiffRemoved
+		newdob = &diffObjectMo{}
+	}
+	if olddob.dfspace != newdob.dfspace {
+		od.Space = &ValueChangeMo{Old: olddob.dfspace, New: newdob.dfspace}
+	}
+	if olddob.dfclass != newdob.dfclass {
+		od.Class = &ValueChangeMo{}
+		if olddob.dfclass != "" {
+			od.Class.Old = dr.label(olddob.dfclass)
+		}
+		if newdob.dfclass != "" {
+			od.Class.New = dr.label(newdob.dfclass)
+		}
+	}
+	atids := make([]string, 0, len(olddob.dfattrs)+len(newdob.dfattrs))
+	for atid := range olddob.dfattrs {
+		atids = append(atids, atid)
+	}
+	for atid := range newdob.dfattrs {
+		if _, found := olddob.dfattrs[atid]; !found {
+			atids = append(atids, atid)
+		}
+	}
+	sort.Strings(atids)
+	for _, atid := range atids {
+		oldjv, oldfound := olddob.dfattrs[atid]
+		newjv, newfound := newdob.dfattrs[atid]
+		if oldfound && newfound && canonicalJson(oldjv) == canonicalJson(newjv) {
+			continue
+		}
+		ad := AttrDiffMo{Attr: dr.label(atid)}
+		if oldfound {
+			ad.Old = dr.value(oldjv)
+		}
+		if newfound {
+			ad.New = dr.value(newjv)
+		}
+		od.Attrs = append(od.Attrs, ad)
+	}
+	// the components are compared rank by rank
+	for rk := 0; rk < len(olddob.dfcomps) || rk < len(newdob.dfcomps); rk++ {
+		cd := CompDiffMo{Rank: rk}
+		if rk < len(olddob.dfcomps) && rk < len(newdob.dfcomps) &&
+			canonicalJson(olddob.dfcomps[rk]) == canonicalJson(newdob.dfcomps[rk]) {
+			continue
+		}
+		if rk < len(olddob.dfcomps) {
+			cd.Old = dr.value(olddob.dfcomps[rk])
+		}
+		if rk < len(newdob.dfcomps) {
+			cd.New = dr.value(newdob.dfcomps[rk])
+		}
+		od.Comps = append(od.Comps, cd)
+	}
+	if olddob.dfpayl != newdob.dfpayl {
+		od.Payload = &ValueChangeMo{Old: olddob.dfpayl, New: newdob.dfpayl}
+	}
+	if od.Status == DiffChanged && od.Space == nil && od.Class == nil &&
+		len(od.Attrs) == 0 && len(od.Comps) == 0 && od.Payload == nil {
+		return nil
+	}
+	return od
+} // end diffObject
+
+// DiffStores compares the dumps of oldst and newst
+func DiffStores(oldst StoreMo, newst StoreMo, opts DiffOptionsMo) (*DumpDiffMo, error) {
+	olddd, err := readDiffDump(oldst)
+	if err != nil {
+		return nil, err
+	}
+	newdd, err := readDiffDump(newst)
+	if err != nil {
+		return nil, err
+	}
+	dr := &diffRendererMo{}
+	if opts.Names {
+		// the new names are preferred
+		dr.dfnames = make(map[string]string)
+		olddd.names(dr.dfnames)
+		newdd.names(dr.dfnames)
+	}
+	diff := &DumpDiffMo{Old: fmt.Sprintf("%v", oldst), New: fmt.Sprintf("%v", newst),
+		Objects: []ObjectDiffMo{}, Globals: []GlobalDiffMo{}}
+	ids := make([]string, 0, len(olddd.ddobjects)+len(newdd.ddobjects))
+	for idstr := range olddd.ddobjects {
+		ids = append(ids, idstr)
+	}
+	for idstr := range newdd.ddobjects {
+		if _, found := olddd.ddobjects[idstr]; !found {
+			ids = append(ids, idstr)
+		}
+	}
+	sort.Strings(ids)
+	for _, idstr := range ids {
+		if od := dr.diffObject(idstr, olddd.ddobjects[idstr], newdd.ddobjects[idstr]); od != nil {
+			diff.Objects = append(diff.Objects, *od)
+		}
+	}
+	globnames := sortedKeys(olddd.ddglobals)
+	for _, gname := range sortedKeys(newdd.ddglobals) {
+		if _, found := olddd.ddglobals[gname]; !found {
+			globnames = append(globnames, gname)
+		}
+	}
+	sort.Strings(globnames)
+	for _, gname := range globnames {
+		oldid, newid := olddd.ddglobals[gname], newdd.ddglobals[gname]
+		if oldid == newid {
+			continue
+		}
+		gd := GlobalDiffMo{Global: gname}
+		if oldid != "" {
+			gd.Old = dr.label(oldid)
+		}
+		if newid != "" {
+			gd.New = dr.label(newid)
+		}
+		diff.Globals = append(diff.Globals, gd)
+	}
+	log.Printf("DiffStores %v %v: %d objects and %d globals differ\n",
+		oldst, newst, len(diff.Objects), len(diff.Globals))
+	return diff, nil
+} // end DiffStores
+
+// OpenDumpStore gives the store of a dump directory, textual if it
+// has a manifest, else Sqlite
+func OpenDumpStore(dirname string) (StoreMo, error) {
+	if dirname == "" {
+		dirname = "."
+	}
+	if _, err := os.Stat(filepath.Join(dirname, TextManifestName)); err == nil {
+		return NewTextStore(dirname), nil
+	}
+	ss := NewSqliteStore(dirname)
+	if !isRegularFile(ss.ssglobalpath) {
+		return nil, fmt.Errorf("no dump in %s", dirname)
+	}
+	return ss, nil
+} // end OpenDumpStore
+
+// DiffDirectories compares the dumps in olddir and newdir
+func DiffDirectories(olddir string, newdir string, opts DiffOptionsMo) (*DumpDiffMo, error) {
+	oldst, err := OpenDumpStore(olddir)
+	if err != nil {
+		return nil, err
+	}
+	defer oldst.Close()
+	newst, err := OpenDumpStore(newdir)
+	if err != nil {
+		return nil, err
+	}
+	defer newst.Close()
+	diff, err := DiffStores(oldst, newst, opts)
+	if err != nil {
+		return nil, err
+	}
+	diff.Old, diff.New = olddir, newdir
+	return diff, nil
+} // end DiffDirectories
+
+func (diff *DumpDiffMo) Empty() bool {
+	return len(diff.Objects) == 0 && len(diff.Globals) == 0
+}
+
+// WriteJson writes the machine readable diff
+func (diff *DumpDiffMo) WriteJson(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", " ")
+	return enc.Encode(diff)
+}
+
+func writeChange(bw *bufio.Writer, what string, vc ValueChangeMo) {
+	switch {
+	case vc.Old == "":
+		fmt.Fprintf(bw, "  + %s = %s\n", what, vc.New)
+	case vc.New == "":
+		fmt.Fprintf(bw, "  - %s = %s\n", what, vc.Old)
+	default:
+		fmt.Fprintf(bw, "  ~ %s: %s -> %s\n", what, vc.Old, vc.New)
+	}
+}
+
+// WriteText writes the human readable diff, one line per change
+func (diff *DumpDiffMo) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "--- %s\n+++ %s\n", diff.Old, diff.New)
+	marks := map[string]string{DiffAdded: "+", DiffRemoved: "-", DiffChanged: "~"}
+	for _, od := range diff.Objects {
+		label := od.Id
+		if od.Name != "" {
+			label = fmt.Sprintf("%s(%s)", od.Id, od.Name)
+		}
+		fmt.Fprintf(bw, "%s object %s\n", marks[od.Status], label)
+		if od.Space != nil {
+			writeChange(bw, "space", *od.Space)
+		}
+		if od.Class != nil {
+			writeChange(bw, "class", *od.Class)
+		}
+		for _, ad := range od.Attrs {
+			writeChange(bw, "attr "+ad.Attr, ad.ValueChangeMo)
+		}
+		for _, cd := range od.Comps {
+			writeChange(bw, fmt.Sprintf("comp#%d", cd.Rank), cd.ValueChangeMo)
+		}
+		if od.Payload != nil {
+			writeChange(bw, "payload", *od.Payload)
+		}
+	}
+	for _, gd := range diff.Globals {
+		switch {
+		case gd.Old == "":
+			fmt.Fprintf(bw, "+ global %s = %s\n", gd.Global, gd.New)
+		case gd.New == "":
+			fmt.Fprintf(bw, "- global %s = %s\n", gd.Global, gd.Old)
+		default:
+			fmt.Fprintf(bw, "~ global %s: %s -> %s\n", gd.Global, gd.Old, gd.New)
+		}
+	}
+	return bw.Flush()
+} // end WriteText
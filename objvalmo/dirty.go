@@ -0,0 +1,117 @@
+// file objvalmo/dirty.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+//// the dirty set: every non-transient object modified (by UnsyncTouch,
+//// so by any mutator) since the last incremental dump or load. An
+//// incremental dump (or its first full dump) takes the dirty set at
+//// its start, and restores it if it fails. Other full dumps, maybe
+//// into another store, keep it, since the mtimes of the objects, in
+//// seconds, cannot tell their later changes in the same second.
+
+var dirty_mtx sync.Mutex
+var dirty_map map[*ObjectMo]struct{} = make(map[*ObjectMo]struct{})
+
+// the number of modifications ever, updated atomically
+var dirty_nbmodifs uint64
+
+// nudged (without blocking) at every modification, for the autosaver
+var dirty_nudge = make(chan struct{}, 1)
+
+// called with pob locked, or not yet shared
+func markDirty(pob *ObjectMo) {
+	if pob.obspace == SpaTransient {
+		return
+	}
+	dirty_mtx.Lock()
+	defer dirty_mtx.Unlock()
+	dirty_map[pob] = struct{}{}
+	atomic.AddUint64(&dirty_nbmodifs, 1)
+	select {
+	case dirty_nudge <- struct{}{}:
+	default:
+	}
+}
+
+// NbModifications gives the number of modifications of non-transient
+// objects since the start
+func NbModifications() uint64 {
+	return atomic.LoadUint64(&dirty_nbmodifs)
+}
+
+func sortedObjectsOfSet(set map[*ObjectMo]struct{}) []*ObjectMo {
+	objs := make([]*ObjectMo, 0, len(set))
+	for pob := range set {
+		objs = append(objs, pob)
+	}
+	sort.Slice(objs, func(i, j int) bool {
+		return LessObptr(objs[i], objs[j])
+	})
+	return objs
+}
+
+func (pob *ObjectMo) IsDirty() bool {
+	if pob == nil {
+		return false
+	}
+	dirty_mtx.Lock()
+	defer dirty_mtx.Unlock()
+	_, found := dirty_map[pob]
+	return found
+}
+
+func NbDirtyObjects() int {
+	dirty_mtx.Lock()
+	defer dirty_mtx.Unlock()
+	return len(dirty_map)
+}
+
+// DirtyObjects gives the dirty objects, sorted by LessObptr
+func DirtyObjects() []*ObjectMo {
+	dirty_mtx.Lock()
+	defer dirty_mtx.Unlock()
+	return sortedObjectsOfSet(dirty_map)
+}
+
+// TakeDirtyObjects gives the sorted dirty objects and clears the dirty set
+func TakeDirtyObjects() []*ObjectMo {
+	dirty_mtx.Lock()
+	defer dirty_mtx.Unlock()
+	objs := sortedObjectsOfSet(dirty_map)
+	dirty_map = make(map[*ObjectMo]struct{})
+	return objs
+}
+
+func ClearDirtyObjects() {
+	dirty_mtx.Lock()
+	defer dirty_mtx.Unlock()
+	log.Printf("ClearDirtyObjects forgetting %d dirty objects\n", len(dirty_map))
+	dirty_map = make(map[*ObjectMo]struct{})
+}
+
+// MarkDirtyObjects adds back objects into the dirty set, e.g. after a
+// failed dump; transient objects are ignored
+func MarkDirtyObjects(objs ...*ObjectMo) {
+	dirty_mtx.Lock()
+	defer dirty_mtx.Unlock()
+	for _, pob := range objs {
+		if pob != nil && pob.obspace != SpaTransient {
+			dirty_map[pob] = struct{}{}
+		}
+	}
+}
+
+func UnmarkDirtyObjects(objs ...*ObjectMo) {
+	dirty_mtx.Lock()
+	defer dirty_mtx.Unlock()
+	for _, pob := range objs {
+		delete(dirty_map, pob)
+	}
+}
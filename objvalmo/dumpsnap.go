@@ -0,0 +1,76 @@
+// file objvalmo/dumpsnap.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"fmt"
+	"log"
+)
+
+//// consistent dumps: when the dumper scans an object, it copies its
+//// space, mtime, class, attributes, components and payload while the
+//// object is locked, and later emits that snapshot. So other goroutines
+//// may keep mutating objects during a dump: every dumped object is
+//// in a state it had at some instant of the scan. Values are
+//// immutable, so copying the attribute map and the component slice is
+//// enough; payloads are mutable, so they should implement
+//// PayloadSnapshotMo to be copied too.
+
+// PayloadSnapshotMo is implemented by payloads able to copy their
+// state for a dump; SnapshotPayl is called with pob locked, and should
+// not lock any object.
+type PayloadSnapshotMo interface {
+	SnapshotPayl(pob *ObjectMo) PayloadMo
+}
+
+type dumpSnapshotMo struct {
+	snspace  uint8
+	snmtime  int64
+	snclass  *ObjectMo
+	snattrs  map[*ObjectMo]ValueMo
+	sncomps  []ValueMo
+	snpayl   PayloadMo
+	snpaylcp bool // true if snpayl is a copy, false if it is the live payload
+}
+
+// take the snapshot of pob, once per dump
+func (du *DumperMo) snapshotObject(pob *ObjectMo) *dumpSnapshotMo {
+	if snap := du.dusnapshots[pob]; snap != nil {
+		return snap
+	}
+	pob.obmtx.Lock()
+	snap := &dumpSnapshotMo{snspace: pob.obspace, snmtime: pob.obmtime, snclass: pob.obclass}
+	snap.snattrs = make(map[*ObjectMo]ValueMo, len(pob.obattrs))
+	for patob, pval := range pob.obattrs {
+		snap.snattrs[patob] = pval
+	}
+	snap.sncomps = make([]ValueMo, len(pob.obcomps))
+	copy(snap.sncomps, pob.obcomps)
+	if pob.obpayl != nil {
+		if psnap, ok := pob.obpayl.(PayloadSnapshotMo); ok {
+			snap.snpayl = psnap.SnapshotPayl(pob)
+			snap.snpaylcp = true
+		} else {
+			snap.snpayl = pob.obpayl
+		}
+	}
+	pob.obmtx.Unlock()
+	if snap.snpayl != nil && !snap.snpaylcp {
+		log.Printf("snapshotObject pob=%v payload %T without snapshot\n", pob, snap.snpayl)
+	}
+	du.dusnapshots[pob] = snap
+	// the object may have moved to another space since it was added
+	if snap.snspace != SpaTransient {
+		du.dusetobjects[pob] = snap.snspace
+	}
+	return snap
+} // end snapshotObject
+
+// the snapshot of an already scanned object
+func (du *DumperMo) scannedSnapshot(pob *ObjectMo) *dumpSnapshotMo {
+	snap := du.dusnapshots[pob]
+	if snap == nil {
+		panic(fmt.Errorf("dumper: no snapshot of unscanned object %v", pob))
+	}
+	return snap
+}
@@ -0,0 +1,319 @@
+// file objvalmo/fsck.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"serialmo" // import "github.com/bstarynk/monimelt/serialmo"
+)
+
+//// the consistency checker of dump directories: FsckDirectory reads
+//// the rows of a dump, without loading them, so the live world is not
+//// changed; the object references are resolved against the ids of the
+//// dump only. It reports bad ids, malformed JSON, dangling references,
+//// unknown payload kinds, globals of missing objects and, for Sqlite,
+//// .sql files out of date with their database.
+
+type FsckReportMo struct {
+	Dirname   string
+	NbObjects int
+	NbGlobals int
+	Problems  []LoadProblemMo
+}
+
+func (rep *FsckReportMo) Ok() bool {
+	return len(rep.Problems) == 0
+}
+
+type fsckCheckerMo struct {
+	fkreport *FsckReportMo
+	fkids    map[string]bool // the ids of both databases
+	fkglobs  map[string]bool // the ids of the global database
+	// the object row being checked
+	fkglobflag bool
+	fkcurid    string
+	fkcurcol   string
+	fkdangling int // number of bad references found
+}
+
+func (fk *fsckCheckerMo) problem(globflag bool, table string, idstr string, column string, reason string) {
+	lp := LoadProblemMo{Database: databaseName(globflag), Table: table, ObjId: idstr, Column: column, Reason: reason}
+	log.Printf("fsck problem %v\n", lp)
+	fk.fkreport.Problems = append(fk.fkreport.Problems, lp)
+}
+
+// the checker is the parser of the values, giving detached objects
+// which are not in the live world
+func (fk *fsckCheckerMo) ParseObjptr(idstr string) (*ObjectMo, error) {
+	oid, err := serialmo.IdFromString(idstr)
+	if err != nil {
+		err = fmt.Errorf("bad reference %q: %v", idstr, err)
+	} else if !fk.fkids[idstr] {
+		err = fmt.Errorf("dangling reference to %s", idstr)
+	}
+	if err != nil {
+		fk.fkdangling++
+		fk.problem(fk.fkglobflag, "t_objects", fk.fkcurid, fk.fkcurcol, err.Error())
+		return nil, err
+	}
+	return &ObjectMo{obid: oid}, nil
+} // end ParseObjptr
+
+func (fk *fsckCheckerMo) checkValue(what string, jv interface{}) {
+	before := fk.fkdangling
+	defer func() {
+		// some malformed values make the parser panic
+		if r := recover(); r != nil {
+			fk.problem(fk.fkglobflag, "t_objects", fk.fkcurid, fk.fkcurcol, fmt.Sprintf("bad %s: %v", what, r))
+		}
+	}()
+	if _, err := JasonParseVal(fk, jv); err != nil && fk.fkdangling == before {
+		fk.problem(fk.fkglobflag, "t_objects", fk.fkcurid, fk.fkcurcol, fmt.Sprintf("bad %s: %v", what, err))
+	}
+} // end checkValue
+
+// collect the ids of a database, giving the number of its rows
+func (fk *fsckCheckerMo) collectIds(st StoreMo, globflag bool) (int, error) {
+	nbrows := 0
+	err := st.ObjectIds(globflag, func(idstr string) {
+		nbrows++
+		if _, err := serialmo.IdFromString(idstr); err != nil {
+			fk.problem(globflag, "t_objects", idstr, "ob_id", fmt.Sprintf("bad id: %v", err))
+			return
+		}
+		if !globflag && fk.fkglobs[idstr] {
+			fk.problem(globflag, "t_objects", idstr, "ob_id", "also in the global database")
+		}
+		fk.fkids[idstr] = true
+		if globflag {
+			fk.fkglobs[idstr] = true
+		}
+	})
+	return nbrows, err
+} // end collectIds
+
+func (fk *fsckCheckerMo) checkObjectRow(globflag bool, row *ObjectRowMo) {
+	if _, err := serialmo.IdFromString(row.Id); err != nil {
+		// already reported by collectIds
+		return
+	}
+	fk.fkglobflag, fk.fkcurid, fk.fkcurcol = globflag, row.Id, "ob_jsoncont"
+	var jcont jsonObContent
+	if err := json.Unmarshal([]byte(row.JsonCont), &jcont); err != nil {
+		fk.problem(globflag, "t_objects", row.Id, "ob_jsoncont", fmt.Sprintf("bad JSON content: %v", err))
+	} else {
+		if jcont.Jclass != "" {
+			fk.ParseObjptr(jcont.Jclass)
+		}
+		for atix, jat := range jcont.Jattrs {
+			fk.ParseObjptr(jat.Jat)
+			fk.checkValue(fmt.Sprintf("value of attribute#%d %s", atix, jat.Jat), jat.Jva)
+		}
+		for cix, jcomp := range jcont.Jcomps {
+			fk.checkValue(fmt.Sprintf("component#%d", cix), jcomp)
+		}
+	}
+	if row.PaylKind == "" {
+		return
+	}
+	if pl, err := PayloadLoader(row.PaylKind); pl == nil || err != nil {
+		fk.problem(globflag, "t_objects", row.Id, "ob_paylkind",
+			fmt.Sprintf("unknown payload kind %q: %v", row.PaylKind, err))
+	}
+	var jpayl interface{}
+	if strings.TrimSpace(row.PaylCont) != "" {
+		if err := json.Unmarshal([]byte(row.PaylCont), &jpayl); err != nil {
+			fk.problem(globflag, "t_objects", row.Id, "ob_paylcont", fmt.Sprintf("bad JSON payload: %v", err))
+		}
+	}
+} // end checkObjectRow
+
+// a count of the database should be the one recorded in its params
+func (fk *fsckCheckerMo) checkCount(globflag bool, params map[string]string, parname string, count int) {
+	if parstr, found := params[parname]; found && parstr != strconv.Itoa(count) {
+		fk.problem(globflag, "t_params", parname, "par_value", fmt.Sprintf("recorded %s but found %d", parstr, count))
+	}
+}
+
+func (fk *fsckCheckerMo) checkDatabase(st StoreMo, globflag bool, nbrows int) error {
+	params, err := st.Params(globflag)
+	if err != nil {
+		return err
+	}
+	fk.checkCount(globflag, params, ParNbObjects, nbrows)
+	var chain []migrationMo
+	if version, err := paramsFormatVersion(params); err != nil {
+		fk.problem(globflag, "t_params", ParFormatVersion, "par_value", fmt.Sprintf("bad format version: %v", err))
+	} else if version > DumpFormatVersion {
+		fk.problem(globflag, "t_params", ParFormatVersion, "par_value",
+			fmt.Sprintf("format %d is newer than the supported %d", version, DumpFormatVersion))
+	} else if chain, err = migrationChain(version); err != nil {
+		fk.problem(globflag, "t_params", ParFormatVersion, "par_value", err.Error())
+	}
+	// the rows are checked as the loader would see them, once migrated
+	err = st.ObjectRows(globflag, func(row *ObjectRowMo) {
+		if row.Problem != "" {
+			fk.problem(globflag, "t_objects", row.Id, "ob_id", row.Problem)
+		}
+		for _, mig := range chain {
+			if err := mig.migfun(row, globflag); err != nil {
+				fk.problem(globflag, "t_objects", row.Id, "ob_jsoncont",
+					fmt.Sprintf("migration from %d to %d failed: %v", mig.migfrom, mig.migto, err))
+				return
+			}
+		}
+		fk.checkObjectRow(globflag, row)
+	})
+	if err != nil {
+		return err
+	}
+	nbglobals := 0
+	err = st.GlobalRows(globflag, func(globname string, idstr string) {
+		nbglobals++
+		if _, err := serialmo.IdFromString(idstr); err != nil {
+			fk.problem(globflag, "t_globals", globname, "glob_oid", fmt.Sprintf("bad id %s: %v", idstr, err))
+		} else if !fk.fkids[idstr] {
+			fk.problem(globflag, "t_globals", globname, "glob_oid", fmt.Sprintf("missing object %s", idstr))
+		}
+		if GlobalVariableAddress(globname) == nil {
+			fk.problem(globflag, "t_globals", globname, "glob_name", "unknown global variable")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fk.fkreport.NbGlobals += nbglobals
+	fk.checkCount(globflag, params, ParNbGlobals, nbglobals)
+	return nil
+} // end checkDatabase
+
+// FsckStore checks the dump of st; the error is set when st cannot be
+// read at all
+func FsckStore(st StoreMo) (*FsckReportMo, error) {
+	rep := &FsckReportMo{Dirname: fmt.Sprintf("%v", st)}
+	if err := fsckStore(st, rep); err != nil {
+		return rep, err
+	}
+	sortLoadProblems(rep.Problems)
+	return rep, nil
+} // end FsckStore
+
+func fsckStore(st StoreMo, rep *FsckReportMo) error {
+	fk := &fsckCheckerMo{fkreport: rep, fkids: make(map[string]bool), fkglobs: make(map[string]bool)}
+	globflags := []bool{GlobalObjects}
+	if st.HasUser() {
+		globflags = append(globflags, UserObjects)
+	}
+	nbrows := make([]int, len(globflags))
+	for ix, globflag := range globflags {
+		nb, err := fk.collectIds(st, globflag)
+		if err != nil {
+			return fmt.Errorf("fsck failed to read the %s objects of %v - %v", databaseName(globflag), st, err)
+		}
+		nbrows[ix] = nb
+		rep.NbObjects += nb
+	}
+	for ix, globflag := range globflags {
+		if err := fk.checkDatabase(st, globflag, nbrows[ix]); err != nil {
+			return fmt.Errorf("fsck failed to check the %s database of %v - %v", databaseName(globflag), st, err)
+		}
+	}
+	log.Printf("fsck %v checked %d objects and %d globals, with %d problems\n",
+		st, rep.NbObjects, rep.NbGlobals, len(rep.Problems))
+	return nil
+} // end fsckStore
+
+// FsckDirectory checks the dump in dirname, textual or Sqlite
+func FsckDirectory(dirname string) (*FsckReportMo, error) {
+	if dirname == "" {
+		dirname = "."
+	}
+	if _, err := os.Stat(filepath.Join(dirname, TextManifestName)); err == nil {
+		rep, err := FsckStore(NewTextStore(dirname))
+		rep.Dirname = dirname
+		return rep, err
+	}
+	rep := &FsckReportMo{Dirname: dirname}
+	ss := NewSqliteStore(dirname)
+	if !isRegularFile(ss.ssglobalpath) {
+		return rep, fmt.Errorf("FsckDirectory %s has no global database %s", dirname, ss.ssglobalpath)
+	}
+	err := fsckStore(ss, rep)
+	ss.Close()
+	if err != nil {
+		return rep, err
+	}
+	fsckSqlFiles(rep, dirname)
+	sortLoadProblems(rep.Problems)
+	return rep, nil
+} // end FsckDirectory
+
+// the .sql file of each database should be its SQL text, and not be older
+func fsckSqlFiles(rep *FsckReportMo, dirname string) {
+	for _, globflag := range []bool{GlobalObjects, UserObjects} {
+		dbname := DefaultGlobalDbname
+		if !globflag {
+			dbname = DefaultUserDbname
+		}
+		dbpath := filepath.Join(dirname, dbname+".sqlite")
+		sqlpath := filepath.Join(dirname, dbname+".sql")
+		dbinf, err := os.Stat(dbpath)
+		if err != nil {
+			continue
+		}
+		fileproblem := func(column string, reason string) {
+			lp := LoadProblemMo{Database: databaseName(globflag), Table: "files", ObjId: dbname + ".sql", Column: column, Reason: reason}
+			log.Printf("fsck problem %v\n", lp)
+			rep.Problems = append(rep.Problems, lp)
+		}
+		sqlinf, err := os.Stat(sqlpath)
+		if err != nil {
+			fileproblem("mtime", fmt.Sprintf("missing SQL text: %v", err))
+			continue
+		}
+		if sqlinf.ModTime().Before(dbinf.ModTime()) {
+			fileproblem("mtime", fmt.Sprintf("older than %s.sqlite", dbname))
+		}
+		if reason := sqlTextMismatch(dbpath, sqlpath, databaseName(globflag), dbname); reason != "" {
+			fileproblem("content", reason)
+		}
+	}
+} // end fsckSqlFiles
+
+// compare the .sql file with the SQL text of its database, giving the
+// reason of a mismatch or ""
+func sqlTextMismatch(dbpath string, sqlpath string, kind string, dbname string) string {
+	sqltext, err := ioutil.ReadFile(sqlpath)
+	if err != nil {
+		return err.Error()
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbpath+"?mode=ro&cache=private")
+	if err != nil {
+		return err.Error()
+	}
+	defer db.Close()
+	var buf bytes.Buffer
+	stacmt, endcmt := sqlTextComments(kind, dbname)
+	if err := WriteSqlText(db, &buf, stacmt, endcmt); err != nil {
+		return fmt.Sprintf("cannot make SQL text of %s.sqlite: %v", dbname, err)
+	}
+	if bytes.Equal(buf.Bytes(), sqltext) {
+		return ""
+	}
+	dblines := strings.Split(buf.String(), "\n")
+	sqllines := strings.Split(string(sqltext), "\n")
+	lix := 0
+	for lix < len(dblines) && lix < len(sqllines) && dblines[lix] == sqllines[lix] {
+		lix++
+	}
+	return fmt.Sprintf("differs from %s.sqlite at line %d", dbname, lix+1)
+} // end sqlTextMismatch
@@ -0,0 +1,33 @@
+// file objvalmo/intern.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"log"
+)
+
+//// optional hash-consing of immutable values. An interner keeps
+//// weak references to the storage of the values it has seen, keyed
+//// by their Hash(), so equal values share their strings or slices,
+//// but unused values can still be garbage collected. Only values
+//// owning some storage (strings, byte blobs, sets, tuples, nodes)
+//// are interned; others are returned as they are.
+//// The weak references need Go 1.24 (see intern_weak.go); with older
+//// Go, intern_noweak.go gives an interner returning values as they are.
+
+type InternStatsMo struct {
+	Hits    uint64 // number of values found already interned
+	Misses  uint64 // number of values added
+	Entries int    // number of entries, some maybe dead
+}
+
+// the interface of value parsers able to intern parsed values
+type JsonValInternerMo interface {
+	InternValue(ValueMo) ValueMo
+}
+
+func (vi *ValueInternerMo) LogStats(msg string) {
+	st := vi.Stats()
+	log.Printf("%s value interner: %d hits, %d misses, %d entries\n",
+		msg, st.Hits, st.Misses, st.Entries)
+}
@@ -0,0 +1,44 @@
+// file objvalmo/intern_noweak.go
+
+//go:build !go1.24
+// +build !go1.24
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"sync"
+)
+
+//// without weak references (before Go 1.24), the interner shares
+//// nothing: it only counts the values given to it, as misses.
+
+type ValueInternerMo struct {
+	vimtx    sync.Mutex
+	vimisses uint64
+}
+
+func NewValueInterner() *ValueInternerMo {
+	return new(ValueInternerMo)
+}
+
+// Intern gives v itself
+func (vi *ValueInternerMo) Intern(v ValueMo) ValueMo {
+	if vi == nil || v == nil {
+		return v
+	}
+	vi.vimtx.Lock()
+	defer vi.vimtx.Unlock()
+	vi.vimisses++
+	return v
+}
+
+// Purge has nothing to remove
+func (vi *ValueInternerMo) Purge() int {
+	return 0
+}
+
+func (vi *ValueInternerMo) Stats() InternStatsMo {
+	vi.vimtx.Lock()
+	defer vi.vimtx.Unlock()
+	return InternStatsMo{Misses: vi.vimisses}
+}
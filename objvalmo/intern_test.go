@@ -0,0 +1,78 @@
+// file objvalmo/intern_test.go
+
+//go:build go1.24
+// +build go1.24
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func TestValueInterner(t *testing.T) {
+	vi := NewValueInterner()
+	ob1 := NewObj()
+	ob2 := NewObj()
+	s1 := vi.Intern(MakeStringV("some interned string"))
+	s2 := vi.Intern(MakeStringV("some interned " + fmt.Sprint("string")))
+	if unsafe.StringData(s1.(StringV).str) != unsafe.StringData(s2.(StringV).str) {
+		t.Errorf("TestValueInterner strings not shared")
+	}
+	set1 := vi.Intern(MakeSetV(ob1, ob2))
+	set2 := vi.Intern(MakeSetV(ob2, ob1))
+	if &set1.(SetV).scomps[0] != &set2.(SetV).scomps[0] || !EqualValues(set1, set2) {
+		t.Errorf("TestValueInterner sets not shared")
+	}
+	tup := vi.Intern(MakeTupleV(ob1, ob2))
+	if EqualValues(tup, set1) {
+		t.Errorf("TestValueInterner tuple equal to set")
+	}
+	if iv := vi.Intern(MakeIntV(3)); iv != MakeIntV(3) {
+		t.Errorf("TestValueInterner changed an integer")
+	}
+	st := vi.Stats()
+	fmt.Printf("TestValueInterner stats %+v\n", st)
+	if st.Hits != 2 || st.Misses != 3 {
+		t.Errorf("TestValueInterner bad stats %+v", st)
+	}
+	set1, set2, tup = nil, nil, nil
+	runtime.GC()
+	runtime.GC()
+	fmt.Printf("TestValueInterner purged %d dead entries\n", vi.Purge())
+	if st := vi.Stats(); st.Entries > 2 {
+		t.Errorf("TestValueInterner dead entries remain %+v", st)
+	}
+	runtime.KeepAlive(s1)
+	runtime.KeepAlive(s2)
+}
+
+type internTestParser struct {
+	JsonSimpleValParser
+	vi *ValueInternerMo
+}
+
+func (itp internTestParser) InternValue(v ValueMo) ValueMo {
+	return itp.vi.Intern(v)
+}
+
+func TestJsonInterning(t *testing.T) {
+	itp := internTestParser{vi: NewValueInterner()}
+	ob := NewObj()
+	js := fmt.Sprintf(`{"node":"%v","sons":["abc",{"set":["%v"]},"abc",{"set":["%v"]}]}`, ob, ob, ob)
+	var jv interface{}
+	json.Unmarshal(([]byte)(js), &jv)
+	v, err := JasonParseVal(itp, jv)
+	if err != nil {
+		t.Errorf("TestJsonInterning failed to parse %s: %v", js, err)
+		return
+	}
+	st := itp.vi.Stats()
+	fmt.Printf("TestJsonInterning v=%v stats %+v\n", v, st)
+	if st.Hits != 2 || st.Misses != 3 {
+		t.Errorf("TestJsonInterning bad stats %+v", st)
+	}
+}
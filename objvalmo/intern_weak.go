@@ -0,0 +1,211 @@
+// file objvalmo/intern_weak.go
+
+//go:build go1.24
+// +build go1.24
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"bytes"
+	"serialmo" // import "github.com/bstarynk/monimelt/serialmo"
+	"slices"
+	"strings"
+	"sync"
+	"unsafe"
+	"weak"
+)
+
+//// the interner with weak references to the storage of values
+
+type internEntry struct {
+	ietype  uint
+	ielen   int
+	iebytes weak.Pointer[byte]      // for strings and byte blobs
+	ieobjs  weak.Pointer[*ObjectMo] // for sets and tuples
+	ievals  weak.Pointer[ValueMo]   // for node sons
+	ieconn  weak.Pointer[ObjectMo]  // for node connective
+}
+
+type ValueInternerMo struct {
+	vimtx    sync.Mutex
+	vimap    map[serialmo.HashMo][]internEntry
+	vihits   uint64
+	vimisses uint64
+}
+
+func NewValueInterner() *ValueInternerMo {
+	vi := new(ValueInternerMo)
+	vi.vimap = make(map[serialmo.HashMo][]internEntry)
+	return vi
+}
+
+func internable(v ValueMo) bool {
+	switch v.TypeV() {
+	case TyStringV:
+		return len(v.(StringV).str) > 0
+	case TyBytesV:
+		return len(v.(BytesV).bydata) > 0
+	case TySetV:
+		return len(v.(SetV).scomps) > 0
+	case TyTupleV:
+		return len(v.(TupleV).scomps) > 0
+	case TyNodeV:
+		return true
+	}
+	return false
+}
+
+// a copy of v with its own freshly heap-allocated storage, since weak
+// pointers cannot refer to static data like string literals
+func cloneValueStorage(v ValueMo) ValueMo {
+	switch v.TypeV() {
+	case TyStringV:
+		sv := v.(StringV)
+		return StringV{shash: sv.shash, str: strings.Clone(sv.str)}
+	case TyBytesV:
+		bv := v.(BytesV)
+		return BytesV{byhash: bv.byhash, bydata: bytes.Clone(bv.bydata)}
+	case TySetV:
+		sq := v.(SetV).SequenceV
+		return SetV{SequenceV{shash: sq.shash, scomps: slices.Clone(sq.scomps)}}
+	case TyTupleV:
+		sq := v.(TupleV).SequenceV
+		return TupleV{SequenceV{shash: sq.shash, scomps: slices.Clone(sq.scomps)}}
+	case TyNodeV:
+		nd := v.(NodeV)
+		return NodeV{nhash: nd.nhash, nconn: nd.nconn, nsons: slices.Clone(nd.nsons)}
+	}
+	return v
+}
+
+func makeInternEntry(v ValueMo) internEntry {
+	ie := internEntry{ietype: v.TypeV()}
+	switch ie.ietype {
+	case TyStringV:
+		str := v.(StringV).str
+		ie.ielen = len(str)
+		ie.iebytes = weak.Make(unsafe.StringData(str))
+	case TyBytesV:
+		bydata := v.(BytesV).bydata
+		ie.ielen = len(bydata)
+		ie.iebytes = weak.Make(&bydata[0])
+	case TySetV:
+		scomps := v.(SetV).scomps
+		ie.ielen = len(scomps)
+		ie.ieobjs = weak.Make(&scomps[0])
+	case TyTupleV:
+		scomps := v.(TupleV).scomps
+		ie.ielen = len(scomps)
+		ie.ieobjs = weak.Make(&scomps[0])
+	case TyNodeV:
+		nd := v.(NodeV)
+		ie.ielen = len(nd.nsons)
+		ie.ieconn = weak.Make(nd.nconn)
+		if ie.ielen > 0 {
+			ie.ievals = weak.Make(&nd.nsons[0])
+		}
+	}
+	return ie
+} // end makeInternEntry
+
+// gives back the value of an entry, or nil if it has been collected
+func (ie internEntry) value(h serialmo.HashMo) ValueMo {
+	switch ie.ietype {
+	case TyStringV:
+		if p := ie.iebytes.Value(); p != nil {
+			return StringV{shash: uint32(h), str: unsafe.String(p, ie.ielen)}
+		}
+	case TyBytesV:
+		if p := ie.iebytes.Value(); p != nil {
+			return BytesV{byhash: h, bydata: unsafe.Slice(p, ie.ielen)}
+		}
+	case TySetV:
+		if p := ie.ieobjs.Value(); p != nil {
+			return SetV{SequenceV{shash: h, scomps: unsafe.Slice(p, ie.ielen)}}
+		}
+	case TyTupleV:
+		if p := ie.ieobjs.Value(); p != nil {
+			return TupleV{SequenceV{shash: h, scomps: unsafe.Slice(p, ie.ielen)}}
+		}
+	case TyNodeV:
+		conn := ie.ieconn.Value()
+		if conn == nil {
+			return nil
+		}
+		if ie.ielen == 0 {
+			return NodeV{nhash: h, nconn: conn, nsons: []ValueMo{}}
+		}
+		if p := ie.ievals.Value(); p != nil {
+			return NodeV{nhash: h, nconn: conn, nsons: unsafe.Slice(p, ie.ielen)}
+		}
+	}
+	return nil
+} // end internEntry value
+
+// Intern gives an already interned value equal to v if there is one,
+// otherwise a copy of v which becomes interned
+func (vi *ValueInternerMo) Intern(v ValueMo) ValueMo {
+	if vi == nil || v == nil || !internable(v) {
+		return v
+	}
+	h := v.Hash()
+	vty := v.TypeV()
+	vi.vimtx.Lock()
+	defer vi.vimtx.Unlock()
+	oldents := vi.vimap[h]
+	newents := oldents[:0]
+	var found ValueMo
+	for _, ie := range oldents {
+		iv := ie.value(h)
+		if iv == nil {
+			// a dead entry, forget it
+			continue
+		}
+		newents = append(newents, ie)
+		if found == nil && ie.ietype == vty && EqualValues(iv, v) {
+			found = iv
+		}
+	}
+	if found != nil {
+		vi.vihits++
+	} else {
+		vi.vimisses++
+		found = cloneValueStorage(v)
+		newents = append(newents, makeInternEntry(found))
+	}
+	vi.vimap[h] = newents
+	return found
+} // end Intern
+
+// Purge removes the entries of collected values
+func (vi *ValueInternerMo) Purge() int {
+	vi.vimtx.Lock()
+	defer vi.vimtx.Unlock()
+	nbdead := 0
+	for h, oldents := range vi.vimap {
+		newents := oldents[:0]
+		for _, ie := range oldents {
+			if ie.value(h) == nil {
+				nbdead++
+				continue
+			}
+			newents = append(newents, ie)
+		}
+		if len(newents) == 0 {
+			delete(vi.vimap, h)
+		} else {
+			vi.vimap[h] = newents
+		}
+	}
+	return nbdead
+} // end Purge
+
+func (vi *ValueInternerMo) Stats() InternStatsMo {
+	vi.vimtx.Lock()
+	defer vi.vimtx.Unlock()
+	nbent := 0
+	for _, ents := range vi.vimap {
+		nbent += len(ents)
+	}
+	return InternStatsMo{Hits: vi.vihits, Misses: vi.vimisses, Entries: nbent}
+}
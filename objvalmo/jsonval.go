@@ -4,6 +4,7 @@ package objvalmo  // import "github.com/bstarynk/monimelt/objvalmo"
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	jason "github.com/antonholmquist/jason"
@@ -22,6 +23,14 @@ type jsonInt struct {
 	Jint string `json:"int"`
 }
 
+type jsonBigInt struct {
+	Jbigint string `json:"bigint"`
+}
+
+type jsonBytes struct {
+	Jbytes string `json:"bytes"`
+}
+
 type jsonFloat struct {
 	Jfloat string `json:"float"`
 }
@@ -35,8 +44,8 @@ type jsonTuple struct {
 }
 
 type jsonColInt struct {
-	Jcolori  int64  `json:"colori"`
-	Jcolorob string `json:"colorob"`
+	Jcolori  interface{} `json:"colori"` // an int64, or a string when huge
+	Jcolorob string      `json:"colorob"`
 }
 
 type jsonColString struct {
@@ -49,6 +58,11 @@ type jsonColRef struct {
 	Jcolorob string `json:"colorob"`
 }
 
+type jsonNode struct {
+	Jnode string        `json:"node"`
+	Jsons []interface{} `json:"sons"`
+}
+
 type JsonValEmitterMo interface {
 	EmitObjptr(*ObjectMo) bool
 }
@@ -145,6 +159,9 @@ func sequenceToJsonTuple(vem JsonValEmitterMo, seqv SequenceV) []string {
 
 func ValToJson(vem JsonValEmitterMo, v ValueMo) interface{} {
 	var res interface{}
+	if v == nil {
+		return nil
+	}
 	vty := v.TypeV()
 	log.Printf("ValToJson v=%#v vty:%d (%T)\n", v, vty, v)
 	defer log.Printf("ValToJson v=%v (%T) res=%v (%T)\n", v, v, res, res)
@@ -160,12 +177,24 @@ func ValToJson(vem JsonValEmitterMo, v ValueMo) interface{} {
 			}
 			return res
 		}
+	case TyBigIntV:
+		{
+			bv := v.(BigIntV)
+			res = jsonBigInt{Jbigint: bv.ToString()}
+			return res
+		}
 	case TyStringV:
 		{
 			sv := v.(StringV)
 			res = sv.ToString()
 			return res
 		}
+	case TyBytesV:
+		{
+			bv := v.(BytesV)
+			res = jsonBytes{Jbytes: base64.StdEncoding.EncodeToString(bv.bydata)}
+			return res
+		}
 	case TyFloatV:
 		{
 			fv := v.(FloatV)
@@ -189,7 +218,13 @@ func ValToJson(vem JsonValEmitterMo, v ValueMo) interface{} {
 				return nil
 			}
 			cobid := civ.ColorId()
-			res = jsonColInt{Jcolori: civ.colint, Jcolorob: cobid.ToString()}
+			var jci interface{}
+			if civ.colint > -1000000000 && civ.colint < 1000000000 {
+				jci = civ.colint
+			} else {
+				jci = fmt.Sprintf("%d", civ.colint)
+			}
+			res = jsonColInt{Jcolori: jci, Jcolorob: cobid.ToString()}
 			return res
 		}
 	case TyColStringV:
@@ -202,6 +237,30 @@ func ValToJson(vem JsonValEmitterMo, v ValueMo) interface{} {
 			res = jsonColString{Jcolorstr: csv.colstr, Jcolorob: cobid.ToString()}
 			return res
 		}
+	case TyColRefV:
+		{
+			crv := v.(ColRefV)
+			if !vem.EmitObjptr(crv.ColorRef()) || !vem.EmitObjptr(crv.ObjRef()) {
+				return nil
+			}
+			cobid := crv.ColorId()
+			robid := crv.ObjId()
+			res = jsonColRef{Jcoloref: robid.ToString(), Jcolorob: cobid.ToString()}
+			return res
+		}
+	case TyNodeV:
+		{
+			ndv := v.(NodeV)
+			if !vem.EmitObjptr(ndv.Conn()) {
+				return nil
+			}
+			jsons := make([]interface{}, 0, len(ndv.nsons))
+			for _, son := range ndv.nsons {
+				jsons = append(jsons, ValToJson(vem, son))
+			}
+			res = jsonNode{Jnode: ndv.ConnId().ToString(), Jsons: jsons}
+			return res
+		}
 	case TySetV:
 		{
 			setv := v.(SetV)
@@ -249,7 +308,20 @@ func TrivialValParser() JsonSimpleValParser {
 	return JsonSimpleValParser{}
 }
 
+// parse a JSON value, either a jason.Value or a generic JSON value
+// from encoding/json. When vpm is also a JsonValInternerMo, the parsed
+// values are interned by it.
 func JasonParseVal(vpm JsonValParserMo, jv interface{}) (ValueMo, error) {
+	resval, err := jasonParseRawVal(vpm, jv)
+	if err == nil && resval != nil {
+		if vin, ok := vpm.(JsonValInternerMo); ok {
+			resval = vin.InternValue(resval)
+		}
+	}
+	return resval, err
+} // end JasonParseVal
+
+func jasonParseRawVal(vpm JsonValParserMo, jv interface{}) (ValueMo, error) {
 	var resval ValueMo
 	var err error
 	log.Printf("JasonParseVal start jv %#v (%T)\n", jv, jv)
@@ -321,11 +393,37 @@ func JasonParseVal(vpm JsonValParserMo, jv interface{}) (ValueMo, error) {
 				err = fmt.Errorf("JasonParseVal bad jints %#v (%T)", jints, jints)
 				return nil, err
 			}
-			intnum, err := strconv.ParseInt(intstr, 0, 64)
+			resval, err = ParseIntegerV10(intstr)
+			if err != nil {
+				return nil, err
+			}
+			return resval, nil
+		} else
+		//// big integer value: {"bigint": ...}
+		if jbigs, ok := jmap["bigint"]; ok {
+			var bigstr string
+			if bigstr, ok = jbigs.(string); !ok {
+				err = fmt.Errorf("JasonParseVal bad jbigs %#v (%T)", jbigs, jbigs)
+				return nil, err
+			}
+			resval, err = ParseIntegerV10(bigstr)
 			if err != nil {
 				return nil, err
 			}
-			resval = MakeIntV(int(intnum))
+			return resval, nil
+		} else
+		//// byte blob value: {"bytes": "<base64>"}
+		if jbytes, ok := jmap["bytes"]; ok {
+			var b64str string
+			if b64str, ok = jbytes.(string); !ok {
+				err = fmt.Errorf("JasonParseVal bad jbytes %#v (%T)", jbytes, jbytes)
+				return nil, err
+			}
+			bydata, err := base64.StdEncoding.DecodeString(b64str)
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal bad base64 bytes %q: %v", b64str, err)
+			}
+			resval = MakeBytesV(bydata)
 			return resval, nil
 		} else
 		//// set value: {"set": [ ... ] }
@@ -404,7 +502,7 @@ func JasonParseVal(vpm JsonValParserMo, jv interface{}) (ValueMo, error) {
 			} else if nic, ok := jcolori.(int); ok {
 				ic = int64(nic)
 			} else if sic, ok := jcolori.(string); ok {
-				if inum, err := strconv.ParseInt(sic, 0, 64); err == nil {
+				if inum, err := strconv.ParseInt(sic, 10, 64); err == nil {
 					ic = inum
 				} else {
 					return nil, fmt.Errorf("JasonParseVal jmap %#v bad colorint %v", jmap, err)
@@ -487,6 +585,33 @@ func JasonParseVal(vpm JsonValParserMo, jv interface{}) (ValueMo, error) {
 		badcoloref:
 			return nil, fmt.Errorf("bad coloref %v : %v", jcoloref, colerr)
 		}
+		//// node value { "node" : <connective> , "sons" : [ <values> ... ] }
+		if jnode, ok := jmap["node"]; ok {
+			connids, ok := jnode.(string)
+			if !ok {
+				return nil, fmt.Errorf("JasonParseVal bad node %v", jnode)
+			}
+			connpob, err := vpm.ParseObjptr(connids)
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal invalid node connective %v", err)
+			}
+			var jsons []interface{}
+			if jsonsv, ok := jmap["sons"]; ok && jsonsv != nil {
+				if jsons, ok = jsonsv.([]interface{}); !ok {
+					return nil, fmt.Errorf("JasonParseVal bad node sons %#v (%T)", jsonsv, jsonsv)
+				}
+			}
+			sons := make([]ValueMo, 0, len(jsons))
+			for ix, json1 := range jsons {
+				son, err := JasonParseVal(vpm, json1)
+				if err != nil {
+					return nil, fmt.Errorf("JasonParseVal bad son#%d of node %s: %v", ix, connids, err)
+				}
+				sons = append(sons, son)
+			}
+			resval = MakeNodeSliceV(connpob, sons)
+			return resval, nil
+		}
 		//// otherwise, error
 		err = fmt.Errorf("JasonParseVal unexpected jmap %#v (%T)", jmap, jmap)
 		return nil, err
@@ -503,13 +628,15 @@ func JasonParseVal(vpm JsonValParserMo, jv interface{}) (ValueMo, error) {
 		return resval, nil
 	} else if num, err := jval.Number(); err == nil {
 		ns := num.String()
-		if strings.ContainsRune(ns, '.') || strings.ContainsRune(ns, 'e') || strings.ContainsRune(ns, 'e') {
+		if strings.ContainsRune(ns, '.') || strings.ContainsRune(ns, 'e') || strings.ContainsRune(ns, 'E') {
 			fv, _ := num.Float64()
 			resval = MakeFloatV(fv)
 			return resval, nil
 		} else {
-			iv, _ := num.Int64()
-			resval = MakeIntV(int(iv))
+			resval, err = ParseIntegerV10(ns)
+			if err != nil {
+				return nil, err
+			}
 			return resval, nil
 		}
 	} else if str, err := jval.String(); err == nil {
@@ -546,11 +673,23 @@ func JasonParseVal(vpm JsonValParserMo, jv interface{}) (ValueMo, error) {
 			resval = MakeFloatV(fnum)
 			return resval, nil
 		} else if intstr, err := job.GetString("int"); err == nil {
-			intnum, err := strconv.ParseInt(intstr, 0, 64)
+			resval, err = ParseIntegerV10(intstr)
+			if err != nil {
+				return nil, err
+			}
+			return resval, nil
+		} else if bigstr, err := job.GetString("bigint"); err == nil {
+			resval, err = ParseIntegerV10(bigstr)
 			if err != nil {
 				return nil, err
 			}
-			resval = MakeIntV(int(intnum))
+			return resval, nil
+		} else if b64str, err := job.GetString("bytes"); err == nil {
+			bydata, err := base64.StdEncoding.DecodeString(b64str)
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal bad base64 bytes %q: %v", b64str, err)
+			}
+			resval = MakeBytesV(bydata)
 			return resval, nil
 		} else if oelems, err := job.GetStringArray("set"); err == nil {
 			l := len(oelems)
@@ -578,6 +717,80 @@ func JasonParseVal(vpm JsonValParserMo, jv interface{}) (ValueMo, error) {
 			}
 			resval = MakeTupleSliceV(obseq)
 			return resval, nil
+		} else if jcolori, err := job.GetValue("colori"); err == nil {
+			/// colored integer value { "colori": <int> ; "colorob" : <obref> }
+			var ic int64
+			if num, err := jcolori.Number(); err == nil {
+				if ic, err = num.Int64(); err != nil {
+					return nil, fmt.Errorf("JasonParseVal bad colorint %v : %v", num, err)
+				}
+			} else if sic, err := jcolori.String(); err == nil {
+				if ic, err = strconv.ParseInt(sic, 10, 64); err != nil {
+					return nil, fmt.Errorf("JasonParseVal bad colorint %q : %v", sic, err)
+				}
+			} else {
+				return nil, fmt.Errorf("JasonParseVal bad colorint (strange \"colori\")")
+			}
+			colobs, err := job.GetString("colorob")
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal bad colorint missing \"colorob\" %v", err)
+			}
+			colpob, err := vpm.ParseObjptr(colobs)
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal bad colorint wrong \"colorob\" %v", err)
+			}
+			resval = MakeColInt(colpob, ic)
+			return resval, nil
+		} else if colstr, err := job.GetString("colorstr"); err == nil {
+			/// colored string value { "colorstr": <string> ; "colorob" : <obref> }
+			colobs, err := job.GetString("colorob")
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal bad colorstr missing \"colorob\" %v", err)
+			}
+			colpob, err := vpm.ParseObjptr(colobs)
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal bad colorstr wrong \"colorob\" %v", err)
+			}
+			resval = MakeColString(colpob, colstr)
+			return resval, nil
+		} else if colrefs, err := job.GetString("coloref"); err == nil {
+			//// colored reference value { "coloref" : <reference> , "colorob" : <color> }
+			colobs, err := job.GetString("colorob")
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal bad coloref missing \"colorob\" %v", err)
+			}
+			refpob, err := vpm.ParseObjptr(colrefs)
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal invalid coloref %v", err)
+			}
+			colpob, err := vpm.ParseObjptr(colobs)
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal invalid colorob %v", err)
+			}
+			resval = MakeColRef(colpob, refpob)
+			return resval, nil
+		} else if connids, err := job.GetString("node"); err == nil {
+			//// node value { "node" : <connective> , "sons" : [ <values> ... ] }
+			connpob, err := vpm.ParseObjptr(connids)
+			if err != nil {
+				return nil, fmt.Errorf("JasonParseVal invalid node connective %v", err)
+			}
+			var jsons []*jason.Value
+			if jsonsv, err := job.GetValue("sons"); err == nil && jsonsv.Null() != nil {
+				if jsons, err = jsonsv.Array(); err != nil {
+					return nil, fmt.Errorf("JasonParseVal bad node sons %v", err)
+				}
+			}
+			sons := make([]ValueMo, 0, len(jsons))
+			for ix, json1 := range jsons {
+				son, err := JasonParseVal(vpm, *json1)
+				if err != nil {
+					return nil, fmt.Errorf("JasonParseVal bad son#%d of node %s: %v", ix, connids, err)
+				}
+				sons = append(sons, son)
+			}
+			resval = MakeNodeSliceV(connpob, sons)
+			return resval, nil
 		} else if jval, err := job.GetValue("value"); err == nil {
 			return JasonParseVal(vpm, *jval)
 		}
@@ -0,0 +1,226 @@
+// file objvalmo/jsonval_test.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"encoding/json"
+	"fmt"
+	jason "github.com/antonholmquist/jason"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+// an emitter accepting every object
+var allJsonEmitter = MakeJsonSimpleValEmitter(func(*ObjectMo) bool { return true })
+
+// a sample of values of every kind, for round-trip testing
+func roundTripSampleValues() []ValueMo {
+	ob1 := NewObj()
+	ob2 := NewObj()
+	ob3 := NewObj()
+	col := NewObj()
+	huge, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	return []ValueMo{
+		MakeIntV(0),
+		MakeIntV(42),
+		MakeIntV(-345),
+		MakeIntV(12345678901234),
+		MakeIntV(math.MaxInt64),
+		MakeIntV(math.MinInt64),
+		MakeBigIntV(huge),
+		MakeBigIntV(new(big.Int).Lsh(big.NewInt(1), 200)),
+		MakeFloatV(3.14),
+		MakeFloatV(-0.5),
+		MakeFloatV(2.0),
+		MakeFloatV(-1.2345678901e75),
+		MakeFloatV(math.MaxFloat64),
+		MakeFloatV(math.SmallestNonzeroFloat64),
+		MakeFloatV(math.Inf(+1)),
+		MakeFloatV(math.Inf(-1)),
+		MakeStringV(""),
+		MakeStringV("abc€"),
+		MakeStringV("a\nnewline"),
+		MakeStringV(`{"oid":"__"}`),
+		MakeBytesV(nil),
+		MakeBytesV([]byte("plain")),
+		MakeBytesV([]byte{0xff, 0xfe, 0, 0x80, 'a', 0xc3}),
+		MakeRefobV(ob1),
+		MakeColInt(col, 0),
+		MakeColInt(col, -17),
+		MakeColInt(col, math.MaxInt64),
+		MakeColInt(col, math.MinInt64),
+		MakeColString(col, ""),
+		MakeColString(col, "colored\tstring"),
+		MakeColRef(col, ob2),
+		MakeSetV(ob3, ob1, ob2, ob1),
+		MakeSetV(ob2),
+		MakeTupleV(ob1, ob2, ob1, ob3),
+		MakeTupleV(ob3),
+		MakeNodeV(col),
+		MakeNodeV(ob1, MakeIntV(1), nil, MakeStringV("son"), MakeRefobV(ob2)),
+		MakeNodeV(col, MakeNodeV(ob3, MakeSetV(ob1, ob2), MakeFloatV(-2.5)),
+			MakeColRef(ob1, ob3), MakeNodeV(ob2)),
+	}
+}
+
+func checkRoundTrip(t *testing.T, path string, v ValueMo, pv ValueMo, js []byte) {
+	if !reflect.DeepEqual(v, pv) {
+		t.Errorf("%s round-trip failed v=%v (%T) json=%s pv=%v (%T)", path, v, v, js, pv, pv)
+		return
+	}
+	if v.Hash() != pv.Hash() {
+		t.Errorf("%s round-trip changed hash v=%v json=%s", path, v, js)
+	}
+}
+
+func TestJsonRoundTripMap(t *testing.T) {
+	tp := TrivialValParser()
+	for _, v := range roundTripSampleValues() {
+		js, err := json.Marshal(ValToJson(allJsonEmitter, v))
+		if err != nil {
+			t.Errorf("TestJsonRoundTripMap failed to marshal v=%v : %v", v, err)
+			continue
+		}
+		var jv interface{}
+		if err := json.Unmarshal(js, &jv); err != nil {
+			t.Errorf("TestJsonRoundTripMap failed to unmarshal %s : %v", js, err)
+			continue
+		}
+		pv, err := JasonParseVal(tp, jv)
+		if err != nil {
+			t.Errorf("TestJsonRoundTripMap failed to parse %s : %v", js, err)
+			continue
+		}
+		checkRoundTrip(t, "map", v, pv, js)
+	}
+}
+
+func TestJsonRoundTripJason(t *testing.T) {
+	tp := TrivialValParser()
+	for _, v := range roundTripSampleValues() {
+		js, err := json.Marshal(ValToJson(allJsonEmitter, v))
+		if err != nil {
+			t.Errorf("TestJsonRoundTripJason failed to marshal v=%v : %v", v, err)
+			continue
+		}
+		jv, err := jason.NewValueFromBytes(js)
+		if err != nil {
+			t.Errorf("TestJsonRoundTripJason jason failure %s : %v", js, err)
+			continue
+		}
+		pv, err := JasonParseVal(tp, *jv)
+		if err != nil {
+			t.Errorf("TestJsonRoundTripJason failed to parse %s : %v", js, err)
+			continue
+		}
+		checkRoundTrip(t, "jason", v, pv, js)
+	}
+}
+
+// the integers of JSON values are decimal, as in the textual syntax
+func TestJsonDecimalIntegers(t *testing.T) {
+	tp := TrivialValParser()
+	col := NewObj()
+	for _, tc := range []struct {
+		js   string
+		want ValueMo // nil for an error
+	}{
+		{`{"int":"010"}`, MakeIntV(10)},
+		{`{"int":"0x10"}`, nil},
+		{fmt.Sprintf(`{"colori":"010","colorob":"%s"}`, col), MakeColInt(col, 10)},
+		{fmt.Sprintf(`{"colori":"0x10","colorob":"%s"}`, col), nil},
+	} {
+		var jv interface{}
+		if err := json.Unmarshal([]byte(tc.js), &jv); err != nil {
+			t.Fatalf("TestJsonDecimalIntegers failed to unmarshal %s : %v", tc.js, err)
+		}
+		jjv, err := jason.NewValueFromBytes([]byte(tc.js))
+		if err != nil {
+			t.Fatalf("TestJsonDecimalIntegers jason failure %s : %v", tc.js, err)
+		}
+		for _, parsed := range []interface{}{jv, *jjv} {
+			pv, err := JasonParseVal(tp, parsed)
+			if tc.want == nil && err == nil {
+				t.Errorf("TestJsonDecimalIntegers %s (%T) parsed as %v", tc.js, parsed, pv)
+			} else if tc.want != nil && (err != nil || !EqualValues(pv, tc.want)) {
+				t.Errorf("TestJsonDecimalIntegers %s (%T) gives %v : %v", tc.js, parsed, pv, err)
+			}
+		}
+	}
+}
+
+func TestJsonNilValue(t *testing.T) {
+	js, err := json.Marshal(ValToJson(allJsonEmitter, nil))
+	if err != nil || string(js) != "null" {
+		t.Errorf("TestJsonNilValue bad json %s : %v", js, err)
+	}
+	pv, err := JasonParseVal(TrivialValParser(), nil)
+	if pv != nil || err != nil {
+		t.Errorf("TestJsonNilValue bad parse pv=%v err=%v", pv, err)
+	}
+}
+
+func TestValueTextRoundTrip(t *testing.T) {
+	tp := TrivialValParser()
+	for _, v := range roundTripSampleValues() {
+		txt := ValueString(v)
+		pv, err := ParseValueText(txt, tp)
+		if err != nil {
+			t.Errorf("TestValueTextRoundTrip failed to parse %s : %v", txt, err)
+			continue
+		}
+		if ValueString(pv) != txt {
+			t.Errorf("TestValueTextRoundTrip %s parsed as %s", txt, ValueString(pv))
+		}
+		if v.TypeV() != TyFloatV && !EqualValues(v, pv) {
+			t.Errorf("TestValueTextRoundTrip %s parsed as unequal %v (%T)", txt, pv, pv)
+		}
+	}
+	ob := NewObj()
+	pv, err := ParseValueText(fmt.Sprintf(" *%v( -3\n 2.5e3 [%v]\t~ ) ", ob, ob), tp)
+	if err != nil || !EqualValues(pv, MakeNodeV(ob, MakeIntV(-3), MakeFloatV(2500), MakeTupleV(ob), nil)) {
+		t.Errorf("TestValueTextRoundTrip bad spaced node %v : %v", pv, err)
+	}
+	// integers are always decimal, even with leading zeros
+	for txt, n := range map[string]int{"010": 10, "08": 8, "-007": -7, "+09": 9} {
+		if pv, err := ParseValueText(txt, tp); err != nil || !EqualValues(pv, MakeIntV(n)) {
+			t.Errorf("TestValueTextRoundTrip %s parsed as %v : %v", txt, pv, err)
+		}
+	}
+}
+
+func TestValueTextErrors(t *testing.T) {
+	tp := TrivialValParser()
+	ob := NewObj()
+	badtexts := []struct {
+		txt    string
+		offset int
+		line   int
+	}{
+		{"", 0, 1},
+		{"[_bad]", 1, 1},
+		{fmt.Sprintf("{%v", ob), 25, 1},
+		{fmt.Sprintf("%%%v?", ob), 0, 1},
+		{fmt.Sprintf("*%v(1\n  2 ?)", ob), 32, 2},
+		{`"unterminated`, 0, 1},
+		{"12 13", 3, 1},
+		{"1e+", 3, 1},
+		{`#"not base64!"`, 0, 1},
+		{"0x1F", 1, 1},
+		{"0b101", 1, 1},
+		{"1_000", 1, 1},
+	}
+	for _, bt := range badtexts {
+		v, err := ParseValueText(bt.txt, tp)
+		vterr, ok := err.(*ValueTextError)
+		if !ok {
+			t.Errorf("TestValueTextErrors %q gave v=%v err=%v", bt.txt, v, err)
+			continue
+		}
+		if vterr.Offset != bt.offset || vterr.Line != bt.line {
+			t.Errorf("TestValueTextErrors %q bad position: %v", bt.txt, vterr)
+		}
+	}
+}
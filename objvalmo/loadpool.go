@@ -0,0 +1,142 @@
+// file objvalmo/loadpool.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+//// parallel loading: the fill_content_objects and fill_payload_objects
+//// phases of the loader read their rows in one goroutine, and give the
+//// filling of each object to a pool of workers. Since create_objects
+//// has made every object before, and each object is filled by the
+//// worker of its bucket, no object is shared by two workers. Every
+//// phase waits for all its workers, so the order of the phases is
+//// kept. With several workers, the payload loaders should be safe for
+//// concurrent use on distinct objects.
+
+// the default number of loading workers; 1 loads serially, like before
+var LoadWorkers = runtime.NumCPU()
+
+// the capacity of the channel of each worker
+const loadPoolChanLen = 256
+
+type loadPoolMo struct {
+	lpchans  []chan func()
+	lpwg     sync.WaitGroup
+	lpfailed int32 // set atomically once a job panicked
+	lppanic  interface{}
+	lpmtx    sync.Mutex
+	lpclosed bool // only used by the reading goroutine
+}
+
+// SetWorkers sets the number of workers filling the objects; 0 means
+// LoadWorkers
+func (l *LoaderMo) SetWorkers(nbworkers int) {
+	if nbworkers < 0 {
+		nbworkers = 0
+	}
+	l.ldnbworkers = nbworkers
+}
+
+func (l *LoaderMo) nbWorkers() int {
+	if l.ldnbworkers > 0 {
+		return l.ldnbworkers
+	}
+	if LoadWorkers > 0 {
+		return LoadWorkers
+	}
+	return 1
+}
+
+// start a pool, or give nil when loading serially
+func (l *LoaderMo) startPool() *loadPoolMo {
+	nbw := l.nbWorkers()
+	if nbw <= 1 {
+		return nil
+	}
+	lp := &loadPoolMo{lpchans: make([]chan func(), nbw)}
+	for wix := range lp.lpchans {
+		ch := make(chan func(), loadPoolChanLen)
+		lp.lpchans[wix] = ch
+		lp.lpwg.Add(1)
+		go lp.work(ch)
+	}
+	return lp
+} // end startPool
+
+func (lp *loadPoolMo) work(ch chan func()) {
+	defer lp.lpwg.Done()
+	for job := range ch {
+		// after a failure, the remaining jobs are only drained
+		if atomic.LoadInt32(&lp.lpfailed) != 0 {
+			continue
+		}
+		lp.runJob(job)
+	}
+}
+
+func (lp *loadPoolMo) runJob(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			lp.lpmtx.Lock()
+			if lp.lppanic == nil {
+				lp.lppanic = r
+			}
+			lp.lpmtx.Unlock()
+			atomic.StoreInt32(&lp.lpfailed, 1)
+		}
+	}()
+	job()
+}
+
+// run the job filling pob, in the worker of its bucket; a nil pool
+// runs it at once
+func (lp *loadPoolMo) dispatch(pob *ObjectMo, job func()) {
+	if lp == nil {
+		job()
+		return
+	}
+	lp.lpchans[pob.obid.BucketNum()%uint(len(lp.lpchans))] <- job
+}
+
+// close the channels and wait for the workers, once
+func (lp *loadPoolMo) shutdown() {
+	if lp == nil || lp.lpclosed {
+		return
+	}
+	lp.lpclosed = true
+	for _, ch := range lp.lpchans {
+		close(ch)
+	}
+	lp.lpwg.Wait()
+} // end shutdown
+
+// wait for all the jobs, and panic like the first failed one
+func (lp *loadPoolMo) finish() {
+	if lp == nil {
+		return
+	}
+	lp.shutdown()
+	if lp.lppanic != nil {
+		log.Printf("loader pool failed: %v\n", lp.lppanic)
+		panic(lp.lppanic)
+	}
+} // end finish
+
+// run a filling phase with its pool, whose workers are joined even
+// when the reading goroutine panics, e.g. on a store error
+func (l *LoaderMo) runFillPhase(fill func(lp *loadPoolMo)) {
+	lp := l.startPool()
+	defer func() {
+		if r := recover(); r != nil {
+			lp.shutdown()
+			panic(r)
+		}
+	}()
+	fill(lp)
+	lp.finish()
+} // end runFillPhase
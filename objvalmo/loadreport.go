@@ -0,0 +1,143 @@
+// file objvalmo/loadreport.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+//// loading with diagnostics: LoadFromDirectoryE gives a report of
+//// every problem found in the databases. In strict mode the first
+//// problem aborts the load (but the objects already loaded stay in
+//// memory); in lenient mode bad objects, values, payloads or globals
+//// are skipped, so a world can be recovered after hand edits.
+
+const (
+	LoadStrict = iota
+	LoadLenient
+)
+
+type LoadOptionsMo struct {
+	Mode     uint8            // LoadStrict or LoadLenient
+	Interner *ValueInternerMo // optional, to intern the loaded values
+	Workers  int              // filling workers, 0 for LoadWorkers
+}
+
+type LoadProblemMo struct {
+	Database string // "global" or "user"
+	Table    string // e.g. "t_objects"
+	ObjId    string // the object id, or the global name in t_globals
+	Column   string // e.g. "ob_jsoncont"
+	Reason   string
+}
+
+func (lp LoadProblemMo) String() string {
+	return fmt.Sprintf("%s %s %s [%s]: %s", lp.Database, lp.Table, lp.ObjId, lp.Column, lp.Reason)
+}
+
+type LoadReportMo struct {
+	Dirname   string // the dump directory, or the store
+	Mode      uint8
+	NbObjects int // number of loaded objects
+	NbGlobals int // number of bound global variables
+	Problems  []LoadProblemMo
+}
+
+// the panic value aborting a strict load
+type loadAbortMo struct {
+	laprob LoadProblemMo
+}
+
+func databaseName(globflag bool) string {
+	if globflag {
+		return "global"
+	}
+	return "user"
+}
+
+// a problem making something (an object, a payload, a global)
+// unloadable; it may be called by several loading workers
+func (l *LoaderMo) problem(globflag bool, table string, idstr string, column string, reason string) {
+	lp := LoadProblemMo{Database: databaseName(globflag), Table: table, ObjId: idstr, Column: column, Reason: reason}
+	log.Printf("loader problem %v\n", lp)
+	if l.ldreport == nil {
+		panic(fmt.Errorf("persistmo loader %v", lp))
+	}
+	l.ldmtx.Lock()
+	defer l.ldmtx.Unlock()
+	// a strict load keeps only its first problem, even if other
+	// workers find some before being stopped
+	if l.ldreport.Mode == LoadStrict && len(l.ldreport.Problems) > 0 {
+		panic(loadAbortMo{laprob: l.ldreport.Problems[0]})
+	}
+	l.ldreport.Problems = append(l.ldreport.Problems, lp)
+	if l.ldreport.Mode == LoadStrict {
+		panic(loadAbortMo{laprob: lp})
+	}
+}
+
+// a bad value inside an object; without report, like in LoadFromDirectory,
+// it is only logged and skipped
+func (l *LoaderMo) valueProblem(globflag bool, idstr string, column string, reason string) {
+	if l.ldreport == nil {
+		log.Printf("loader skipping bad value in %s t_objects %s [%s]: %s\n",
+			databaseName(globflag), idstr, column, reason)
+		return
+	}
+	l.problem(globflag, "t_objects", idstr, column, reason)
+}
+
+// LoadFromDirectoryE loads from dirname, and gives the report of all
+// problems; the error is set on abort (in strict mode, or if the
+// databases cannot be used at all)
+func LoadFromDirectoryE(dirname string, opts LoadOptionsMo) (*LoadReportMo, error) {
+	return loadWithReport("LoadFromDirectoryE", dirname, opts, func(rep *LoadReportMo) {
+		loadDirectory(dirname, opts.Interner, opts.Workers, rep)
+	})
+} // end LoadFromDirectoryE
+
+// LoadFromStoreE is like LoadFromDirectoryE, loading from st
+func LoadFromStoreE(st StoreMo, opts LoadOptionsMo) (*LoadReportMo, error) {
+	return loadWithReport("LoadFromStoreE", fmt.Sprintf("%v", st), opts, func(rep *LoadReportMo) {
+		runLoader(OpenLoaderFromStore(st), opts.Interner, opts.Workers, rep)
+	})
+} // end LoadFromStoreE
+
+func loadWithReport(fname string, dirname string, opts LoadOptionsMo, load func(rep *LoadReportMo)) (rep *LoadReportMo, err error) {
+	rep = &LoadReportMo{Dirname: dirname, Mode: opts.Mode}
+	defer func() {
+		if r := recover(); r != nil {
+			switch rv := r.(type) {
+			case loadAbortMo:
+				err = fmt.Errorf("%s %s aborted on %v", fname, dirname, rv.laprob)
+			case error:
+				err = fmt.Errorf("%s %s failed: %v", fname, dirname, rv)
+			default:
+				err = fmt.Errorf("%s %s failed: %v", fname, dirname, rv)
+			}
+			log.Printf("%v\n", err)
+		}
+	}()
+	load(rep)
+	// the workers may have found the problems in any order
+	sortLoadProblems(rep.Problems)
+	log.Printf("%s %s loaded %d objects, %d globals, with %d problems\n",
+		fname, dirname, rep.NbObjects, rep.NbGlobals, len(rep.Problems))
+	return rep, nil
+} // end loadWithReport
+
+// sort problems by database, table and id
+func sortLoadProblems(probs []LoadProblemMo) {
+	sort.SliceStable(probs, func(i, j int) bool {
+		pi, pj := &probs[i], &probs[j]
+		if pi.Database != pj.Database {
+			return pi.Database < pj.Database
+		}
+		if pi.Table != pj.Table {
+			return pi.Table < pj.Table
+		}
+		return pi.ObjId < pj.ObjId
+	})
+}
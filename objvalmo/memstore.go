@@ -0,0 +1,341 @@
+// file objvalmo/memstore.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//// an in-memory store, mostly for tests: its databases are maps, and
+//// a dump writes a copy of them which replaces them at commit. Rows
+//// are iterated in the order of their ids, like in Sqlite.
+
+type memDatabaseMo struct {
+	mdobjects map[string]ObjectRowMo
+	mdglobals map[string]string
+	mdparams  map[string]string
+}
+
+type MemoryStoreMo struct {
+	msmtx       sync.Mutex
+	msname      string
+	msglobal    *memDatabaseMo // nil before the first committed dump
+	msuser      *memDatabaseMo
+	msdumping   bool
+	msdumpglob  *memDatabaseMo // written by the current dump
+	msdumpuser  *memDatabaseMo
+	msnbcommits int
+}
+
+func newMemDatabase() *memDatabaseMo {
+	return &memDatabaseMo{
+		mdobjects: make(map[string]ObjectRowMo),
+		mdglobals: make(map[string]string),
+		mdparams:  make(map[string]string),
+	}
+}
+
+func (md *memDatabaseMo) copy() *memDatabaseMo {
+	cp := newMemDatabase()
+	for id, row := range md.mdobjects {
+		cp.mdobjects[id] = row
+	}
+	for name, id := range md.mdglobals {
+		cp.mdglobals[name] = id
+	}
+	for name, val := range md.mdparams {
+		cp.mdparams[name] = val
+	}
+	return cp
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NewMemoryStore gives an empty store, named for the logs
+func NewMemoryStore(name string) *MemoryStoreMo {
+	return &MemoryStoreMo{msname: name}
+}
+
+func (ms *MemoryStoreMo) String() string {
+	return "MemoryStore:" + ms.msname
+}
+
+// the database read, the dumped one while dumping; nil if none
+func (ms *MemoryStoreMo) database(globflag bool) *memDatabaseMo {
+	if ms.msdumping {
+		if globflag {
+			return ms.msdumpglob
+		}
+		return ms.msdumpuser
+	}
+	if globflag {
+		return ms.msglobal
+	}
+	return ms.msuser
+}
+
+func (ms *MemoryStoreMo) readDatabase(globflag bool) (*memDatabaseMo, error) {
+	md := ms.database(globflag)
+	if md == nil {
+		return nil, fmt.Errorf("%v has no %s database", ms, databaseName(globflag))
+	}
+	return md, nil
+}
+
+// the database written by the current dump
+func (ms *MemoryStoreMo) dumpDatabase(globflag bool) (*memDatabaseMo, error) {
+	if !ms.msdumping {
+		return nil, fmt.Errorf("%v is not dumping", ms)
+	}
+	if globflag {
+		return ms.msdumpglob, nil
+	}
+	return ms.msdumpuser, nil
+}
+
+func (ms *MemoryStoreMo) HasDump() bool {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	return ms.msglobal != nil
+}
+
+func (ms *MemoryStoreMo) HasUser() bool {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	return ms.database(UserObjects) != nil
+}
+
+// NbCommits gives the number of committed dumps
+func (ms *MemoryStoreMo) NbCommits() int {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	return ms.msnbcommits
+}
+
+// NbObjectRows gives the number of object rows of a database
+func (ms *MemoryStoreMo) NbObjectRows(globflag bool) int {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	if md := ms.database(globflag); md != nil {
+		return len(md.mdobjects)
+	}
+	return 0
+}
+
+// ObjectRow gives a copy of the row of idstr, or nil
+func (ms *MemoryStoreMo) ObjectRow(globflag bool, idstr string) *ObjectRowMo {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	md := ms.database(globflag)
+	if md == nil {
+		return nil
+	}
+	if row, found := md.mdobjects[idstr]; found {
+		return &row
+	}
+	return nil
+}
+
+func (ms *MemoryStoreMo) Params(globflag bool) (map[string]string, error) {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	md, err := ms.readDatabase(globflag)
+	if err != nil {
+		return nil, err
+	}
+	params := make(map[string]string, len(md.mdparams))
+	for name, val := range md.mdparams {
+		params[name] = val
+	}
+	return params, nil
+}
+
+// the sorted rows of a database, copied so that fn may use the store
+func (ms *MemoryStoreMo) objectRows(globflag bool) ([]ObjectRowMo, error) {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	md, err := ms.readDatabase(globflag)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]ObjectRowMo, 0, len(md.mdobjects))
+	for _, row := range md.mdobjects {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Id < rows[j].Id
+	})
+	return rows, nil
+}
+
+func (ms *MemoryStoreMo) ObjectIds(globflag bool, fn func(idstr string)) error {
+	rows, err := ms.objectRows(globflag)
+	if err != nil {
+		return err
+	}
+	for ix := range rows {
+		fn(rows[ix].Id)
+	}
+	return nil
+}
+
+func (ms *MemoryStoreMo) ObjectRows(globflag bool, fn func(row *ObjectRowMo)) error {
+	rows, err := ms.objectRows(globflag)
+	if err != nil {
+		return err
+	}
+	for ix := range rows {
+		fn(&rows[ix])
+	}
+	return nil
+}
+
+func (ms *MemoryStoreMo) GlobalRows(globflag bool, fn func(globname string, idstr string)) error {
+	ms.msmtx.Lock()
+	md, err := ms.readDatabase(globflag)
+	if err != nil {
+		ms.msmtx.Unlock()
+		return err
+	}
+	names := sortedKeys(md.mdglobals)
+	ids := make([]string, len(names))
+	for ix, name := range names {
+		ids[ix] = md.mdglobals[name]
+	}
+	ms.msmtx.Unlock()
+	for ix, name := range names {
+		if ids[ix] != "" {
+			fn(name, ids[ix])
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStoreMo) BeginDump(incremental bool, dumptime time.Time) error {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	if ms.msdumping {
+		return fmt.Errorf("%v already dumping", ms)
+	}
+	if incremental && ms.msglobal != nil && ms.msuser != nil {
+		ms.msdumpglob = ms.msglobal.copy()
+		ms.msdumpuser = ms.msuser.copy()
+	} else {
+		ms.msdumpglob = newMemDatabase()
+		ms.msdumpuser = newMemDatabase()
+	}
+	ms.msdumping = true
+	log.Printf("MemoryStore BeginDump %v incremental=%t\n", ms, incremental)
+	return nil
+} // end BeginDump
+
+func (ms *MemoryStoreMo) ObjectMtimes(globflag bool) (map[string]int64, error) {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	md, err := ms.readDatabase(globflag)
+	if err != nil {
+		return nil, err
+	}
+	idmap := make(map[string]int64, len(md.mdobjects))
+	for id, row := range md.mdobjects {
+		idmap[id] = row.Mtime
+	}
+	return idmap, nil
+}
+
+func (ms *MemoryStoreMo) PutObjectRow(globflag bool, row *ObjectRowMo) error {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	md, err := ms.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	md.mdobjects[row.Id] = *row
+	return nil
+}
+
+func (ms *MemoryStoreMo) DeleteObjectRow(globflag bool, idstr string) error {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	md, err := ms.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	delete(md.mdobjects, idstr)
+	return nil
+}
+
+func (ms *MemoryStoreMo) ClearGlobals(globflag bool) error {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	md, err := ms.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	md.mdglobals = make(map[string]string)
+	return nil
+}
+
+func (ms *MemoryStoreMo) PutGlobal(globflag bool, globname string, idstr string) error {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	md, err := ms.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	if _, found := md.mdglobals[globname]; found {
+		return fmt.Errorf("%v duplicate global %s", ms, globname)
+	}
+	md.mdglobals[globname] = idstr
+	return nil
+}
+
+func (ms *MemoryStoreMo) PutParam(globflag bool, parname string, parvalue string) error {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	md, err := ms.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	md.mdparams[parname] = parvalue
+	return nil
+}
+
+func (ms *MemoryStoreMo) CommitDump() error {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	if !ms.msdumping {
+		return fmt.Errorf("%v CommitDump without dump", ms)
+	}
+	ms.msglobal, ms.msuser = ms.msdumpglob, ms.msdumpuser
+	ms.msdumpglob, ms.msdumpuser = nil, nil
+	ms.msdumping = false
+	ms.msnbcommits++
+	log.Printf("MemoryStore CommitDump %v with %d global and %d user objects\n",
+		ms, len(ms.msglobal.mdobjects), len(ms.msuser.mdobjects))
+	return nil
+} // end CommitDump
+
+func (ms *MemoryStoreMo) AbortDump() {
+	ms.msmtx.Lock()
+	defer ms.msmtx.Unlock()
+	log.Printf("MemoryStore AbortDump %v\n", ms)
+	ms.msdumpglob, ms.msdumpuser = nil, nil
+	ms.msdumping = false
+}
+
+// Close keeps the committed dump, so the store may be loaded again
+func (ms *MemoryStoreMo) Close() error {
+	return nil
+}
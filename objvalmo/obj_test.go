@@ -4,13 +4,22 @@ package objvalmo  // import "github.com/bstarynk/monimelt/objvalmo"
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	jason "github.com/antonholmquist/jason"
+	"io/ioutil"
 	"log"
 	"math"
+	"math/big"
+	"os"
 	osexec "os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 	/// our packages
 	"serialmo" // import "github.com/bstarynk/monimelt/serialmo"
 )
@@ -166,3 +175,1507 @@ func TestDump1(t *testing.T) {
 	DoTinyDump1(tempdir)
 	t.Logf("TestDump1 end\n\n\n")
 } // end TestDump1
+
+func TestCompareValues(t *testing.T) {
+	ob1 := NewObj()
+	ob2 := NewObj()
+	if LessObptr(ob2, ob1) {
+		ob1, ob2 = ob2, ob1
+	}
+	vals := []ValueMo{
+		nil,
+		MakeIntV(-3),
+		MakeIntV(7),
+		MakeFloatV(-1.5),
+		MakeFloatV(2.5),
+		MakeStringV("abc"),
+		MakeStringV("abd"),
+		MakeRefobV(ob1),
+		MakeRefobV(ob2),
+		MakeColInt(ob1, 5),
+		MakeColInt(ob2, -5),
+		MakeColString(ob1, "x"),
+		MakeColRef(ob1, ob2),
+		MakeSetV(),
+		MakeSetV(ob1),
+		MakeSetV(ob1, ob2),
+		MakeTupleV(ob2),
+		MakeTupleV(ob2, ob1),
+		MakeNodeV(ob1),
+		MakeNodeV(ob1, nil),
+		MakeNodeV(ob1, MakeIntV(2)),
+		MakeNodeV(ob1, MakeIntV(2), MakeStringV("z")),
+		MakeNodeV(ob2, MakeIntV(1)),
+	}
+	for i, vi := range vals {
+		for j, vj := range vals {
+			c := CompareValues(vi, vj)
+			switch {
+			case i < j && c >= 0, i > j && c <= 0, i == j && c != 0:
+				t.Errorf("TestCompareValues bad order #%d %v vs #%d %v: %d", i, vi, j, vj, c)
+			}
+			if EqualValues(vi, vj) != (i == j) {
+				t.Errorf("TestCompareValues bad equality #%d %v vs #%d %v", i, vi, j, vj)
+			}
+		}
+	}
+	if !EqualValues(MakeSetV(ob2, ob1, ob2), MakeSetV(ob1, ob2)) {
+		t.Errorf("TestCompareValues unequal identical sets")
+	}
+	if !EqualValues(MakeSetV(), MakeSetSliceV([]*ObjectMo{})) {
+		t.Errorf("TestCompareValues unequal empty sets")
+	}
+	// the skipped nils do not change the hash
+	skipped, plain := MakeSkippedTupleV(ob1, nil, ob2), MakeTupleV(ob1, ob2)
+	if CompareValues(skipped, plain) != 0 || !EqualValues(skipped, plain) || skipped.Hash() != plain.Hash() {
+		t.Errorf("TestCompareValues skipped tuple %v differs from %v", skipped, plain)
+	}
+	if !EqualValues(MakeSkippedTupleV(nil, nil), MakeTupleV()) {
+		t.Errorf("TestCompareValues skipped empty tuple differs")
+	}
+	nd := MakeNodeV(ob2, MakeTupleV(ob1), nil, MakeColString(ob1, "s"))
+	if nd.String() != fmt.Sprintf("*%v([%v] ~ %%%v\"s\")", ob2, ob1, ob1) {
+		t.Errorf("TestCompareValues bad node string %s", nd)
+	}
+	shuffled := []ValueMo{vals[8], vals[3], vals[19], vals[17], vals[0], vals[12], vals[1]}
+	SortValues(shuffled)
+	for ix := 1; ix < len(shuffled); ix++ {
+		if !LessValues(shuffled[ix-1], shuffled[ix]) {
+			t.Errorf("TestCompareValues badly sorted %v", shuffled)
+		}
+	}
+}
+
+func TestBigIntValues(t *testing.T) {
+	small := MakeBigIntV(big.NewInt(-12345))
+	if iv, ok := small.(IntV); !ok || iv.Int() != -12345 {
+		t.Errorf("TestBigIntValues small not normalized %v (%T)", small, small)
+	}
+	if small.Hash() != MakeIntV(-12345).Hash() {
+		t.Errorf("TestBigIntValues small has bad hash")
+	}
+	b1 := new(big.Int).Lsh(big.NewInt(3), 100)
+	bv1 := MakeBigIntV(b1)
+	b1.SetInt64(0)
+	bv2, err := ParseIntegerV("3802951800684688204490109616128")
+	if err != nil {
+		t.Errorf("TestBigIntValues ParseIntegerV failed %v", err)
+	}
+	fmt.Printf("TestBigIntValues bv1=%v of hash %v, bv2=%v of hash %v\n",
+		bv1, bv1.Hash(), bv2, bv2.Hash())
+	if bv1.TypeV() != TyBigIntV || !EqualValues(bv1, bv2) {
+		t.Errorf("TestBigIntValues bv1=%v bv2=%v differ", bv1, bv2)
+	}
+	if CompareValues(bv1, MakeBigIntV(new(big.Int).Neg(bv1.(BigIntV).BigInt()))) <= 0 {
+		t.Errorf("TestBigIntValues bad order for bv1=%v", bv1)
+	}
+	if _, err := ParseIntegerV("12x"); err == nil {
+		t.Errorf("TestBigIntValues ParseIntegerV accepted 12x")
+	}
+	// the bounds of int are normalized, not beyond them
+	maxint := int(^uint(0) >> 1)
+	if bv := MakeBigIntV(big.NewInt(int64(maxint))); bv.TypeV() != TyIntV {
+		t.Errorf("TestBigIntValues max int not normalized %v (%T)", bv, bv)
+	}
+	if bv := MakeBigIntV(big.NewInt(int64(-maxint - 1))); bv.TypeV() != TyIntV {
+		t.Errorf("TestBigIntValues min int not normalized %v (%T)", bv, bv)
+	}
+	beyond := new(big.Int).Add(big.NewInt(int64(maxint)), big.NewInt(1))
+	if bv := MakeBigIntV(beyond); bv.TypeV() != TyBigIntV {
+		t.Errorf("TestBigIntValues beyond max int gives %v (%T)", bv, bv)
+	}
+}
+
+func TestBytesValues(t *testing.T) {
+	raw := []byte{0xff, 0xc3, 0x28, 0, 'x'}
+	bv := MakeBytesV(raw)
+	raw[0] = 'A'
+	if bv.Length() != 5 || bv.Bytes()[0] != 0xff {
+		t.Errorf("TestBytesValues bv=%v shares its data", bv)
+	}
+	bv2 := MakeBytesV([]byte{0xfe, 0xc3, 0x28, 0, 'x'})
+	fmt.Printf("TestBytesValues bv=%v of hash %v, bv2=%v of hash %v\n",
+		bv, bv.Hash(), bv2, bv2.Hash())
+	if bv.Hash() == bv2.Hash() || EqualValues(bv, bv2) || CompareValues(bv2, bv) >= 0 {
+		t.Errorf("TestBytesValues bv=%v bv2=%v should differ", bv, bv2)
+	}
+	if !EqualValues(bv, MakeBytesV(bv.Bytes())) {
+		t.Errorf("TestBytesValues bv=%v not equal to its copy", bv)
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	obs := make([]*ObjectMo, 8)
+	for ix := range obs {
+		obs[ix] = NewObj()
+	}
+	s1 := MakeSetV(obs[0], obs[1], obs[2], obs[3], obs[4])
+	s2 := MakeSetV(obs[3], obs[4], obs[5], obs[6])
+	empty := MakeSetV()
+	fmt.Printf("TestSetAlgebra s1=%v s2=%v\n", s1, s2)
+	checkset := func(msg string, got SetV, want SetV) {
+		if !got.SetEqual(want) || !EqualValues(got, want) {
+			t.Errorf("TestSetAlgebra %s got %v want %v", msg, got, want)
+		}
+	}
+	checkset("union", s1.SetUnion(s2), MakeSetV(obs[0], obs[1], obs[2], obs[3], obs[4], obs[5], obs[6]))
+	checkset("union-empty", s1.SetUnion(empty), s1)
+	checkset("intersection", s1.SetIntersection(s2), MakeSetV(obs[3], obs[4]))
+	checkset("intersection-empty", empty.SetIntersection(s2), empty)
+	checkset("difference", s1.SetDifference(s2), MakeSetV(obs[0], obs[1], obs[2]))
+	checkset("difference-rev", s2.SetDifference(s1), MakeSetV(obs[5], obs[6]))
+	checkset("difference-self", s2.SetDifference(s2), empty)
+	if !MakeSetV(obs[4], obs[1]).SetIsSubset(s1) || !empty.SetIsSubset(s1) || !s1.SetIsSubset(s1) {
+		t.Errorf("TestSetAlgebra missing subset of s1=%v", s1)
+	}
+	if s1.SetIsSubset(s2) || MakeSetV(obs[4], obs[7]).SetIsSubset(s1) {
+		t.Errorf("TestSetAlgebra wrong subset of s1=%v", s1)
+	}
+	if s1.SetEqual(s2) || !empty.SetEqual(MakeSetSliceV(nil)) {
+		t.Errorf("TestSetAlgebra bad SetEqual")
+	}
+}
+
+func TestTupleOperations(t *testing.T) {
+	ob1 := NewObj()
+	ob2 := NewObj()
+	ob3 := NewObj()
+	tu := MakeTupleV(ob1, ob2, ob3, ob2)
+	checktup := func(msg string, got TupleV, want TupleV) {
+		if !EqualValues(got, want) {
+			t.Errorf("TestTupleOperations %s got %v want %v", msg, got, want)
+		}
+	}
+	checktup("slice", tu.Slice(1, 3), MakeTupleV(ob2, ob3))
+	checktup("slice-neg", tu.Slice(-2, -1), MakeTupleV(ob3))
+	checktup("slice-empty", tu.Slice(2, 2), MakeTupleV())
+	checktup("concat", tu.Slice(0, 1).Concat(MakeTupleV(ob3), MakeTupleV(), MakeTupleV(ob1, ob2)),
+		MakeTupleV(ob1, ob3, ob1, ob2))
+	checktup("reverse", tu.Reverse(), MakeTupleV(ob2, ob3, ob2, ob1))
+	checktup("filter", tu.Filter(func(pob *ObjectMo) bool { return pob != ob2 }), MakeTupleV(ob1, ob3))
+	checktup("map", tu.Map(func(pob *ObjectMo) *ObjectMo {
+		if pob == ob2 {
+			return ob1
+		}
+		return pob
+	}), MakeTupleV(ob1, ob1, ob3, ob1))
+	checktup("map-nil", tu.Map(func(pob *ObjectMo) *ObjectMo {
+		if pob == ob2 {
+			return nil
+		}
+		return pob
+	}), MakeTupleV(ob1, ob3))
+	if tu.IndexOf(ob2) != 1 || tu.IndexOf(ob3) != 2 || tu.IndexOf(NewObj()) != -1 {
+		t.Errorf("TestTupleOperations bad IndexOf in %v", tu)
+	}
+}
+
+func TestObjectAccessors(t *testing.T) {
+	ob := NewObj()
+	at1 := NewObj()
+	at2 := NewObj()
+	ob.UnsyncPutMtime(1)
+	ob.PutAttr(at1, MakeIntV(1)).PutAttr(at2, MakeStringV("two"))
+	if ob.Mtime() <= 1 {
+		t.Errorf("TestObjectAccessors PutAttr did not touch ob=%v", ob)
+	}
+	if !EqualValues(ob.GetAttr(at2), MakeStringV("two")) || !ob.HasAttr(at1) || ob.GetAttr(ob) != nil {
+		t.Errorf("TestObjectAccessors bad attributes in ob=%v", ob)
+	}
+	keys := ob.AttrKeys()
+	if len(keys) != 2 || !LessObptr(keys[0], keys[1]) {
+		t.Errorf("TestObjectAccessors bad AttrKeys %v", keys)
+	}
+	ob.UnsyncPutMtime(1)
+	ob.RemoveAttr(at1)
+	if ob.HasAttr(at1) || ob.Mtime() <= 1 {
+		t.Errorf("TestObjectAccessors bad RemoveAttr in ob=%v", ob)
+	}
+	ob.AppendVal(MakeIntV(10))
+	ob.AppendVal(MakeIntV(30))
+	ob.InsertCompAt(1, MakeIntV(20))
+	ob.InsertCompAt(3, MakeIntV(40))
+	ob.InsertCompAt(0, nil)
+	ob.SetCompAt(-1, MakeIntV(50))
+	want := []ValueMo{nil, MakeIntV(10), MakeIntV(20), MakeIntV(30), MakeIntV(50)}
+	if ob.NbComps() != len(want) {
+		t.Errorf("TestObjectAccessors bad NbComps %d", ob.NbComps())
+	}
+	for ix, w := range want {
+		if c := ob.CompAt(ix); !EqualValues(c, w) {
+			t.Errorf("TestObjectAccessors comp#%d is %v want %v", ix, c, w)
+		}
+	}
+	ob.UnsyncPutMtime(1)
+	ob.TruncateComps(2)
+	if ob.NbComps() != 2 || ob.Mtime() <= 1 {
+		t.Errorf("TestObjectAccessors bad TruncateComps in ob=%v", ob)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("TestObjectAccessors CompAt out of bounds did not panic")
+		}
+	}()
+	ob.CompAt(2)
+}
+
+func TestClassInheritance(t *testing.T) {
+	at1 := NewObj()
+	at2 := NewObj()
+	supcla := NewObj().PutAttr(at1, MakeIntV(1)).PutAttr(at2, MakeIntV(2))
+	cla := NewObj().SetClass(supcla).PutAttr(at2, MakeIntV(20))
+	ob := NewObj().SetClass(cla)
+	if ob.Class() != cla || cla.Class() != supcla {
+		t.Errorf("TestClassInheritance bad classes ob=%v cla=%v", ob, cla)
+	}
+	if !EqualValues(ob.GetAttrInherited(at1), MakeIntV(1)) || !EqualValues(ob.GetAttrInherited(at2), MakeIntV(20)) {
+		t.Errorf("TestClassInheritance bad inherited attributes in ob=%v", ob)
+	}
+	if ob.GetAttr(at1) != nil || ob.UnsyncGetAttrInherited(at1) == nil {
+		t.Errorf("TestClassInheritance bad own attributes in ob=%v", ob)
+	}
+	// a cycle in the class chain
+	supcla.SetClass(ob)
+	if ob.GetAttrInherited(NewObj()) != nil || cla.GetAttrInherited(at1) == nil {
+		t.Errorf("TestClassInheritance bad lookup with cycle ob=%v", ob)
+	}
+	supcla.SetClass(nil)
+	// the class is dumped and loaded
+	const tempdir = "/tmp/montestclass"
+	osexec.Command("rm", "-rf", tempdir).Run()
+	for _, pob := range []*ObjectMo{supcla, cla, ob} {
+		pob.UnsyncSetSpaceNum(SpaUser)
+	}
+	oldsys := Glob_the_system
+	Glob_the_system = ob
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(tempdir)
+	ob.SetClass(nil)
+	cla.SetClass(nil)
+	LoadFromDirectory(tempdir)
+	if ob.Class() != cla || cla.Class() != supcla || supcla.Class() != nil {
+		t.Errorf("TestClassInheritance classes not reloaded ob=%v cla=%v", ob, cla)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	link := NewObj()
+	ob1 := NewObj()
+	ob2 := NewObj()
+	ob1.AppendVal(MakeIntV(1))
+	// a committed transaction linking both objects
+	err := RunTransaction(func(tr *TransactionMo) error {
+		tr.PutAttr(ob1, link, MakeRefobV(ob2)).PutAttr(ob2, link, MakeRefobV(ob1))
+		return nil
+	}, ob2, ob1, ob2)
+	if err != nil || ob1.GetAttr(link) == nil || ob2.GetAttr(link) == nil {
+		t.Errorf("TestTransactions link failed err=%v", err)
+	}
+	// a failed transaction is rolled back
+	mtim := ob1.Mtime()
+	ob1.UnsyncPutMtime(mtim - 10)
+	UnmarkDirtyObjects(ob1)
+	mcnt1 := ob1.ModCount()
+	err = RunTransaction(func(tr *TransactionMo) error {
+		tr.RemoveAttr(ob1, link).RemoveAttr(ob2, link)
+		tr.PutAttr(ob1, ob2, MakeIntV(12)).SetClass(ob1, ob2)
+		tr.InsertCompAt(ob1, 0, MakeIntV(0)).AppendVal(ob2, MakeIntV(2))
+		return fmt.Errorf("unlinking failed")
+	}, ob1, ob2)
+	if err == nil || ob1.GetAttr(link) == nil || ob2.GetAttr(link) == nil || ob1.HasAttr(ob2) {
+		t.Errorf("TestTransactions attributes not rolled back err=%v", err)
+	}
+	if ob1.NbComps() != 1 || !EqualValues(ob1.CompAt(0), MakeIntV(1)) || ob2.NbComps() != 0 {
+		t.Errorf("TestTransactions components not rolled back")
+	}
+	if ob1.Class() != nil || ob1.Mtime() != mtim-10 {
+		t.Errorf("TestTransactions class or mtime not rolled back")
+	}
+	if ob1.ModCount() != mcnt1 || ob1.IsDirty() {
+		t.Errorf("TestTransactions modification count %d or dirty mark not rolled back", ob1.ModCount())
+	}
+	// a panicking transaction is rolled back, and the panic goes on
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("TestTransactions panic lost")
+			}
+		}()
+		RunTransaction(func(tr *TransactionMo) error {
+			tr.TruncateComps(ob1, 0)
+			tr.PutAttr(NewObj(), link, MakeIntV(0))
+			return nil
+		}, ob1)
+	}()
+	if ob1.NbComps() != 1 || ob1.obmtx.TryLock() == false {
+		t.Errorf("TestTransactions bad state after panic")
+	} else {
+		ob1.obmtx.Unlock()
+	}
+	// locking in opposite orders does not deadlock
+	done := make(chan bool)
+	for g := 0; g < 2; g++ {
+		go func(g int) {
+			for i := 0; i < 1000; i++ {
+				var unlock func()
+				if g == 0 {
+					unlock = LockObjects(ob1, ob2)
+				} else {
+					unlock = LockObjects(ob2, nil, ob1)
+				}
+				unlock()
+			}
+			done <- true
+		}(g)
+	}
+	<-done
+	<-done
+}
+
+// the changes of a transaction are notified only once committed
+func TestWatchTransaction(t *testing.T) {
+	ob := NewObj()
+	at := NewObj()
+	obch := Watch(ob, nil)
+	defer Unwatch(obch)
+	err := RunTransaction(func(tr *TransactionMo) error {
+		tr.PutAttr(ob, at, MakeIntV(1)).AppendVal(ob, MakeStringV("c0"))
+		tr.SetCompAt(ob, -1, MakeStringV("c1")).SetClass(ob, at)
+		if len(obch) != 0 {
+			t.Errorf("TestWatchTransaction events before the commit")
+		}
+		return nil
+	}, ob)
+	if err != nil {
+		t.Fatalf("TestWatchTransaction failed: %v", err)
+	}
+	wantkinds := []uint8{ChgPutAttr, ChgAppendComp, ChgSetComp, ChgClass}
+	for ix, wk := range wantkinds {
+		select {
+		case ev := <-obch:
+			if ev.Kind != wk || ev.Object != ob {
+				t.Errorf("TestWatchTransaction event#%d is %v, want kind %d", ix, ev, wk)
+			}
+			if ix == 2 && (ev.Index != 0 || !EqualValues(ev.OldVal, MakeStringV("c0"))) {
+				t.Errorf("TestWatchTransaction bad component event %v", ev)
+			}
+		default:
+			t.Errorf("TestWatchTransaction missing event#%d", ix)
+		}
+	}
+	// a rolled back transaction sends nothing
+	err = RunTransaction(func(tr *TransactionMo) error {
+		tr.RemoveAttr(ob, at).TruncateComps(ob, 0)
+		return fmt.Errorf("rolled back")
+	}, ob)
+	if err == nil || len(obch) != 0 {
+		t.Errorf("TestWatchTransaction rollback err=%v sent %d events", err, len(obch))
+	}
+}
+
+func TestWatchChanges(t *testing.T) {
+	ob := NewObj()
+	other := NewObj()
+	at := NewObj()
+	obch := Watch(ob, nil)
+	attrch := WatchAll(func(ev *ChangeEventMo) bool {
+		return ev.Attr == at
+	})
+	ob.PutAttr(at, MakeIntV(1))
+	ob.PutAttr(at, MakeIntV(2))
+	ob.AppendVal(MakeStringV("c0"))
+	ob.InsertCompAt(-1, MakeStringV("c-1"))
+	ob.SetCompAt(-1, MakeStringV("c1"))
+	ob.TruncateComps(1)
+	ob.RemoveAttr(at)
+	ob.RemoveAttr(at) // no change, no event
+	ob.SetClass(other)
+	other.PutAttr(at, MakeIntV(3))
+	other.UnsyncPutAttr(at, MakeIntV(4)) // unsynchronized, no event
+	wantkinds := []uint8{ChgPutAttr, ChgPutAttr, ChgAppendComp, ChgInsertComp,
+		ChgSetComp, ChgTruncateComps, ChgRemoveAttr, ChgClass}
+	for ix, wk := range wantkinds {
+		select {
+		case ev := <-obch:
+			if ev.Kind != wk || ev.Object != ob {
+				t.Errorf("TestWatchChanges event#%d is %v, want kind %d", ix, ev, wk)
+			}
+			if ix == 1 && (!EqualValues(ev.OldVal, MakeIntV(1)) || !EqualValues(ev.NewVal, MakeIntV(2))) {
+				t.Errorf("TestWatchChanges bad values in %v", ev)
+			}
+			if ix == 4 && ev.Index != 1 {
+				t.Errorf("TestWatchChanges bad index in %v", ev)
+			}
+		default:
+			t.Errorf("TestWatchChanges missing event#%d", ix)
+		}
+	}
+	if len(obch) != 0 {
+		t.Errorf("TestWatchChanges %d extra events", len(obch))
+	}
+	if len(attrch) != 4 {
+		t.Errorf("TestWatchChanges %d attribute events, want 4", len(attrch))
+	}
+	if Unwatch(attrch) != 0 {
+		t.Errorf("TestWatchChanges unexpected dropped events")
+	}
+	for i := 0; i < WatchChanLen+5; i++ {
+		ob.AppendVal(MakeIntV(i))
+	}
+	if dropped := Unwatch(obch); dropped != 5 {
+		t.Errorf("TestWatchChanges dropped %d events, want 5", dropped)
+	}
+	nbev := 0
+	for range obch {
+		nbev++
+	}
+	if nbev != WatchChanLen {
+		t.Errorf("TestWatchChanges got %d events after closing", nbev)
+	}
+}
+
+func TestDirtyObjects(t *testing.T) {
+	ClearDirtyObjects()
+	trob := NewObj()
+	trob.PutAttr(trob, MakeIntV(0))
+	if trob.IsDirty() || NbDirtyObjects() != 0 {
+		t.Errorf("TestDirtyObjects transient trob=%v is dirty", trob)
+	}
+	ob := NewObj()
+	ob.UnsyncSetSpaceNum(SpaUser)
+	cnt := ob.ModCount()
+	ob.UnsyncPutMtime(1)
+	ob.AppendVal(MakeIntV(1))
+	ob.UnsyncPutAttr(trob, MakeIntV(2))
+	if ob.ModCount() != cnt+2 || ob.Mtime() <= 1 || !ob.IsDirty() {
+		t.Errorf("TestDirtyObjects bad modification of ob=%v count %d", ob, ob.ModCount())
+	}
+	if dobjs := DirtyObjects(); len(dobjs) != 1 || dobjs[0] != ob {
+		t.Errorf("TestDirtyObjects bad dirty objects %v", dobjs)
+	}
+	if dobjs := TakeDirtyObjects(); len(dobjs) != 1 || NbDirtyObjects() != 0 || ob.IsDirty() {
+		t.Errorf("TestDirtyObjects bad taken dirty objects %v", dobjs)
+	}
+	MarkDirtyObjects(ob, trob, nil)
+	if NbDirtyObjects() != 1 {
+		t.Errorf("TestDirtyObjects bad marked dirty objects %v", DirtyObjects())
+	}
+	UnmarkDirtyObjects(ob)
+	if ob.IsDirty() {
+		t.Errorf("TestDirtyObjects ob=%v still dirty", ob)
+	}
+}
+
+// the first column of the rows of a query in the database dbpath
+func querySqlStrings(t *testing.T, dbpath string, query string) []string {
+	db, err := sql.Open("sqlite3", "file:"+dbpath+"?mode=ro")
+	if err != nil {
+		t.Fatalf("querySqlStrings cannot open %s: %v", dbpath, err)
+	}
+	defer db.Close()
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("querySqlStrings %s failed in %s: %v", query, dbpath, err)
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var str string
+		rows.Scan(&str)
+		res = append(res, str)
+	}
+	return res
+}
+
+func TestSqlTextDump(t *testing.T) {
+	const tempdir = "/tmp/montestsqltext"
+	osexec.Command("rm", "-rf", tempdir).Run()
+	root := NewObj()
+	root.UnsyncSetSpaceNum(SpaUser)
+	for i := 0; i < 5; i++ {
+		pob := NewObj()
+		pob.UnsyncSetSpaceNum(SpaUser)
+		pob.PutAttr(root, MakeStringV(fmt.Sprintf("it's\nline %d", i)))
+		root.AppendVal(MakeRefobV(pob))
+	}
+	oldsys := Glob_the_system
+	Glob_the_system = root
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(tempdir)
+	userdb := tempdir + "/" + DefaultUserDbname + ".sqlite"
+	usersql := tempdir + "/" + DefaultUserDbname + ".sql"
+	sqltext1, err := ioutil.ReadFile(usersql)
+	if err != nil {
+		t.Fatalf("TestSqlTextDump no %s: %v", usersql, err)
+	}
+	// the objects are sorted by id
+	var dumpedids []string
+	for _, line := range strings.Split(string(sqltext1), "\n") {
+		if strings.HasPrefix(line, "INSERT INTO t_objects VALUES('") {
+			dumpedids = append(dumpedids, line[len("INSERT INTO t_objects VALUES('"):][:len(root.ToString())])
+		}
+	}
+	if len(dumpedids) != 6 || !sort.StringsAreSorted(dumpedids) {
+		t.Errorf("TestSqlTextDump bad dumped ids %v", dumpedids)
+	}
+	// the SQL text is byte-stable and survives a restore
+	if err := DumpSqlTextFile(userdb, usersql+"2", "generated monimelt user dumpfile monimelt_user.sql",
+		"end of monimelt user dumpfile monimelt_user.sql"); err != nil {
+		t.Errorf("TestSqlTextDump DumpSqlTextFile failed: %v", err)
+	}
+	if err := RestoreDirectoryFromSql(tempdir); err != nil {
+		t.Errorf("TestSqlTextDump RestoreDirectoryFromSql failed: %v", err)
+	}
+	if err := DumpSqlTextFile(userdb, usersql+"3", "generated monimelt user dumpfile monimelt_user.sql",
+		"end of monimelt user dumpfile monimelt_user.sql"); err != nil {
+		t.Errorf("TestSqlTextDump DumpSqlTextFile after restore failed: %v", err)
+	}
+	sqltext2, _ := ioutil.ReadFile(usersql + "2")
+	sqltext3, _ := ioutil.ReadFile(usersql + "3")
+	if !bytes.Equal(sqltext1, sqltext2) || !bytes.Equal(sqltext1, sqltext3) {
+		t.Errorf("TestSqlTextDump SQL text not stable")
+	}
+	if names := querySqlStrings(t, userdb, "SELECT glob_name FROM t_globals"); len(names) != 1 || names[0] != "the_system" {
+		t.Errorf("TestSqlTextDump bad restored globals %v", names)
+	}
+	LoadFromDirectory(tempdir)
+	// the sqlite3 program, if available, also reads our SQL text
+	if _, err := osexec.LookPath(SqliteProgram); err == nil {
+		cmd := osexec.Command(SqliteProgram, tempdir+"/cli.sqlite")
+		sqlf, _ := os.Open(usersql)
+		defer sqlf.Close()
+		cmd.Stdin = sqlf
+		if out, err := cmd.CombinedOutput(); err != nil || len(out) > 0 {
+			t.Errorf("TestSqlTextDump %s failed: %v %s", SqliteProgram, err, out)
+		}
+		if ids := querySqlStrings(t, tempdir+"/cli.sqlite", "SELECT ob_id FROM t_objects ORDER BY ob_id"); len(ids) != 6 {
+			t.Errorf("TestSqlTextDump %s restored %v", SqliteProgram, ids)
+		}
+	}
+}
+
+func TestLoadReport(t *testing.T) {
+	const tempdir = "/tmp/montestloadreport"
+	osexec.Command("rm", "-rf", tempdir).Run()
+	root := NewObj()
+	badat := NewObj()
+	badpayl := NewObj()
+	for _, pob := range []*ObjectMo{root, badat, badpayl} {
+		pob.UnsyncSetSpaceNum(SpaUser)
+	}
+	root.UnsyncAddValues(MakeRefobV(badat), MakeRefobV(badpayl))
+	oldsys := Glob_the_system
+	Glob_the_system = root
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(tempdir)
+	// corrupt the user database by hand
+	db, err := sql.Open("sqlite3", "file:"+tempdir+"/"+DefaultUserDbname+".sqlite?mode=rw")
+	if err != nil {
+		t.Fatalf("TestLoadReport open failed: %v", err)
+	}
+	badcont := fmt.Sprintf(`{"attrs":[{"at":"nonsense","va":"x"},{"at":"%s","va":"good"}],"comps":[]}`, root.ToString())
+	for _, cmd := range []string{
+		fmt.Sprintf(`UPDATE t_objects SET ob_jsoncont='%s' WHERE ob_id='%s'`, badcont, badat.ToString()),
+		fmt.Sprintf(`UPDATE t_objects SET ob_paylkind='nosuchkind' WHERE ob_id='%s'`, badpayl.ToString()),
+		fmt.Sprintf(`INSERT INTO t_globals VALUES('no_such_global', '%s')`, root.ToString()),
+	} {
+		if _, err := db.Exec(cmd); err != nil {
+			t.Fatalf("TestLoadReport %s failed: %v", cmd, err)
+		}
+	}
+	db.Close()
+	userdb := tempdir + "/" + DefaultUserDbname + ".sqlite"
+	if err := DumpSqlTextFile(userdb, tempdir+"/"+DefaultUserDbname+".sql", "corrupted", "end corrupted"); err != nil {
+		t.Fatalf("TestLoadReport DumpSqlTextFile failed: %v", err)
+	}
+	rep, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{Mode: LoadLenient})
+	if err != nil {
+		t.Fatalf("TestLoadReport lenient load failed: %v", err)
+	}
+	if rep.NbObjects < 3 || rep.NbGlobals < 1 || len(rep.Problems) != 4 {
+		t.Errorf("TestLoadReport bad lenient report %+v", rep)
+	}
+	wantcols := map[string]string{badat.ToString(): "ob_jsoncont",
+		badpayl.ToString(): "ob_paylkind", "no_such_global": "glob_name",
+		ParNbGlobals: "par_value"}
+	for _, lp := range rep.Problems {
+		if lp.Database != "user" || wantcols[lp.ObjId] != lp.Column {
+			t.Errorf("TestLoadReport unexpected problem %v", lp)
+		}
+	}
+	if !EqualValues(badat.GetAttr(root), MakeStringV("good")) {
+		t.Errorf("TestLoadReport good attribute of badat not loaded: %v", badat)
+	}
+	// a strict load stops at the first problem
+	rep, err = LoadFromDirectoryE(tempdir, LoadOptionsMo{Mode: LoadStrict})
+	if err == nil || len(rep.Problems) != 1 {
+		t.Errorf("TestLoadReport strict load err=%v problems=%v", err, rep.Problems)
+	}
+}
+
+// an attribute referring to a transient object is not dumped, and
+// the dump reloads strictly
+func TestDumpTransientAttr(t *testing.T) {
+	const tempdir = "/tmp/montesttransientattr"
+	osexec.Command("rm", "-rf", tempdir).Run()
+	root := NewObj()
+	root.UnsyncSetSpaceNum(SpaUser)
+	trans := NewObj()
+	root.UnsyncPutAttr(trans, MakeStringV("hidden attribute"))
+	root.UnsyncPutAttr(root, MakeRefobV(trans))
+	oldsys := Glob_the_system
+	Glob_the_system = root
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(tempdir)
+	rep, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{Mode: LoadStrict})
+	if err != nil || len(rep.Problems) != 0 {
+		t.Fatalf("TestDumpTransientAttr strict load err=%v problems=%v", err, rep.Problems)
+	}
+	if frep, err := FsckDirectory(tempdir); err != nil || !frep.Ok() {
+		t.Errorf("TestDumpTransientAttr fsck err=%v report=%+v", err, frep)
+	}
+	conts := querySqlStrings(t, tempdir+"/"+DefaultUserDbname+".sqlite",
+		fmt.Sprintf("SELECT ob_jsoncont FROM t_objects WHERE ob_id='%s'", root))
+	if len(conts) != 1 || strings.Contains(conts[0], "null") {
+		t.Errorf("TestDumpTransientAttr bad dumped content %v", conts)
+	}
+}
+
+// a component referring to a transient object is loaded as nil, and
+// can be dumped again
+func TestDumpNilComponent(t *testing.T) {
+	root := NewObj()
+	root.UnsyncSetSpaceNum(SpaUser)
+	trans := NewObj()
+	root.UnsyncAppendVal(MakeRefobV(trans))
+	root.UnsyncAppendVal(MakeStringV("after"))
+	oldsys := Glob_the_system
+	Glob_the_system = root
+	defer func() { Glob_the_system = oldsys }()
+	st := NewMemoryStore("nilcomp")
+	DumpIntoStore(st)
+	root.TruncateComps(0)
+	if _, err := LoadFromStoreE(st, LoadOptionsMo{Mode: LoadStrict}); err != nil {
+		t.Fatalf("TestDumpNilComponent load failed: %v", err)
+	}
+	if root.NbComps() != 2 || root.CompAt(0) != nil {
+		t.Fatalf("TestDumpNilComponent bad reloaded root %v", root)
+	}
+	DumpIntoStore(st)
+	if row := st.ObjectRow(UserObjects, root.ToString()); row == nil || !strings.Contains(row.JsonCont, "after") {
+		t.Errorf("TestDumpNilComponent bad row %+v", row)
+	}
+}
+
+// a world recovered by a lenient load can be dumped again
+func TestLenientLoadThenDump(t *testing.T) {
+	const tempdir = "/tmp/montestlenientdump"
+	osexec.Command("rm", "-rf", tempdir).Run()
+	root := NewObj()
+	root.UnsyncSetSpaceNum(SpaUser)
+	root.UnsyncAppendVal(MakeStringV("first"))
+	root.UnsyncAppendVal(MakeStringV("second"))
+	oldsys := Glob_the_system
+	Glob_the_system = root
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(tempdir)
+	db, err := sql.Open("sqlite3", "file:"+tempdir+"/"+DefaultUserDbname+".sqlite?mode=rw")
+	if err != nil {
+		t.Fatalf("TestLenientLoadThenDump open failed: %v", err)
+	}
+	badcont := `{"attrs":[],"comps":[{"nosuchkind":1},"second"]}`
+	if _, err := db.Exec(`UPDATE t_objects SET ob_jsoncont=? WHERE ob_id=?`, badcont, root.ToString()); err != nil {
+		t.Fatalf("TestLenientLoadThenDump update failed: %v", err)
+	}
+	db.Close()
+	userdb := tempdir + "/" + DefaultUserDbname + ".sqlite"
+	if err := DumpSqlTextFile(userdb, tempdir+"/"+DefaultUserDbname+".sql", "corrupted", "end corrupted"); err != nil {
+		t.Fatalf("TestLenientLoadThenDump DumpSqlTextFile failed: %v", err)
+	}
+	root.TruncateComps(0)
+	rep, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{Mode: LoadLenient})
+	if err != nil || len(rep.Problems) != 1 {
+		t.Fatalf("TestLenientLoadThenDump lenient load err=%v problems=%v", err, rep.Problems)
+	}
+	if root.NbComps() != 2 || root.CompAt(0) != nil {
+		t.Fatalf("TestLenientLoadThenDump bad recovered root %v", root)
+	}
+	DumpIntoDirectory(tempdir)
+	root.TruncateComps(0)
+	if rep, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{Mode: LoadStrict}); err != nil || len(rep.Problems) != 0 {
+		t.Errorf("TestLenientLoadThenDump reload of the recovered dump err=%v", err)
+	}
+	if root.NbComps() != 2 || !EqualValues(root.CompAt(1), MakeStringV("second")) {
+		t.Errorf("TestLenientLoadThenDump bad reloaded root %v", root)
+	}
+}
+
+func TestFormatMigration(t *testing.T) {
+	const tempdir = "/tmp/montestmigration"
+	osexec.Command("rm", "-rf", tempdir).Run()
+	root := NewObj()
+	root.UnsyncSetSpaceNum(SpaUser)
+	root.UnsyncPutAttr(root, MakeStringV("migrated"))
+	oldsys := Glob_the_system
+	Glob_the_system = root
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(tempdir)
+	userdb := tempdir + "/" + DefaultUserDbname + ".sqlite"
+	usersql := tempdir + "/" + DefaultUserDbname + ".sql"
+	params := querySqlStrings(t, userdb, "SELECT par_name || '=' || par_value FROM t_params ORDER BY par_name")
+	parstr := strings.Join(params, " ")
+	if !strings.Contains(parstr, fmt.Sprintf("%s=%d", ParFormatVersion, DumpFormatVersion)) ||
+		!strings.Contains(parstr, ParNbObjects+"=1 ") || !strings.Contains(parstr, ParNbObjectsPrefix+"user=1") ||
+		!strings.Contains(parstr, ParNbGlobals+"=1") || !strings.Contains(parstr, ParProducer+"=monimelt "+MonimeltVersion) {
+		t.Errorf("TestFormatMigration bad user t_params %v", params)
+	}
+	// pretend the user database has an older format, where attributes
+	// were named differently
+	db, err := sql.Open("sqlite3", "file:"+userdb+"?mode=rw")
+	if err != nil {
+		t.Fatalf("TestFormatMigration open failed: %v", err)
+	}
+	setformat := func(version int) {
+		for _, cmd := range []string{
+			fmt.Sprintf(`UPDATE t_params SET par_value='%d' WHERE par_name='%s'`, version, ParFormatVersion),
+			`UPDATE t_objects SET ob_jsoncont=replace(ob_jsoncont, '"attrs"', '"oldattrs"')`,
+		} {
+			if _, err := db.Exec(cmd); err != nil {
+				t.Fatalf("TestFormatMigration %s failed: %v", cmd, err)
+			}
+		}
+		if err := DumpSqlTextFile(userdb, usersql, "old", "end old"); err != nil {
+			t.Fatalf("TestFormatMigration DumpSqlTextFile failed: %v", err)
+		}
+	}
+	setformat(-1)
+	if _, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{}); err == nil {
+		t.Errorf("TestFormatMigration loaded a format without migration")
+	}
+	nbmigrated := 0
+	RegisterMigration(-1, DumpFormatVersion, func(row *ObjectRowMo, globflag bool) error {
+		row.JsonCont = strings.Replace(row.JsonCont, `"oldattrs"`, `"attrs"`, -1)
+		nbmigrated++
+		return nil
+	})
+	defer unregisterMigration(-1)
+	root.RemoveAttr(root)
+	if rep, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{}); err != nil || len(rep.Problems) > 0 {
+		t.Errorf("TestFormatMigration migrating load failed: %v", err)
+	}
+	if nbmigrated != 1 || !EqualValues(root.GetAttr(root), MakeStringV("migrated")) {
+		t.Errorf("TestFormatMigration bad migration nbmigrated=%d root=%v", nbmigrated, root)
+	}
+	// older formats are not dumped incrementally
+	if CanDumpIncrementally(tempdir) {
+		t.Errorf("TestFormatMigration can dump incrementally an old format")
+	}
+	setformat(DumpFormatVersion + 1)
+	db.Close()
+	if _, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{Mode: LoadLenient}); err == nil {
+		t.Errorf("TestFormatMigration loaded a newer format")
+	}
+}
+
+func TestConcurrentDump(t *testing.T) {
+	const tempdir = "/tmp/montestconcdump"
+	osexec.Command("rm", "-rf", tempdir).Run()
+	root := NewObj()
+	atx := NewObj()
+	aty := NewObj()
+	for _, pob := range []*ObjectMo{root, atx, aty} {
+		pob.UnsyncSetSpaceNum(SpaUser)
+	}
+	root.PutAttr(atx, MakeIntV(0))
+	root.PutAttr(aty, MakeIntV(0))
+	oldsys := Glob_the_system
+	Glob_the_system = root
+	defer func() { Glob_the_system = oldsys }()
+	// the mutator keeps both attributes equal, and moves atx between spaces
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			unlock := LockObjects(root)
+			root.UnsyncPutAttr(atx, MakeIntV(i))
+			root.UnsyncPutAttr(aty, MakeIntV(i))
+			unlock()
+			unlock = LockObjects(atx)
+			if i%2 == 0 {
+				atx.UnsyncSetSpaceNum(SpaGlobal)
+			} else {
+				atx.UnsyncSetSpaceNum(SpaUser)
+			}
+			unlock()
+		}
+	}()
+	for d := 0; d < 5; d++ {
+		if d%2 == 0 {
+			DumpIntoDirectory(tempdir)
+		} else {
+			DumpIncrementallyIntoDirectory(tempdir)
+		}
+		conts := querySqlStrings(t, tempdir+"/"+DefaultUserDbname+".sqlite",
+			"SELECT ob_jsoncont FROM t_objects WHERE ob_id='"+root.ToString()+"'")
+		if len(conts) != 1 {
+			t.Fatalf("TestConcurrentDump dump#%d no root in %v", d, conts)
+		}
+		var jcont jsonObContent
+		if err := json.Unmarshal([]byte(conts[0]), &jcont); err != nil || len(jcont.Jattrs) != 2 {
+			t.Fatalf("TestConcurrentDump dump#%d bad root content %s: %v", d, conts[0], err)
+		}
+		if fmt.Sprint(jcont.Jattrs[0].Jva) != fmt.Sprint(jcont.Jattrs[1].Jva) {
+			t.Errorf("TestConcurrentDump dump#%d inconsistent root %v", d, jcont.Jattrs)
+		}
+	}
+	close(stop)
+	<-done
+}
+
+func TestMemoryStore(t *testing.T) {
+	const nbobj = 50
+	objs := makeTestWorld(nbobj)
+	oldsys := Glob_the_system
+	Glob_the_system = objs[0]
+	defer func() { Glob_the_system = oldsys }()
+	st := NewMemoryStore("test")
+	if nbup, _ := DumpIncrementallyIntoStore(st); nbup >= 0 || !st.HasDump() {
+		t.Fatalf("TestMemoryStore first dump not full nbup=%d", nbup)
+	}
+	if nb := st.NbObjectRows(UserObjects); nb != nbobj {
+		t.Errorf("TestMemoryStore dumped %d user objects, want %d", nb, nbobj)
+	}
+	params, err := st.Params(UserObjects)
+	if err != nil || params[ParNbObjects] != fmt.Sprint(nbobj) {
+		t.Errorf("TestMemoryStore bad params %v err=%v", params, err)
+	}
+	if nbup, nbdel := DumpIncrementallyIntoStore(st); nbup != 0 || nbdel != 0 {
+		t.Errorf("TestMemoryStore unchanged dump nbup=%d nbdel=%d", nbup, nbdel)
+	}
+	objs[3].PutAttr(objs[4], MakeStringV("changed"))
+	if nbup, _ := DumpIncrementallyIntoStore(st); nbup != 1 {
+		t.Errorf("TestMemoryStore incremental dump nbup=%d, want 1", nbup)
+	}
+	if row := st.ObjectRow(UserObjects, objs[3].ToString()); row == nil || !strings.Contains(row.JsonCont, `"changed"`) {
+		t.Errorf("TestMemoryStore bad row %+v", row)
+	}
+	for i, pob := range objs {
+		pob.RemoveAttr(objs[(i*7+1)%nbobj])
+	}
+	objs[3].RemoveAttr(objs[4])
+	rep, err := LoadFromStoreE(st, LoadOptionsMo{Mode: LoadStrict, Workers: 2})
+	if err != nil || rep.NbObjects < nbobj || len(rep.Problems) > 0 {
+		t.Fatalf("TestMemoryStore load failed: %v %+v", err, rep)
+	}
+	for i, pob := range objs {
+		if !EqualValues(pob.GetAttr(objs[(i*7+1)%nbobj]), MakeIntV(i)) {
+			t.Fatalf("TestMemoryStore bad object#%d %v", i, pob)
+		}
+	}
+	if !EqualValues(objs[3].GetAttr(objs[4]), MakeStringV("changed")) {
+		t.Errorf("TestMemoryStore changed attribute not loaded in %v", objs[3])
+	}
+	// a failed dump keeps the previous one
+	if err := st.BeginDump(false, time.Now()); err != nil {
+		t.Fatalf("TestMemoryStore BeginDump failed: %v", err)
+	}
+	st.AbortDump()
+	if nb := st.NbObjectRows(UserObjects); nb != nbobj || st.NbCommits() != 3 {
+		t.Errorf("TestMemoryStore abort lost the dump: %d rows, %d commits", nb, st.NbCommits())
+	}
+}
+
+// the sorted rows of st, with their JSON compacted
+func compactStoreRows(t *testing.T, st StoreMo, globflag bool) []string {
+	var rows []string
+	compact := func(js string) string {
+		var buf bytes.Buffer
+		if js == "" {
+			return ""
+		}
+		if err := json.Compact(&buf, []byte(js)); err != nil {
+			t.Errorf("compactStoreRows bad JSON %q in %v: %v", js, st, err)
+		}
+		return buf.String()
+	}
+	err := st.ObjectRows(globflag, func(row *ObjectRowMo) {
+		rows = append(rows, fmt.Sprintf("%s %d %s %s %s", row.Id, row.Mtime,
+			compact(row.JsonCont), row.PaylKind, compact(row.PaylCont)))
+	})
+	if err != nil {
+		t.Fatalf("compactStoreRows %v failed: %v", st, err)
+	}
+	sort.Strings(rows)
+	return rows
+}
+
+func TestTextDump(t *testing.T) {
+	const sqldir = "/tmp/montesttextdump-sql"
+	const textdir = "/tmp/montesttextdump-text"
+	const nbobj = 40
+	osexec.Command("rm", "-rf", sqldir, textdir).Run()
+	objs := makeTestWorld(nbobj)
+	oldsys := Glob_the_system
+	Glob_the_system = objs[0]
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(sqldir)
+	DumpIntoTextDirectory(textdir)
+	// both dumps have the same rows
+	sqlst, textst := NewSqliteStore(sqldir), NewTextStore(textdir)
+	defer sqlst.Close()
+	for _, globflag := range []bool{GlobalObjects, UserObjects} {
+		sqlrows := compactStoreRows(t, sqlst, globflag)
+		textrows := compactStoreRows(t, textst, globflag)
+		if strings.Join(sqlrows, "\n") != strings.Join(textrows, "\n") {
+			t.Errorf("TestTextDump %s rows differ:\n%v\n%v", databaseName(globflag), sqlrows, textrows)
+		}
+	}
+	victimpath, err := textst.objectPath(UserObjects, objs[5].ToString())
+	if _, serr := os.Stat(victimpath); err != nil || serr != nil {
+		t.Fatalf("TestTextDump no file for %v: %v %v", objs[5], err, serr)
+	}
+	if globs, err := ioutil.ReadFile(textdir + "/" + TextGlobalsName); err != nil || !bytes.Contains(globs, []byte(objs[0].ToString())) {
+		t.Errorf("TestTextDump bad globals err=%v", err)
+	}
+	// a dump of the same world writes nothing
+	fi, _ := os.Stat(victimpath)
+	DumpIntoTextDirectory(textdir)
+	if fi2, err := os.Stat(victimpath); err != nil || !fi2.ModTime().Equal(fi.ModTime()) {
+		t.Errorf("TestTextDump unchanged file rewritten err=%v", err)
+	}
+	// the file of a disappeared object is removed
+	objs[5].UnsyncSetSpaceNum(SpaTransient)
+	DumpIntoTextDirectory(textdir)
+	if _, err := os.Stat(victimpath); !os.IsNotExist(err) {
+		t.Errorf("TestTextDump stale %s kept: %v", victimpath, err)
+	}
+	objs[5].UnsyncSetSpaceNum(SpaUser)
+	DumpIntoTextDirectory(textdir)
+	for i, pob := range objs {
+		pob.RemoveAttr(objs[(i*7+1)%nbobj])
+	}
+	LoadFromTextDirectory(textdir)
+	for i, pob := range objs {
+		if !EqualValues(pob.GetAttr(objs[(i*7+1)%nbobj]), MakeIntV(i)) {
+			t.Fatalf("TestTextDump bad object#%d %v", i, pob)
+		}
+	}
+	// a file with the id of another object loads the object of its path
+	victimdata, err := ioutil.ReadFile(victimpath)
+	if err != nil {
+		t.Fatalf("TestTextDump read failed: %v", err)
+	}
+	otherid := serialmo.RandomId().ToString()
+	if err := ioutil.WriteFile(victimpath, bytes.Replace(victimdata, []byte(objs[5].ToString()), []byte(otherid), 1), 0640); err != nil {
+		t.Fatalf("TestTextDump write failed: %v", err)
+	}
+	objs[5].RemoveAttr(objs[(5*7+1)%nbobj])
+	if rep, err := LoadFromStoreE(textst, LoadOptionsMo{Mode: LoadLenient}); err != nil || len(rep.Problems) != 1 ||
+		rep.Problems[0].ObjId != objs[5].ToString() || !strings.Contains(rep.Problems[0].Reason, otherid) {
+		t.Errorf("TestTextDump lenient load of mismatched id err=%v problems=%v", err, rep.Problems)
+	}
+	if !EqualValues(objs[5].GetAttr(objs[(5*7+1)%nbobj]), MakeIntV(5)) {
+		t.Errorf("TestTextDump bad load of mismatched id %v", objs[5])
+	}
+	if rep, err := FsckDirectory(textdir); err != nil || len(rep.Problems) != 1 {
+		t.Errorf("TestTextDump fsck of mismatched id err=%v problems=%+v", err, rep)
+	}
+	// a conflicting merge is reported
+	if err := ioutil.WriteFile(victimpath, []byte("<<<<<<< HEAD\n"), 0640); err != nil {
+		t.Fatalf("TestTextDump write failed: %v", err)
+	}
+	if rep, err := LoadFromStoreE(textst, LoadOptionsMo{Mode: LoadLenient}); err != nil || len(rep.Problems) != 1 {
+		t.Errorf("TestTextDump lenient load err=%v problems=%v", err, rep.Problems)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	const tempdir = "/tmp/montestfsck"
+	const textdir = "/tmp/montestfsck-text"
+	const nbobj = 30
+	osexec.Command("rm", "-rf", tempdir, textdir).Run()
+	objs := makeTestWorld(nbobj)
+	oldsys := Glob_the_system
+	Glob_the_system = objs[0]
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(tempdir)
+	DumpIntoTextDirectory(textdir)
+	for _, dir := range []string{tempdir, textdir} {
+		rep, err := FsckDirectory(dir)
+		if err != nil || !rep.Ok() || rep.NbObjects < nbobj || rep.NbGlobals != 1 {
+			t.Fatalf("TestFsck %s not clean err=%v rep=%+v", dir, err, rep)
+		}
+	}
+	danglingid := serialmo.RandomId().ToString()
+	db, err := sql.Open("sqlite3", "file:"+tempdir+"/"+DefaultUserDbname+".sqlite?mode=rw")
+	if err != nil {
+		t.Fatalf("TestFsck open failed: %v", err)
+	}
+	for _, upd := range []struct {
+		sql  string
+		args []interface{}
+	}{
+		{`UPDATE t_objects SET ob_jsoncont=? WHERE ob_id=?`,
+			[]interface{}{`{"attrs":[],"comps":[{"oid":"` + danglingid + `"}]}`, objs[1].ToString()}},
+		{`UPDATE t_objects SET ob_paylkind='nosuchkind' WHERE ob_id=?`, []interface{}{objs[2].ToString()}},
+		{`UPDATE t_objects SET ob_jsoncont='{bad' WHERE ob_id=?`, []interface{}{objs[3].ToString()}},
+		{`INSERT INTO t_objects VALUES ('notanid', 1, '{}', '', '')`, nil},
+		{`INSERT INTO t_globals VALUES ('nosuchglobal', ?)`, []interface{}{danglingid}},
+	} {
+		if _, err := db.Exec(upd.sql, upd.args...); err != nil {
+			t.Fatalf("TestFsck %s failed: %v", upd.sql, err)
+		}
+	}
+	db.Close()
+	rep, err := FsckDirectory(tempdir)
+	if err != nil {
+		t.Fatalf("TestFsck failed: %v", err)
+	}
+	for _, want := range []struct{ table, id, column, reason string }{
+		{"t_objects", objs[1].ToString(), "ob_jsoncont", "dangling reference"},
+		{"t_objects", objs[2].ToString(), "ob_paylkind", "unknown payload kind"},
+		{"t_objects", objs[3].ToString(), "ob_jsoncont", "bad JSON content"},
+		{"t_objects", "notanid", "ob_id", "bad id"},
+		{"t_globals", "nosuchglobal", "glob_oid", "missing object"},
+		{"t_globals", "nosuchglobal", "glob_name", "unknown global variable"},
+		{"t_params", ParNbObjects, "par_value", "found"},
+		{"files", DefaultUserDbname + ".sql", "content", "differs"},
+	} {
+		found := false
+		for _, prob := range rep.Problems {
+			if prob.Database == "user" && prob.Table == want.table && prob.ObjId == want.id &&
+				prob.Column == want.column && strings.Contains(prob.Reason, want.reason) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("TestFsck missing problem %v in %v", want, rep.Problems)
+		}
+	}
+	// the checker did not make the dangling object
+	if oid, _ := serialmo.IdFromString(danglingid); FindObjectById(oid) != nil {
+		t.Errorf("TestFsck made the object %s", danglingid)
+	}
+}
+
+func TestDumpDiff(t *testing.T) {
+	const olddir = "/tmp/montestdiff-old"
+	const newdir = "/tmp/montestdiff-new"
+	const nbobj = 20
+	osexec.Command("rm", "-rf", olddir, newdir).Run()
+	objs := makeTestWorld(nbobj)
+	pr_name := Predef_02hL3RuX4x6_6y6PTK9vZs7()
+	objs[1].PutAttr(pr_name, MakeStringV("one"))
+	oldsys := Glob_the_system
+	Glob_the_system = objs[0]
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(olddir)
+	if diff, err := DiffDirectories(olddir, olddir, DiffOptionsMo{}); err != nil || !diff.Empty() {
+		t.Fatalf("TestDumpDiff same dump differs err=%v diff=%+v", err, diff)
+	}
+	added := NewObj()
+	added.UnsyncSetSpaceNum(SpaUser)
+	objs[0].AppendVal(MakeRefobV(added))
+	newset := MakeSetV(objs[4], objs[5])
+	objs[2].PutAttr(objs[1], newset)
+	objs[3].UnsyncSetSpaceNum(SpaTransient)
+	Glob_the_system = objs[1]
+	DumpIntoTextDirectory(newdir)
+	diff, err := DiffDirectories(olddir, newdir, DiffOptionsMo{Names: true})
+	if err != nil {
+		t.Fatalf("TestDumpDiff failed: %v", err)
+	}
+	status := make(map[string]string)
+	for _, od := range diff.Objects {
+		status[od.Id] = od.Status
+	}
+	if status[added.ToString()] != DiffAdded || status[objs[3].ToString()] != DiffRemoved ||
+		status[objs[0].ToString()] != DiffChanged || status[objs[2].ToString()] != DiffChanged {
+		t.Errorf("TestDumpDiff bad statuses %v", status)
+	}
+	if len(diff.Globals) != 1 || diff.Globals[0].New != objs[1].ToString()+"(one)" {
+		t.Errorf("TestDumpDiff bad globals %+v", diff.Globals)
+	}
+	var textbuf, jsonbuf bytes.Buffer
+	if err := diff.WriteText(&textbuf); err != nil {
+		t.Fatalf("TestDumpDiff WriteText failed: %v", err)
+	}
+	wantline := fmt.Sprintf("  + attr %s(one) = {%s %s}", objs[1], newset.At(0), newset.At(1))
+	if !strings.Contains(textbuf.String(), wantline) {
+		t.Errorf("TestDumpDiff text without %q:\n%s", wantline, textbuf.String())
+	}
+	if err := diff.WriteJson(&jsonbuf); err != nil {
+		t.Fatalf("TestDumpDiff WriteJson failed: %v", err)
+	}
+	var jdiff DumpDiffMo
+	if err := json.Unmarshal(jsonbuf.Bytes(), &jdiff); err != nil || len(jdiff.Objects) != len(diff.Objects) {
+		t.Errorf("TestDumpDiff bad JSON err=%v:\n%s", err, jsonbuf.String())
+	}
+}
+
+// a malformed value making the parser panic is shown as JSON
+func TestDiffMalformedValue(t *testing.T) {
+	dr := &diffRendererMo{}
+	if text := dr.value(map[string]interface{}{"oid": 12}); text != `{"oid":12}` {
+		t.Errorf("TestDiffMalformedValue bad text %q", text)
+	}
+}
+
+// wait until the autosaver as did nbsaves saves
+func waitAutosaves(t *testing.T, as *AutosaverMo, nbsaves int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for as.NbSaves() < nbsaves {
+		if time.Now().After(deadline) {
+			t.Fatalf("waitAutosaves timeout with %d saves, expecting %d", as.NbSaves(), nbsaves)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAutosave(t *testing.T) {
+	const statedir = "/tmp/montestautosave"
+	const bakdir = statedir + "-backups"
+	osexec.Command("rm", "-rf", statedir, bakdir).Run()
+	objs := makeTestWorld(10)
+	ClearDirtyObjects()
+	as := StartAutosave(AutosaveOptionsMo{Dirname: statedir, NbModifs: 3, NbBackups: 2})
+	defer as.Stop()
+	for round := 1; round <= 3; round++ {
+		for ix := 0; ix < 3; ix++ {
+			objs[ix].PutAttr(objs[ix+1], MakeIntV(round))
+		}
+		waitAutosaves(t, as, round)
+		if err := as.LastError(); err != nil {
+			t.Fatalf("TestAutosave round %d failed: %v", round, err)
+		}
+	}
+	if !CanDumpIncrementally(statedir) {
+		t.Errorf("TestAutosave no dump in %s", statedir)
+	}
+	baks, err := AutosaveBackups(bakdir)
+	if err != nil || len(baks) != 2 {
+		t.Errorf("TestAutosave expecting two backups, got %v err=%v", baks, err)
+	} else if !isRegularFile(bakdir + "/" + baks[1] + "/" + DefaultGlobalDbname + ".sqlite") {
+		t.Errorf("TestAutosave incomplete backup %s", baks[1])
+	}
+	// two backups at the same time go into distinct dirs
+	later := time.Now().Add(time.Hour)
+	if later.Location() == time.UTC {
+		// check that the backups are named in UTC
+		later = later.In(time.FixedZone("EST", -5*3600))
+	}
+	if err := as.backup(later); err != nil {
+		t.Fatalf("TestAutosave first backup failed: %v", err)
+	}
+	if err := as.backup(later); err != nil {
+		t.Fatalf("TestAutosave second backup failed: %v", err)
+	}
+	if baks, err = AutosaveBackups(bakdir); err != nil || len(baks) != 2 ||
+		baks[0] != later.UTC().Format(AutosaveBackupFormat) || baks[0] == baks[1] {
+		t.Errorf("TestAutosave bad backups at the same time %v err=%v", baks, err)
+	}
+	as.Stop()
+	// now with a period, and no backups
+	as = StartAutosave(AutosaveOptionsMo{Dirname: statedir, Period: 20 * time.Millisecond})
+	defer as.Stop()
+	objs[0].PutAttr(objs[1], MakeIntV(4))
+	waitAutosaves(t, as, 1)
+	if NbDirtyObjects() != 0 {
+		t.Errorf("TestAutosave still %d dirty objects", NbDirtyObjects())
+	}
+	// rebinding a global variable alone is autosaved
+	oldsys := Glob_the_system
+	defer SetGlobalVariable("the_system", oldsys)
+	SetGlobalVariable("the_system", objs[2])
+	waitAutosaves(t, as, 2)
+	if globids := querySqlStrings(t, statedir+"/"+DefaultUserDbname+".sqlite",
+		"SELECT glob_oid FROM t_globals WHERE glob_name='the_system'"); len(globids) != 1 || globids[0] != objs[2].ToString() {
+		t.Errorf("TestAutosave rebound global not saved %v", globids)
+	}
+}
+
+// a failed autosave is retried at the next modification
+func TestAutosaveRetry(t *testing.T) {
+	const statedir = "/tmp/montestautosaveretry"
+	osexec.Command("rm", "-rf", statedir).Run()
+	// a regular file cannot be a state directory
+	if err := ioutil.WriteFile(statedir, []byte("not a directory\n"), 0640); err != nil {
+		t.Fatalf("TestAutosaveRetry cannot write %s: %v", statedir, err)
+	}
+	defer os.Remove(statedir)
+	objs := makeTestWorld(5)
+	ClearDirtyObjects()
+	as := StartAutosave(AutosaveOptionsMo{Dirname: statedir, NbModifs: 2})
+	defer as.Stop()
+	objs[0].PutAttr(objs[1], MakeIntV(1))
+	objs[1].PutAttr(objs[2], MakeIntV(1))
+	deadline := time.Now().Add(10 * time.Second)
+	for as.LastError() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("TestAutosaveRetry autosave into a file did not fail")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	os.Remove(statedir)
+	objs[2].PutAttr(objs[3], MakeIntV(1))
+	waitAutosaves(t, as, 1)
+	if err := as.LastError(); err != nil || !CanDumpIncrementally(statedir) {
+		t.Errorf("TestAutosaveRetry retry failed: %v", err)
+	}
+	osexec.Command("rm", "-rf", statedir).Run()
+}
+
+// make a world of nbobj user objects, with attributes, components and
+// classes, all reachable from the first one, which the tests put in
+// Glob_the_system
+func makeTestWorld(nbobj int) []*ObjectMo {
+	objs := make([]*ObjectMo, nbobj)
+	for i := range objs {
+		objs[i] = NewObj()
+		objs[i].UnsyncSetSpaceNum(SpaUser)
+	}
+	for i, pob := range objs {
+		pob.UnsyncPutAttr(objs[(i*7+1)%nbobj], MakeIntV(i))
+		pob.UnsyncPutAttr(objs[(i*13+2)%nbobj], MakeStringV(fmt.Sprintf("str#%d", i)))
+		pob.UnsyncAppendVal(MakeRefobV(objs[(i+1)%nbobj]))
+		pob.UnsyncAppendVal(MakeTupleV(objs[(i*3)%nbobj], objs[(i*5)%nbobj]))
+		if i > 0 {
+			pob.UnsyncSetClass(objs[i/2])
+		}
+	}
+	return objs
+}
+
+func TestParallelLoad(t *testing.T) {
+	const tempdir = "/tmp/montestparload"
+	const nbobj = 400
+	osexec.Command("rm", "-rf", tempdir).Run()
+	objs := makeTestWorld(nbobj)
+	oldsys := Glob_the_system
+	Glob_the_system = objs[0]
+	defer func() { Glob_the_system = oldsys }()
+	DumpIntoDirectory(tempdir)
+	for i, pob := range objs {
+		pob.RemoveAttr(objs[(i*7+1)%nbobj])
+		pob.SetClass(nil)
+	}
+	rep, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{Mode: LoadStrict, Workers: 4})
+	if err != nil || rep.NbObjects < nbobj {
+		t.Fatalf("TestParallelLoad failed: %v %+v", err, rep)
+	}
+	for i, pob := range objs {
+		if !EqualValues(pob.GetAttr(objs[(i*7+1)%nbobj]), MakeIntV(i)) ||
+			(i > 0 && pob.Class() != objs[i/2]) || pob.Mtime() == 0 {
+			t.Fatalf("TestParallelLoad bad object#%d %v", i, pob)
+		}
+	}
+	// a bad content is reported by its worker
+	db, err := sql.Open("sqlite3", "file:"+tempdir+"/"+DefaultUserDbname+".sqlite?mode=rw")
+	if err != nil {
+		t.Fatalf("TestParallelLoad open failed: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE t_objects SET ob_jsoncont='{bad' WHERE ob_id IN (?, ?)`,
+		objs[1].ToString(), objs[2].ToString()); err != nil {
+		t.Fatalf("TestParallelLoad update failed: %v", err)
+	}
+	db.Close()
+	DumpSqlTextFile(tempdir+"/"+DefaultUserDbname+".sqlite", tempdir+"/"+DefaultUserDbname+".sql", "bad", "end bad")
+	if rep, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{Mode: LoadLenient, Workers: 3}); err != nil || len(rep.Problems) != 2 {
+		t.Errorf("TestParallelLoad lenient load err=%v problems=%v", err, rep.Problems)
+	}
+	if rep, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{Mode: LoadStrict, Workers: 3}); err == nil || len(rep.Problems) != 1 {
+		t.Errorf("TestParallelLoad strict load err=%v problems=%v", err, rep.Problems)
+	}
+}
+
+// a store failing to read its user objects after some rows
+type failingRowsStoreMo struct {
+	*MemoryStoreMo
+}
+
+func (fs failingRowsStoreMo) ObjectRows(globflag bool, fn func(row *ObjectRowMo)) error {
+	if globflag == GlobalObjects {
+		return fs.MemoryStoreMo.ObjectRows(globflag, fn)
+	}
+	nbrows := 0
+	fs.MemoryStoreMo.ObjectRows(globflag, func(row *ObjectRowMo) {
+		if nbrows < 10 {
+			fn(row)
+		}
+		nbrows++
+	})
+	return fmt.Errorf("failing after %d rows", nbrows)
+}
+
+func TestParallelLoadFailure(t *testing.T) {
+	objs := makeTestWorld(100)
+	oldsys := Glob_the_system
+	Glob_the_system = objs[0]
+	defer func() { Glob_the_system = oldsys }()
+	st := NewMemoryStore("failing")
+	DumpIntoStore(st)
+	nbgoroutines := runtime.NumGoroutine()
+	if _, err := LoadFromStoreE(failingRowsStoreMo{st}, LoadOptionsMo{Workers: 4}); err == nil {
+		t.Fatalf("TestParallelLoadFailure load did not fail")
+	}
+	// the workers are joined before the failed load returns
+	if nb := runtime.NumGoroutine(); nb > nbgoroutines {
+		t.Errorf("TestParallelLoadFailure %d goroutines after the load, %d before", nb, nbgoroutines)
+	}
+}
+
+const benchLoadNbObjects = 1000000
+
+var benchWorldOnce sync.Once
+
+// compare the loading time of a generated world of a million objects
+// with various numbers of workers, e.g. with
+//   go test -run NONE -bench LoadWorld -benchtime 1x objvalmo
+func BenchmarkLoadWorld(b *testing.B) {
+	const tempdir = "/tmp/montestbenchworld"
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	benchWorldOnce.Do(func() {
+		osexec.Command("rm", "-rf", tempdir).Run()
+		objs := makeTestWorld(benchLoadNbObjects)
+		oldsys := Glob_the_system
+		Glob_the_system = objs[0]
+		DumpIntoDirectory(tempdir)
+		Glob_the_system = oldsys
+	})
+	nbworkers := []int{1, 2, 4}
+	if runtime.NumCPU() > 4 {
+		nbworkers = append(nbworkers, runtime.NumCPU())
+	}
+	for _, nbw := range nbworkers {
+		b.Run(fmt.Sprintf("workers%d", nbw), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rep, err := LoadFromDirectoryE(tempdir, LoadOptionsMo{Workers: nbw})
+				if err != nil || rep.NbObjects < benchLoadNbObjects {
+					b.Fatalf("BenchmarkLoadWorld failed with %d workers: %v", nbw, err)
+				}
+			}
+		})
+	}
+}
+
+// a full dump into another store keeps the dirty objects for the next
+// incremental dump, even when their mtime did not change
+func TestFullDumpKeepsDirty(t *testing.T) {
+	objs := makeTestWorld(10)
+	oldsys := Glob_the_system
+	Glob_the_system = objs[0]
+	defer func() { Glob_the_system = oldsys }()
+	incrst := NewMemoryStore("incremental")
+	DumpIncrementallyIntoStore(incrst)
+	oldmtime := objs[2].Mtime()
+	objs[2].PutAttr(objs[3], MakeStringV("same second"))
+	objs[2].UnsyncPutMtime(oldmtime)
+	DumpIntoStore(NewMemoryStore("other"))
+	if nbup, nbdel := DumpIncrementallyIntoStore(incrst); nbup != 1 || nbdel != 0 {
+		t.Errorf("TestFullDumpKeepsDirty nbup=%d nbdel=%d, want 1 and 0", nbup, nbdel)
+	}
+	if row := incrst.ObjectRow(UserObjects, objs[2].ToString()); row == nil || !strings.Contains(row.JsonCont, "same second") {
+		t.Errorf("TestFullDumpKeepsDirty bad row %+v", row)
+	}
+}
+
+// the rows of a store, by id, with their content and payload
+func storeRowsContents(t *testing.T, st StoreMo) map[string]string {
+	conts := make(map[string]string)
+	for _, globflag := range []bool{GlobalObjects, UserObjects} {
+		err := st.ObjectRows(globflag, func(row *ObjectRowMo) {
+			conts[row.Id] = fmt.Sprintf("%t %d %s %s %s", globflag, row.Mtime, row.JsonCont, row.PaylKind, row.PaylCont)
+		})
+		if err != nil {
+			t.Fatalf("storeRowsContents %v failed - %v", st, err)
+		}
+	}
+	return conts
+}
+
+// objects referring to objects becoming persistent or transient are
+// dumped again, so an incremental dump is like a full one
+func TestIncrementalDumpPersistence(t *testing.T) {
+	root := NewObj().UnsyncSetSpaceNum(SpaUser)
+	refer := NewObj().UnsyncSetSpaceNum(SpaUser)
+	trans := NewObj()
+	dropped := NewObj().UnsyncSetSpaceNum(SpaUser)
+	root.UnsyncAddValues(MakeRefobV(refer))
+	refer.UnsyncPutAttr(trans, MakeStringV("hidden attribute"))
+	refer.UnsyncAddValues(MakeRefobV(trans), MakeRefobV(dropped))
+	oldsys := Glob_the_system
+	Glob_the_system = root
+	defer func() { Glob_the_system = oldsys }()
+	incrst := NewMemoryStore("incremental")
+	DumpIncrementallyIntoStore(incrst)
+	// refer keeps its mtime and is not dirty
+	trans.UnsyncSetSpaceNum(SpaUser)
+	dropped.UnsyncSetSpaceNum(SpaTransient)
+	UnmarkDirtyObjects(trans, dropped)
+	if nbup, nbdel := DumpIncrementallyIntoStore(incrst); nbup != 2 || nbdel != 1 {
+		t.Errorf("TestIncrementalDumpPersistence nbup=%d nbdel=%d, want 2 and 1", nbup, nbdel)
+	}
+	fullst := NewMemoryStore("full")
+	DumpIntoStore(fullst)
+	incrconts, fullconts := storeRowsContents(t, incrst), storeRowsContents(t, fullst)
+	if len(incrconts) != len(fullconts) {
+		t.Errorf("TestIncrementalDumpPersistence %d incremental rows, %d full rows", len(incrconts), len(fullconts))
+	}
+	for idstr, fullcont := range fullconts {
+		if incrcont := incrconts[idstr]; incrcont != fullcont {
+			t.Errorf("TestIncrementalDumpPersistence row %s incrementally %q fully %q", idstr, incrcont, fullcont)
+		}
+	}
+}
+
+func TestIncrementalDump(t *testing.T) {
+	const tempdir = "/tmp/montestincrdump"
+	osexec.Command("rm", "-rf", tempdir).Run()
+	root := NewObj()
+	kept := NewObj()
+	changed := NewObj()
+	dropped := NewObj()
+	for _, pob := range []*ObjectMo{root, kept, changed, dropped} {
+		pob.UnsyncSetSpaceNum(SpaUser)
+	}
+	root.UnsyncAddValues(MakeRefobV(kept), MakeRefobV(changed), MakeRefobV(dropped))
+	oldsys := Glob_the_system
+	Glob_the_system = root
+	defer func() { Glob_the_system = oldsys }()
+	if nbup, _ := DumpIncrementallyIntoDirectory(tempdir); nbup >= 0 {
+		t.Errorf("TestIncrementalDump first dump not full nbup=%d", nbup)
+	}
+	// nothing changed, nothing to do
+	if nbup, nbdel := DumpIncrementallyIntoDirectory(tempdir); nbup != 0 || nbdel != 0 {
+		t.Errorf("TestIncrementalDump unchanged dump nbup=%d nbdel=%d", nbup, nbdel)
+	}
+	changed.PutAttr(kept, MakeStringV("changed"))
+	root.TruncateComps(2)
+	nbup, nbdel := DumpIncrementallyIntoDirectory(tempdir)
+	if nbup != 2 || nbdel != 1 {
+		t.Errorf("TestIncrementalDump nbup=%d nbdel=%d, want 2 and 1", nbup, nbdel)
+	}
+	userids := querySqlStrings(t, tempdir+"/"+DefaultUserDbname+".sqlite",
+		"SELECT ob_id FROM t_objects ORDER BY ob_id")
+	wantids := []string{root.ToString(), kept.ToString(), changed.ToString()}
+	sort.Strings(wantids)
+	if strings.Join(userids, " ") != strings.Join(wantids, " ") {
+		t.Errorf("TestIncrementalDump bad user objects %v", userids)
+	}
+	sqltext, err := ioutil.ReadFile(tempdir + "/" + DefaultUserDbname + ".sql")
+	if err != nil || !bytes.Contains(sqltext, []byte(`"changed"`)) || bytes.Contains(sqltext, []byte(dropped.ToString())) {
+		t.Errorf("TestIncrementalDump .sql not regenerated err=%v", err)
+	}
+	changed.RemoveAttr(kept)
+	LoadFromDirectory(tempdir)
+	if !EqualValues(changed.GetAttr(kept), MakeStringV("changed")) {
+		t.Errorf("TestIncrementalDump bad reload of changed=%v", changed)
+	}
+}
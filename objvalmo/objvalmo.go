@@ -4,9 +4,11 @@ package objvalmo  // import "github.com/bstarynk/monimelt/objvalmo"
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"math"
+	"math/big"
 	"regexp"
 	"runtime"
 	"serialmo" // import "github.com/bstarynk/monimelt/serialmo"
@@ -27,6 +29,9 @@ const (
 	TyColRefV
 	TySetV
 	TyTupleV
+	TyNodeV
+	TyBigIntV
+	TyBytesV
 )
 
 const (
@@ -38,13 +43,15 @@ const (
 )
 
 type ObjectMo struct {
-	obid    serialmo.IdentMo
-	obmtx   sync.Mutex
-	obspace uint8
-	obmtime int64
-	obattrs map[*ObjectMo]ValueMo
-	obcomps []ValueMo
-	obpayl  PayloadMo
+	obid       serialmo.IdentMo
+	obmtx      sync.Mutex
+	obspace    uint8
+	obmtime    int64
+	obmodcount uint64 // incremented by every modification
+	obclass    *ObjectMo
+	obattrs    map[*ObjectMo]ValueMo
+	obcomps    []ValueMo
+	obpayl     PayloadMo
 }
 
 type PayloadMo interface {
@@ -123,6 +130,70 @@ func (sv StringV) String() string {
 	return fmt.Sprintf("%q", sv.str)
 }
 
+//////////////// byte blob values, any bytes (not only UTF-8)
+type BytesVMo interface {
+	ValueMo
+	isBytesV() // private
+	Length() int
+	Bytes() []byte
+}
+
+type BytesV struct {
+	byhash serialmo.HashMo
+	bydata []byte
+}
+
+func (BytesV) isBytesV() {}
+
+func (bv BytesV) Length() int {
+	return len(bv.bydata)
+}
+
+// a fresh copy, since byte values are immutable
+func (bv BytesV) Bytes() []byte {
+	res := make([]byte, len(bv.bydata))
+	copy(res, bv.bydata)
+	return res
+}
+
+func (BytesV) TypeV() uint {
+	return TyBytesV
+}
+
+func (bv BytesV) DumpScan(du *DumperMo) {}
+
+func BytesHash(b []byte) serialmo.HashMo {
+	var h1, h2 uint32
+	for ix, by := range b {
+		uc := uint32(by)
+		if ix%2 == 0 {
+			h1 = (h1 * 317) ^ ((uc * 1291) + uint32(ix&0xff))
+		} else {
+			h2 = (h2 * 919) + (uc * 3187) - uint32(ix&0xff)
+		}
+	}
+	h := h1 ^ h2 ^ (4091 * uint32(len(b)))
+	if h == 0 {
+		h = 7*(h1&0xfffff) + 3*(h2&0xfffff) + uint32(len(b)&0xfffff) + 13
+	}
+	return serialmo.HashMo(h)
+}
+
+func MakeBytesV(b []byte) BytesV {
+	bcopy := make([]byte, len(b))
+	copy(bcopy, b)
+	return BytesV{byhash: BytesHash(bcopy), bydata: bcopy}
+}
+
+func (bv BytesV) Hash() serialmo.HashMo {
+	return bv.byhash
+}
+
+// printable bytes, as #"base64"
+func (bv BytesV) String() string {
+	return `#"` + base64.StdEncoding.EncodeToString(bv.bydata) + `"`
+}
+
 //////////////// integer values
 type IntVMo interface {
 	ValueMo
@@ -162,6 +233,112 @@ func (iv IntV) String() string {
 
 func (sv IntV) DumpScan(du *DumperMo) {}
 
+//////////////// big integer values, never fitting in an int
+type BigIntVMo interface {
+	ValueMo
+	isBigIntV() // private
+	BigInt() *big.Int
+	Sign() int
+	ToString() string
+}
+
+type BigIntV struct {
+	bhash serialmo.HashMo
+	bint  *big.Int
+}
+
+func (BigIntV) isBigIntV() {}
+
+func (BigIntV) TypeV() uint {
+	return TyBigIntV
+}
+
+// a fresh copy, since big integer values are immutable
+func (bv BigIntV) BigInt() *big.Int {
+	return new(big.Int).Set(bv.bint)
+}
+
+func (bv BigIntV) Sign() int {
+	return bv.bint.Sign()
+}
+
+func (bv BigIntV) Hash() serialmo.HashMo {
+	return bv.bhash
+}
+
+// the bounds of int, as big integers (big.Int.IsInt64 needs Go 1.9)
+var big_max_int = big.NewInt(int64(int(^uint(0) >> 1)))
+var big_min_int = big.NewInt(int64(-int(^uint(0)>>1) - 1))
+
+func bigIntFitsInt(b *big.Int) bool {
+	return b.Cmp(big_min_int) >= 0 && b.Cmp(big_max_int) <= 0
+}
+
+// the hash of a big integer fitting in an int is the hash of that IntV
+func BigIntHash(b *big.Int) serialmo.HashMo {
+	if bigIntFitsInt(b) {
+		return IntV(int(b.Int64())).Hash()
+	}
+	var h1, h2 uint32
+	h1 = uint32(b.Sign() + 2)
+	h2 = uint32(b.BitLen())
+	for ix, w := range b.Bits() {
+		uw := uint64(w)
+		if ix%2 == 0 {
+			h1 = (h1 * 2539) ^ (uint32(uw) + 7*uint32(uw>>32))
+		} else {
+			h2 = (h2 * 4217) + (11 * uint32(uw)) - uint32(uw>>32)
+		}
+	}
+	h := (29 * h1) ^ (1031 * h2)
+	if h == 0 {
+		h = 5*(h1&0xfffff) + 13*(h2&0xfffff) + 23
+	}
+	return serialmo.HashMo(h)
+}
+
+// gives an IntV if b fits in an int, else a BigIntV
+func MakeBigIntV(b *big.Int) ValueMo {
+	if b == nil {
+		panic("objvalmo.MakeBigIntV nil big")
+	}
+	if bigIntFitsInt(b) {
+		return MakeIntV(int(b.Int64()))
+	}
+	bcopy := new(big.Int).Set(b)
+	return BigIntV{bhash: BigIntHash(bcopy), bint: bcopy}
+}
+
+// parse a decimal (or 0x hexadecimal...) integer of any size, giving
+// an IntV or a BigIntV
+func ParseIntegerV(s string) (ValueMo, error) {
+	b, ok := new(big.Int).SetString(s, 0)
+	if !ok {
+		return nil, fmt.Errorf("objvalmo.ParseIntegerV bad integer %q", s)
+	}
+	return MakeBigIntV(b), nil
+}
+
+// parse a decimal integer of any size, in the form printed by
+// ValueString, giving an IntV or a BigIntV
+func ParseIntegerV10(s string) (ValueMo, error) {
+	b, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("objvalmo.ParseIntegerV10 bad decimal integer %q", s)
+	}
+	return MakeBigIntV(b), nil
+}
+
+func (bv BigIntV) ToString() string {
+	return bv.bint.String()
+}
+
+func (bv BigIntV) String() string {
+	return bv.bint.String()
+}
+
+func (bv BigIntV) DumpScan(du *DumperMo) {}
+
 //////////////// float values
 type FloatVMo interface {
 	ValueMo
@@ -636,9 +813,7 @@ func (sq SequenceV) seqToString(begc rune, endc rune) string {
 }
 
 func makeCheckedSequenceSlice(hinit uint32, k1 uint32, k2 uint32, objs []*ObjectMo) SequenceV {
-	if objs == nil {
-		return SequenceV{}
-	}
+	// an empty sequence, even from a nil slice, gets its genuine hash
 	l := len(objs)
 	var h1, h2 uint32
 	h1 = hinit
@@ -667,34 +842,16 @@ func makeCheckedSequence(hinit uint32, k1 uint32, k2 uint32, objs ...*ObjectMo)
 	return makeCheckedSequenceSlice(hinit, k1, k2, objs)
 }
 
+// the nil objects are skipped, so the hash is the one of the checked
+// sequence of the kept objects
 func makeSkippedSequenceSlice(hinit uint32, k1 uint32, k2 uint32, objs []*ObjectMo) SequenceV {
-	if objs == nil {
-		return SequenceV{}
-	}
-	l := len(objs)
-	var h1, h2 uint32
-	h1 = hinit
-	h2 = k1*uint32(l) + k2
-	sq := make([]*ObjectMo, 0, l)
-	for i, j := 0, 0; i < l; i++ {
-		curobj := objs[i]
-		if curobj == nil {
-			continue
+	kept := make([]*ObjectMo, 0, len(objs))
+	for _, curobj := range objs {
+		if curobj != nil {
+			kept = append(kept, curobj)
 		}
-		hob := uint32(HashObptr(curobj))
-		if j%2 == 0 {
-			h1 = (k1 * h1) ^ (k2*hob + uint32(j))
-		} else {
-			h2 = (k2 * h2) + (k1*hob - uint32(5*j))
-		}
-		sq = append(sq, curobj)
-		j++
 	}
-	hs := (13 * h1) ^ (4093 * h2)
-	if hs == 0 {
-		hs = 31*(h1&0xfffff) + 5*(h2&0xfffff) + uint32(17+l&0xff)
-	}
-	return SequenceV{shash: serialmo.HashMo(hs), scomps: sq}
+	return makeCheckedSequenceSlice(hinit, k1, k2, kept)
 }
 
 func makeSkippedSequence(hinit uint32, k1 uint32, k2 uint32, objs ...*ObjectMo) SequenceV {
@@ -705,6 +862,12 @@ func makeSkippedSequence(hinit uint32, k1 uint32, k2 uint32, objs ...*ObjectMo)
 type TupleVMo interface {
 	SequenceVMo
 	isTupleV() // private
+	Slice(i, j int) TupleV
+	Concat(tuples ...TupleV) TupleV
+	Reverse() TupleV
+	IndexOf(pob *ObjectMo) int
+	Filter(f func(*ObjectMo) bool) TupleV
+	Map(f func(*ObjectMo) *ObjectMo) TupleV
 }
 
 type TupleV struct {
@@ -751,6 +914,84 @@ func (tu TupleV) String() string {
 	return tu.seqToString('[', ']')
 }
 
+// like tu[i:j] with negative indexes counted from the end, may panic
+func (tu TupleV) Slice(i, j int) TupleV {
+	l := len(tu.scomps)
+	if i < 0 {
+		i += l
+	}
+	if j < 0 {
+		j += l
+	}
+	if i < 0 || j > l || i > j {
+		panic(fmt.Sprintf("objvalmo.Slice(TupleV) out of bounds i=%d j=%d length=%d", i, j, l))
+	}
+	if i == 0 && j == l {
+		return tu
+	}
+	return TupleV{makeCheckedSequenceSlice(hinitTuple, k1Tuple, k2Tuple, tu.scomps[i:j])}
+}
+
+func (tu TupleV) Concat(tuples ...TupleV) TupleV {
+	l := len(tu.scomps)
+	for _, otu := range tuples {
+		l += len(otu.scomps)
+	}
+	if l == len(tu.scomps) {
+		return tu
+	}
+	objs := make([]*ObjectMo, 0, l)
+	objs = append(objs, tu.scomps...)
+	for _, otu := range tuples {
+		objs = append(objs, otu.scomps...)
+	}
+	return TupleV{makeCheckedSequenceSlice(hinitTuple, k1Tuple, k2Tuple, objs)}
+}
+
+func (tu TupleV) Reverse() TupleV {
+	l := len(tu.scomps)
+	objs := make([]*ObjectMo, l)
+	for ix, pob := range tu.scomps {
+		objs[l-1-ix] = pob
+	}
+	return TupleV{makeCheckedSequenceSlice(hinitTuple, k1Tuple, k2Tuple, objs)}
+}
+
+// the index of the first occurrence of pob, or -1
+func (tu TupleV) IndexOf(pob *ObjectMo) int {
+	if pob == nil {
+		return -1
+	}
+	for ix, curob := range tu.scomps {
+		if curob == pob {
+			return ix
+		}
+	}
+	return -1
+}
+
+// the tuple of components satisfying f, in the same order
+func (tu TupleV) Filter(f func(*ObjectMo) bool) TupleV {
+	objs := make([]*ObjectMo, 0, len(tu.scomps))
+	for _, curob := range tu.scomps {
+		if f(curob) {
+			objs = append(objs, curob)
+		}
+	}
+	return TupleV{makeCheckedSequenceSlice(hinitTuple, k1Tuple, k2Tuple, objs)}
+}
+
+// the tuple of f applied to each component, dropping the nil results
+func (tu TupleV) Map(f func(*ObjectMo) *ObjectMo) TupleV {
+	objs := make([]*ObjectMo, 0, len(tu.scomps))
+	for _, curob := range tu.scomps {
+		if newob := f(curob); newob != nil {
+			objs = append(objs, newob)
+		}
+	}
+	return TupleV{makeCheckedSequenceSlice(hinitTuple, k1Tuple, k2Tuple, objs)}
+}
+
 // private type for ordering slice of object pointers
 type ordSliceObptr []*ObjectMo
 
@@ -810,6 +1051,11 @@ type SetVMo interface {
 	SequenceVMo
 	isSetV() // private
 	SetContains(ob *ObjectMo) bool
+	SetUnion(oth SetV) SetV
+	SetIntersection(oth SetV) SetV
+	SetDifference(oth SetV) SetV
+	SetIsSubset(oth SetV) bool
+	SetEqual(oth SetV) bool
 }
 
 type SetV struct {
@@ -878,6 +1124,287 @@ func (set SetV) SetContains(pob *ObjectMo) bool {
 	return false
 } // end SetContains
 
+//// set algebra, merging in linear time the sorted scomps
+
+// the slice should be already sorted without duplicates
+func makeSortedSetSlice(objs []*ObjectMo) SetV {
+	return SetV{makeCheckedSequenceSlice(hinitSet, k1Set, k2Set, objs)}
+}
+
+func (set SetV) SetUnion(oth SetV) SetV {
+	ls := len(set.scomps)
+	lo := len(oth.scomps)
+	if lo == 0 {
+		return set
+	}
+	if ls == 0 {
+		return oth
+	}
+	res := make([]*ObjectMo, 0, ls+lo)
+	is, io := 0, 0
+	for is < ls && io < lo {
+		sob := set.scomps[is]
+		oob := oth.scomps[io]
+		if sob == oob {
+			res = append(res, sob)
+			is++
+			io++
+		} else if LessObptr(sob, oob) {
+			res = append(res, sob)
+			is++
+		} else {
+			res = append(res, oob)
+			io++
+		}
+	}
+	res = append(res, set.scomps[is:]...)
+	res = append(res, oth.scomps[io:]...)
+	if len(res) == ls {
+		return set
+	}
+	if len(res) == lo {
+		return oth
+	}
+	return makeSortedSetSlice(res)
+} // end SetUnion
+
+func (set SetV) SetIntersection(oth SetV) SetV {
+	ls := len(set.scomps)
+	lo := len(oth.scomps)
+	minl := ls
+	if lo < minl {
+		minl = lo
+	}
+	res := make([]*ObjectMo, 0, minl)
+	is, io := 0, 0
+	for is < ls && io < lo {
+		sob := set.scomps[is]
+		oob := oth.scomps[io]
+		if sob == oob {
+			res = append(res, sob)
+			is++
+			io++
+		} else if LessObptr(sob, oob) {
+			is++
+		} else {
+			io++
+		}
+	}
+	if len(res) == ls {
+		return set
+	}
+	return makeSortedSetSlice(res)
+} // end SetIntersection
+
+// the elements of set which are not in oth
+func (set SetV) SetDifference(oth SetV) SetV {
+	ls := len(set.scomps)
+	lo := len(oth.scomps)
+	if ls == 0 || lo == 0 {
+		return set
+	}
+	res := make([]*ObjectMo, 0, ls)
+	is, io := 0, 0
+	for is < ls && io < lo {
+		sob := set.scomps[is]
+		oob := oth.scomps[io]
+		if sob == oob {
+			is++
+			io++
+		} else if LessObptr(sob, oob) {
+			res = append(res, sob)
+			is++
+		} else {
+			io++
+		}
+	}
+	res = append(res, set.scomps[is:]...)
+	if len(res) == ls {
+		return set
+	}
+	return makeSortedSetSlice(res)
+} // end SetDifference
+
+// true if every element of set is in oth
+func (set SetV) SetIsSubset(oth SetV) bool {
+	ls := len(set.scomps)
+	lo := len(oth.scomps)
+	if ls > lo {
+		return false
+	}
+	is, io := 0, 0
+	for is < ls && io < lo {
+		sob := set.scomps[is]
+		oob := oth.scomps[io]
+		if sob == oob {
+			is++
+			io++
+		} else if LessObptr(oob, sob) {
+			io++
+		} else {
+			return false
+		}
+		if ls-is > lo-io {
+			return false
+		}
+	}
+	return is == ls
+} // end SetIsSubset
+
+func (set SetV) SetEqual(oth SetV) bool {
+	ls := len(set.scomps)
+	if ls != len(oth.scomps) || set.shash != oth.shash {
+		return false
+	}
+	for ix := 0; ix < ls; ix++ {
+		if set.scomps[ix] != oth.scomps[ix] {
+			return false
+		}
+	}
+	return true
+} // end SetEqual
+
+//////////////// node values
+type NodeVMo interface {
+	ValueMo
+	isNodeV() // private
+	Conn() *ObjectMo
+	ConnId() serialmo.IdentMo
+	NbSons() int
+	SonAt(rk int) ValueMo  // may panic
+	NthSon(rk int) ValueMo // or nil
+	ToString() string
+}
+
+type NodeV struct {
+	nhash serialmo.HashMo
+	nconn *ObjectMo
+	nsons []ValueMo
+}
+
+func (NodeV) isNodeV() {}
+
+func (NodeV) TypeV() uint {
+	return TyNodeV
+}
+
+func (nd NodeV) Hash() serialmo.HashMo { return nd.nhash }
+
+func (nd NodeV) Conn() *ObjectMo {
+	return nd.nconn
+}
+
+func (nd NodeV) ConnId() serialmo.IdentMo {
+	return nd.nconn.obid
+}
+
+func (nd NodeV) NbSons() int {
+	return len(nd.nsons)
+}
+
+func (nd NodeV) SonAt(rk int) ValueMo {
+	l := len(nd.nsons)
+	if rk < 0 {
+		rk += l
+	}
+	if rk < 0 || rk >= l {
+		panic("objvalmo.SonAt(NodeV) out of bounds")
+	}
+	return nd.nsons[rk]
+}
+
+func (nd NodeV) NthSon(rk int) ValueMo {
+	l := len(nd.nsons)
+	if rk < 0 {
+		rk += l
+	}
+	if rk < 0 || rk >= l {
+		return nil
+	}
+	return nd.nsons[rk]
+}
+
+const hinitNode = 4001
+const k1Node = 3163
+const k2Node = 5081
+
+// sons may be nil values
+func MakeNodeSliceV(conn *ObjectMo, sons []ValueMo) NodeV {
+	if conn == nil {
+		panic("objvalmo.MakeNodeV nil conn")
+	}
+	l := len(sons)
+	var h1, h2 uint32
+	h1 = hinitNode ^ (k1Node * uint32(HashObptr(conn)))
+	h2 = k2Node*uint32(l) + k1Node
+	nsons := make([]ValueMo, l)
+	for i, son := range sons {
+		var hson uint32
+		if son != nil {
+			hson = uint32(son.Hash())
+		}
+		if i%2 == 0 {
+			h1 = (k1Node * h1) ^ (k2Node*hson + uint32(i))
+		} else {
+			h2 = (k2Node * h2) + (k1Node*hson - uint32(3*i))
+		}
+		nsons[i] = son
+	}
+	hn := (17 * h1) ^ (2063 * h2)
+	if hn == 0 {
+		hn = 37*(h1&0xfffff) + 7*(h2&0xfffff) + uint32(19+l&0xff)
+	}
+	return NodeV{nhash: serialmo.HashMo(hn), nconn: conn, nsons: nsons}
+}
+
+func MakeNodeV(conn *ObjectMo, sons ...ValueMo) NodeV {
+	return MakeNodeSliceV(conn, sons)
+}
+
+func (nd NodeV) DumpScan(du *DumperMo) {
+	du.AddDumpedObject(nd.nconn)
+	for _, son := range nd.nsons {
+		if son != nil {
+			son.DumpScan(du)
+		}
+	}
+}
+
+// printable value, with nil shown as ~
+func ValueString(v ValueMo) string {
+	if v == nil {
+		return "~"
+	}
+	if sv, ok := v.(fmt.Stringer); ok {
+		return sv.String()
+	}
+	if tv, ok := v.(interface {
+		ToString() string
+	}); ok {
+		return tv.ToString()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func (nd NodeV) ToString() string {
+	var buf bytes.Buffer
+	buf.WriteRune('*')
+	buf.WriteString(nd.nconn.obid.ToString())
+	buf.WriteRune('(')
+	for ix, son := range nd.nsons {
+		if ix > 0 {
+			buf.WriteRune(' ')
+		}
+		buf.WriteString(ValueString(son))
+	}
+	buf.WriteRune(')')
+	return buf.String()
+}
+
+func (nd NodeV) String() string {
+	return nd.ToString()
+}
+
 ////////////////////////////////////////////////////////////////
 type bucketTy struct {
 	bu_mtx   sync.Mutex
@@ -1005,8 +1532,12 @@ func (pob *ObjectMo) ObId() serialmo.IdentMo {
 	return pob.obid
 }
 
+// every modification of an object touches it, updating its mtime and
+// modification count, and marking it as dirty
 func (pob *ObjectMo) UnsyncTouch() {
 	pob.obmtime = time.Now().Unix()
+	pob.obmodcount++
+	markDirty(pob)
 }
 
 func (pob *ObjectMo) UnsyncPutMtime(tim int64) {
@@ -1017,6 +1548,19 @@ func (pob *ObjectMo) UnsyncMtime() int64 {
 	return pob.obmtime
 }
 
+func (pob *ObjectMo) UnsyncModCount() uint64 {
+	return pob.obmodcount
+}
+
+func (pob *ObjectMo) ModCount() uint64 {
+	if pob == nil {
+		panic("ModCount nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	return pob.obmodcount
+}
+
 func (pob *ObjectMo) String() string {
 	if pob == nil {
 		return "__"
@@ -1047,16 +1591,20 @@ func (pob *ObjectMo) SpaceNum() uint8 {
 	return pob.UnsyncSpaceNum()
 }
 
+// scan the snapshot of pob taken by the dumper, without keeping pob
+// locked, since scanning locks other objects
 func (pob *ObjectMo) DumpScanInsideObject(du *DumperMo) {
 	log.Printf("DumpScanInsideObject start pob=%v\n", pob)
 	defer log.Printf("DumpScanInsideObject end pob=%v\n", pob)
 	if pob == nil || du == nil {
 		panic("DumpScanInsideObject corruption")
 	}
-	pob.obmtx.Lock()
-	defer pob.obmtx.Unlock()
+	snap := du.snapshotObject(pob)
 	log.Printf("DumpScanInsideObject inside pob=%v\n", pob)
-	for patob, pval := range pob.obattrs {
+	if snap.snclass != nil {
+		du.AddDumpedObject(snap.snclass)
+	}
+	for patob, pval := range snap.snattrs {
 		log.Printf("DumpScanInsideObject in pob=%v patob=%v pval=%v\n", pob, patob, pval)
 		du.AddDumpedObject(patob)
 		if !du.IsDumpedObject(patob) {
@@ -1064,13 +1612,17 @@ func (pob *ObjectMo) DumpScanInsideObject(du *DumperMo) {
 		}
 		pval.DumpScan(du)
 	}
-	for cix, cval := range pob.obcomps {
+	for cix, cval := range snap.sncomps {
 		log.Printf("DumpScanInsideObject in pob=%v cix=%d cval=%v\n", pob, cix, cval)
+		// e.g. a loaded reference to a transient object, dumped as null
+		if cval == nil {
+			continue
+		}
 		cval.DumpScan(du)
 	}
-	if pob.obpayl != nil {
-		log.Printf("DumpScanInsideObject in pob=%v payload %v\n", pob, pob.obpayl)
-		(pob.obpayl).DumpScanPayl(pob, du)
+	if snap.snpayl != nil {
+		log.Printf("DumpScanInsideObject in pob=%v payload %v\n", pob, snap.snpayl)
+		(snap.snpayl).DumpScanPayl(pob, du)
 	}
 } // end DumpScanInsideObject
 
@@ -1099,6 +1651,7 @@ func (pob *ObjectMo) UnsyncSetSpaceNum(sp uint8) *ObjectMo {
 		predefined_map[pob.obid] = pob
 	}
 	pob.obspace = sp
+	pob.UnsyncTouch()
 	return pob
 }
 
@@ -1116,6 +1669,7 @@ func (pob *ObjectMo) UnsyncPutAttr(pobat *ObjectMo, val ValueMo) *ObjectMo {
 		pob.obattrs = make(map[*ObjectMo]ValueMo)
 	}
 	pob.obattrs[pobat] = val
+	pob.UnsyncTouch()
 	return pob
 } // end UnsyncPutAttr
 
@@ -1127,6 +1681,7 @@ func (pob *ObjectMo) UnsyncAppendVal(val ValueMo) *ObjectMo {
 		pob.obcomps = make([]ValueMo, 0, 7)
 	}
 	pob.obcomps = append(pob.obcomps, val)
+	pob.UnsyncTouch()
 	return pob
 } // end UnsyncAppendVal
 
@@ -1138,9 +1693,383 @@ func (pob *ObjectMo) UnsyncAddValues(vals ...ValueMo) *ObjectMo {
 		pob.obcomps = make([]ValueMo, 0, (5+5*len(vals)/4)|7)
 	}
 	pob.obcomps = append(pob.obcomps, vals...)
+	pob.UnsyncTouch()
 	return pob
 } // end UnsyncAddValues
 
+func (pob *ObjectMo) UnsyncGetAttr(pobat *ObjectMo) ValueMo {
+	if pob == nil {
+		panic("UnsyncGetAttr nil pob")
+	}
+	if pobat == nil {
+		return nil
+	}
+	return pob.obattrs[pobat]
+} // end UnsyncGetAttr
+
+func (pob *ObjectMo) UnsyncHasAttr(pobat *ObjectMo) bool {
+	if pob == nil {
+		panic("UnsyncHasAttr nil pob")
+	}
+	if pobat == nil {
+		return false
+	}
+	_, found := pob.obattrs[pobat]
+	return found
+} // end UnsyncHasAttr
+
+func (pob *ObjectMo) UnsyncRemoveAttr(pobat *ObjectMo) *ObjectMo {
+	if pob == nil {
+		panic("UnsyncRemoveAttr nil pob")
+	}
+	if _, found := pob.obattrs[pobat]; !found {
+		return pob
+	}
+	delete(pob.obattrs, pobat)
+	pob.UnsyncTouch()
+	return pob
+} // end UnsyncRemoveAttr
+
+// the attributes of an object, sorted by LessObptr
+func (pob *ObjectMo) UnsyncAttrKeys() []*ObjectMo {
+	if pob == nil {
+		panic("UnsyncAttrKeys nil pob")
+	}
+	keys := make([]*ObjectMo, 0, len(pob.obattrs))
+	for pobat := range pob.obattrs {
+		keys = append(keys, pobat)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return LessObptr(keys[i], keys[j])
+	})
+	return keys
+} // end UnsyncAttrKeys
+
+func (pob *ObjectMo) UnsyncNbComps() int {
+	if pob == nil {
+		panic("UnsyncNbComps nil pob")
+	}
+	return len(pob.obcomps)
+}
+
+// like SequenceV's At, a negative rk counts from the end
+func (pob *ObjectMo) UnsyncCompAt(rk int) ValueMo {
+	if pob == nil {
+		panic("UnsyncCompAt nil pob")
+	}
+	l := len(pob.obcomps)
+	if rk < 0 {
+		rk += l
+	}
+	if rk < 0 || rk >= l {
+		panic(fmt.Errorf("UnsyncCompAt pob=%v out of bounds rk=%d l=%d", pob, rk, l))
+	}
+	return pob.obcomps[rk]
+} // end UnsyncCompAt
+
+func (pob *ObjectMo) UnsyncSetCompAt(rk int, val ValueMo) *ObjectMo {
+	if pob == nil {
+		panic("UnsyncSetCompAt nil pob")
+	}
+	l := len(pob.obcomps)
+	if rk < 0 {
+		rk += l
+	}
+	if rk < 0 || rk >= l {
+		panic(fmt.Errorf("UnsyncSetCompAt pob=%v out of bounds rk=%d l=%d", pob, rk, l))
+	}
+	pob.obcomps[rk] = val
+	pob.UnsyncTouch()
+	return pob
+} // end UnsyncSetCompAt
+
+// keep only the first nbc components
+func (pob *ObjectMo) UnsyncTruncateComps(nbc int) *ObjectMo {
+	if pob == nil {
+		panic("UnsyncTruncateComps nil pob")
+	}
+	l := len(pob.obcomps)
+	if nbc < 0 || nbc > l {
+		panic(fmt.Errorf("UnsyncTruncateComps pob=%v bad nbc=%d l=%d", pob, nbc, l))
+	}
+	if nbc == l {
+		return pob
+	}
+	// clear the removed components, so they can be garbage collected
+	for ix := nbc; ix < l; ix++ {
+		pob.obcomps[ix] = nil
+	}
+	pob.obcomps = pob.obcomps[:nbc]
+	pob.UnsyncTouch()
+	return pob
+} // end UnsyncTruncateComps
+
+// insert val before the component of rank rk, which can be the
+// number of components to append, or negative to count from the end
+func (pob *ObjectMo) UnsyncInsertCompAt(rk int, val ValueMo) *ObjectMo {
+	if pob == nil {
+		panic("UnsyncInsertCompAt nil pob")
+	}
+	l := len(pob.obcomps)
+	if rk < 0 {
+		rk += l
+	}
+	if rk < 0 || rk > l {
+		panic(fmt.Errorf("UnsyncInsertCompAt pob=%v out of bounds rk=%d l=%d", pob, rk, l))
+	}
+	pob.obcomps = append(pob.obcomps, nil)
+	copy(pob.obcomps[rk+1:], pob.obcomps[rk:l])
+	pob.obcomps[rk] = val
+	pob.UnsyncTouch()
+	return pob
+} // end UnsyncInsertCompAt
+
+//// classes: the class of an object is some other object, and the
+//// class of a class object is its superclass. Attributes are
+//// inherited thru that chain of classes.
+
+func (pob *ObjectMo) UnsyncClass() *ObjectMo {
+	if pob == nil {
+		panic("UnsyncClass nil pob")
+	}
+	return pob.obclass
+}
+
+func (pob *ObjectMo) UnsyncSetClass(pobcla *ObjectMo) *ObjectMo {
+	if pob == nil {
+		panic("UnsyncSetClass nil pob")
+	}
+	if pob == pobcla {
+		panic(fmt.Errorf("UnsyncSetClass pob=%v cannot be its own class", pob))
+	}
+	if pob.obclass == pobcla {
+		return pob
+	}
+	pob.obclass = pobcla
+	pob.UnsyncTouch()
+	return pob
+} // end UnsyncSetClass
+
+// the value of attribute pobat in pob, or else in its class, or its
+// superclass, etc... The cycles in the class chain are detected,
+// then nil is given.  Only pob should be locked, since the classes
+// are not.
+func (pob *ObjectMo) UnsyncGetAttrInherited(pobat *ObjectMo) ValueMo {
+	if pob == nil {
+		panic("UnsyncGetAttrInherited nil pob")
+	}
+	if pobat == nil {
+		return nil
+	}
+	if val, found := pob.obattrs[pobat]; found {
+		return val
+	}
+	if pob.obclass == nil {
+		return nil
+	}
+	return pob.obclass.getAttrInheritedFrom(pob, pobat)
+} // end UnsyncGetAttrInherited
+
+//// the synchronized variants, locking the object
+
+func (pob *ObjectMo) Mtime() int64 {
+	if pob == nil {
+		panic("Mtime nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	return pob.UnsyncMtime()
+}
+
+func (pob *ObjectMo) GetAttr(pobat *ObjectMo) ValueMo {
+	if pob == nil {
+		panic("GetAttr nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	return pob.UnsyncGetAttr(pobat)
+}
+
+func (pob *ObjectMo) HasAttr(pobat *ObjectMo) bool {
+	if pob == nil {
+		panic("HasAttr nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	return pob.UnsyncHasAttr(pobat)
+}
+
+func (pob *ObjectMo) Class() *ObjectMo {
+	if pob == nil {
+		panic("Class nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	return pob.UnsyncClass()
+}
+
+func (pob *ObjectMo) SetClass(pobcla *ObjectMo) *ObjectMo {
+	if pob == nil {
+		panic("SetClass nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	oldcla := pob.obclass
+	pob.UnsyncSetClass(pobcla)
+	if oldcla != pobcla {
+		ev := ChangeEventMo{Object: pob, Kind: ChgClass}
+		if oldcla != nil {
+			ev.OldVal = MakeRefobV(oldcla)
+		}
+		if pobcla != nil {
+			ev.NewVal = MakeRefobV(pobcla)
+		}
+		notifyChange(ev)
+	}
+	return pob
+}
+
+// locks each object of the class chain in turn, never two at once
+func (pob *ObjectMo) GetAttrInherited(pobat *ObjectMo) ValueMo {
+	if pob == nil {
+		panic("GetAttrInherited nil pob")
+	}
+	pob.obmtx.Lock()
+	val, found := pob.obattrs[pobat]
+	cla := pob.obclass
+	pob.obmtx.Unlock()
+	if found || cla == nil {
+		return val
+	}
+	return cla.getAttrInheritedFrom(pob, pobat)
+}
+
+// walk the class chain starting at cla for the attribute pobat of pob
+func (cla *ObjectMo) getAttrInheritedFrom(pob *ObjectMo, pobat *ObjectMo) ValueMo {
+	visited := []*ObjectMo{pob}
+	for ; cla != nil; cla = cla.Class() {
+		for _, vob := range visited {
+			if vob == cla {
+				log.Printf("GetAttrInherited pob=%v pobat=%v class cycle at %v\n", pob, pobat, cla)
+				return nil
+			}
+		}
+		visited = append(visited, cla)
+		if val := cla.GetAttr(pobat); val != nil {
+			return val
+		}
+	}
+	return nil
+} // end getAttrInheritedFrom
+
+func (pob *ObjectMo) PutAttr(pobat *ObjectMo, val ValueMo) *ObjectMo {
+	if pob == nil {
+		panic("PutAttr nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	oldval := pob.obattrs[pobat]
+	pob.UnsyncPutAttr(pobat, val)
+	notifyChange(ChangeEventMo{Object: pob, Kind: ChgPutAttr, Attr: pobat, OldVal: oldval, NewVal: val})
+	return pob
+}
+
+func (pob *ObjectMo) RemoveAttr(pobat *ObjectMo) *ObjectMo {
+	if pob == nil {
+		panic("RemoveAttr nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	oldval, found := pob.obattrs[pobat]
+	if !found {
+		return pob
+	}
+	pob.UnsyncRemoveAttr(pobat)
+	notifyChange(ChangeEventMo{Object: pob, Kind: ChgRemoveAttr, Attr: pobat, OldVal: oldval})
+	return pob
+}
+
+func (pob *ObjectMo) AttrKeys() []*ObjectMo {
+	if pob == nil {
+		panic("AttrKeys nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	return pob.UnsyncAttrKeys()
+}
+
+func (pob *ObjectMo) NbComps() int {
+	if pob == nil {
+		panic("NbComps nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	return pob.UnsyncNbComps()
+}
+
+func (pob *ObjectMo) CompAt(rk int) ValueMo {
+	if pob == nil {
+		panic("CompAt nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	return pob.UnsyncCompAt(rk)
+}
+
+func (pob *ObjectMo) SetCompAt(rk int, val ValueMo) *ObjectMo {
+	if pob == nil {
+		panic("SetCompAt nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	oldval := pob.UnsyncCompAt(rk)
+	if rk < 0 {
+		rk += len(pob.obcomps)
+	}
+	pob.UnsyncSetCompAt(rk, val)
+	notifyChange(ChangeEventMo{Object: pob, Kind: ChgSetComp, Index: rk, OldVal: oldval, NewVal: val})
+	return pob
+}
+
+func (pob *ObjectMo) AppendVal(val ValueMo) *ObjectMo {
+	if pob == nil {
+		panic("AppendVal nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	pob.UnsyncAppendVal(val)
+	notifyChange(ChangeEventMo{Object: pob, Kind: ChgAppendComp, Index: len(pob.obcomps) - 1, NewVal: val})
+	return pob
+}
+
+func (pob *ObjectMo) TruncateComps(nbc int) *ObjectMo {
+	if pob == nil {
+		panic("TruncateComps nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	oldnbc := len(pob.obcomps)
+	pob.UnsyncTruncateComps(nbc)
+	if nbc != oldnbc {
+		notifyChange(ChangeEventMo{Object: pob, Kind: ChgTruncateComps, Index: nbc})
+	}
+	return pob
+}
+
+func (pob *ObjectMo) InsertCompAt(rk int, val ValueMo) *ObjectMo {
+	if pob == nil {
+		panic("InsertCompAt nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	pob.UnsyncInsertCompAt(rk, val)
+	if rk < 0 {
+		rk += len(pob.obcomps) - 1
+	}
+	notifyChange(ChangeEventMo{Object: pob, Kind: ChgInsertComp, Index: rk, NewVal: val})
+	return pob
+}
+
 func SlicePredefined() []*ObjectMo {
 	predefined_mtx.Lock()
 	defer predefined_mtx.Unlock()
@@ -1158,9 +2087,15 @@ func SetPredefined() SetV {
 }
 
 func DumpScanPredefined(du *DumperMo) {
+	// AddDumpedObject locks each object, and UnsyncSetSpaceNum locks
+	// predefined_mtx with its object locked
 	predefined_mtx.Lock()
-	defer predefined_mtx.Unlock()
+	predefs := make([]*ObjectMo, 0, len(predefined_map))
 	for _, pob := range predefined_map {
+		predefs = append(predefs, pob)
+	}
+	predefined_mtx.Unlock()
+	for _, pob := range predefs {
 		du.AddDumpedObject(pob)
 	}
 }
@@ -1233,18 +2168,43 @@ func NamesGlobalVariables() []string {
 	return sl
 }
 
-func DumpScanGlobalVariables(du *DumperMo) {
-	log.Printf("DumpScanGlobalVariables start du=%v\n", du)
-	var gcnt int
+// SetGlobalVariable binds the registered global variable vnam to pob,
+// safely while dumping or autosaving
+func SetGlobalVariable(vnam string, pob *ObjectMo) {
+	glovar_mtx.Lock()
+	defer glovar_mtx.Unlock()
+	vad, _ := glovar_map[vnam]
+	if vad == nil {
+		panic(fmt.Errorf("SetGlobalVariable unknown vnam %q", vnam))
+	}
+	*vad = pob
+}
+
+// the objects bound to the global variables, by name
+func globalVariablesBindings() map[string]*ObjectMo {
 	glovar_mtx.Lock()
 	defer glovar_mtx.Unlock()
-	log.Printf("DumpScanGlobalVariables glovar_map=%#v\n", glovar_map)
-	for _, av := range glovar_map {
+	globmap := make(map[string]*ObjectMo, len(glovar_map))
+	for gname, av := range glovar_map {
 		if *av == nil {
 			continue
 		}
-		log.Printf("DumpScanGlobalVariables av=%v *av=%v\n", av, *av)
-		du.AddDumpedObject(*av)
+		globmap[gname] = *av
+	}
+	return globmap
+}
+
+func DumpScanGlobalVariables(du *DumperMo) {
+	log.Printf("DumpScanGlobalVariables start du=%v\n", du)
+	var gcnt int
+	// the objects of the global variables are remembered, and emitted
+	// even if the variables change during the dump
+	globmap := globalVariablesBindings()
+	log.Printf("DumpScanGlobalVariables globmap=%v\n", globmap)
+	du.duglobals = globmap
+	for gname, gpob := range globmap {
+		log.Printf("DumpScanGlobalVariables gname=%s gpob=%v\n", gname, gpob)
+		du.AddDumpedObject(gpob)
 		gcnt++
 	}
 	if gcnt == 0 {
@@ -1315,5 +2275,58 @@ func (pob *ObjectMo) UnsyncPayloadClear() *ObjectMo {
 	}
 	pob.obpayl = nil
 	(pl).DestroyPayl(pob)
+	pob.UnsyncTouch()
 	return pob
 } // end UnsyncPayloadClear
+
+func (pob *ObjectMo) UnsyncPayload() PayloadMo {
+	if pob == nil {
+		panic("UnsyncPayload nil pob")
+	}
+	return pob.obpayl
+}
+
+// put a new payload in pob, destroying the previous one
+func (pob *ObjectMo) UnsyncPutPayload(payl PayloadMo) *ObjectMo {
+	if pob == nil {
+		panic("UnsyncPutPayload nil pob")
+	}
+	oldpl := pob.obpayl
+	if oldpl == payl {
+		return pob
+	}
+	pob.obpayl = payl
+	if oldpl != nil {
+		(oldpl).DestroyPayl(pob)
+	}
+	pob.UnsyncTouch()
+	return pob
+} // end UnsyncPutPayload
+
+func (pob *ObjectMo) Payload() PayloadMo {
+	if pob == nil {
+		panic("Payload nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	return pob.obpayl
+}
+
+func (pob *ObjectMo) PutPayload(payl PayloadMo) *ObjectMo {
+	if pob == nil {
+		panic("PutPayload nil pob")
+	}
+	pob.obmtx.Lock()
+	defer pob.obmtx.Unlock()
+	oldpl := pob.obpayl
+	if oldpl == payl {
+		return pob
+	}
+	pob.UnsyncPutPayload(payl)
+	notifyChange(ChangeEventMo{Object: pob, Kind: ChgPayload, OldPayl: oldpl, NewPayl: payl})
+	return pob
+}
+
+func (pob *ObjectMo) PayloadClear() *ObjectMo {
+	return pob.PutPayload(nil)
+}
@@ -0,0 +1,243 @@
+// file objvalmo/params.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+//// the t_params table of each database records the format version of
+//// the dump, its producer, its time and some counts. Databases without
+//// any format_version were dumped before it existed, in format 1. When
+//// loading an older format, the registered migrations are applied in
+//// chain to every row of t_objects, before its content and payload
+//// are parsed.
+
+// the format of t_objects rows; should be incremented, with a
+// migration from the previous format, when the JSON layout changes.
+const DumpFormatVersion = 1
+
+const MonimeltVersion = "0.1"
+
+// names of the parameters in t_params
+const (
+	ParFormatVersion = "format_version"
+	ParProducer      = "producer"
+	ParDumpTime      = "dump_time"
+	ParNbObjects     = "nb_objects"
+	ParNbGlobals     = "nb_globals"
+	// followed by the space name, e.g. nb_objects_user
+	ParNbObjectsPrefix = "nb_objects_"
+)
+
+var space_names = [Spa_Last]string{
+	SpaTransient:  "transient",
+	SpaPredefined: "predefined",
+	SpaGlobal:     "global",
+	SpaUser:       "user",
+}
+
+// a row of t_objects, as given to migrations
+type ObjectRowMo struct {
+	Id       string
+	Mtime    int64
+	JsonCont string
+	PaylKind string
+	PaylCont string
+	Problem  string // found by the store reading the row, never written
+}
+
+// a migration updates in place a row of the global or user database
+type MigrationFunMo func(row *ObjectRowMo, globflag bool) error
+
+type migrationMo struct {
+	migfrom int
+	migto   int
+	migfun  MigrationFunMo
+}
+
+var migration_mtx sync.Mutex
+var migration_map map[int]migrationMo = make(map[int]migrationMo)
+
+// RegisterMigration registers fn to convert rows from format version
+// from to the later version to; at most one migration starts from a
+// given version.
+func RegisterMigration(from int, to int, fn MigrationFunMo) {
+	if fn == nil || from >= to || to > DumpFormatVersion {
+		panic(fmt.Errorf("RegisterMigration bad migration from %d to %d", from, to))
+	}
+	migration_mtx.Lock()
+	defer migration_mtx.Unlock()
+	if _, found := migration_map[from]; found {
+		panic(fmt.Errorf("RegisterMigration duplicate migration from %d", from))
+	}
+	migration_map[from] = migrationMo{migfrom: from, migto: to, migfun: fn}
+	log.Printf("RegisterMigration from %d to %d\n", from, to)
+} // end RegisterMigration
+
+// unregister the migration starting from version from, e.g. in tests
+func unregisterMigration(from int) {
+	migration_mtx.Lock()
+	defer migration_mtx.Unlock()
+	delete(migration_map, from)
+}
+
+// the chain of migrations from format version to the current one
+func migrationChain(version int) ([]migrationMo, error) {
+	migration_mtx.Lock()
+	defer migration_mtx.Unlock()
+	var chain []migrationMo
+	for v := version; v < DumpFormatVersion; {
+		mig, found := migration_map[v]
+		if !found {
+			return nil, fmt.Errorf("no migration from format %d", v)
+		}
+		chain = append(chain, mig)
+		v = mig.migto
+	}
+	return chain, nil
+} // end migrationChain
+
+// the format version of a database, 1 when unknown
+func paramsFormatVersion(params map[string]string) (int, error) {
+	verstr, found := params[ParFormatVersion]
+	if !found {
+		return 1, nil
+	}
+	return strconv.Atoi(verstr)
+}
+
+// write the t_params of a database, with the counts of its objects by
+// space and of its global variables
+func (du *DumperMo) emitParams(globflag bool, nbspaobj [Spa_Last]int, nbglobals int) {
+	params := map[string]string{
+		ParFormatVersion: strconv.Itoa(DumpFormatVersion),
+		ParProducer:      fmt.Sprintf("monimelt %s %s", MonimeltVersion, runtime.Version()),
+		ParDumpTime:      du.dutime.UTC().Format("2006-01-02T15:04:05Z"),
+		ParNbGlobals:     strconv.Itoa(nbglobals),
+	}
+	nbobj := 0
+	for sp := SpaPredefined; sp < Spa_Last; sp++ {
+		if (sp == SpaUser) == globflag {
+			continue
+		}
+		params[ParNbObjectsPrefix+space_names[sp]] = strconv.Itoa(nbspaobj[sp])
+		nbobj += nbspaobj[sp]
+	}
+	params[ParNbObjects] = strconv.Itoa(nbobj)
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := du.dustore.PutParam(globflag, name, params[name]); err != nil {
+			panic(fmt.Errorf("emitParams failed to insert %s - %v", name, err))
+		}
+	}
+	log.Printf("emitParams globflag=%t params=%v\n", globflag, params)
+} // end emitParams
+
+func (l *LoaderMo) params(globflag bool) map[string]string {
+	if globflag {
+		return l.ldglobparams
+	}
+	return l.lduserparams
+}
+
+// read and check the t_params of a database, and migrate its rows if
+// it has an older format
+func (l *LoaderMo) check_params(globflag bool) {
+	params, err := l.ldstore.Params(globflag)
+	if err != nil {
+		panic(fmt.Errorf("loader cannot read the parameters of %s database - %v", databaseName(globflag), err))
+	}
+	if globflag {
+		l.ldglobparams = params
+	} else {
+		l.lduserparams = params
+	}
+	log.Printf("check_params %s database format %q producer %q dumped %q\n",
+		databaseName(globflag), params[ParFormatVersion], params[ParProducer], params[ParDumpTime])
+	version, err := paramsFormatVersion(params)
+	if err != nil {
+		l.problem(globflag, "t_params", ParFormatVersion, "par_value", fmt.Sprintf("bad format version: %v", err))
+		return
+	}
+	if version > DumpFormatVersion {
+		l.problem(globflag, "t_params", ParFormatVersion, "par_value",
+			fmt.Sprintf("format %d is newer than the supported %d", version, DumpFormatVersion))
+		panic(fmt.Errorf("loader cannot load format %d of %s database", version, databaseName(globflag)))
+	}
+	if version < DumpFormatVersion {
+		chain, err := migrationChain(version)
+		if err != nil {
+			l.problem(globflag, "t_params", ParFormatVersion, "par_value", err.Error())
+			panic(fmt.Errorf("loader cannot migrate %s database - %v", databaseName(globflag), err))
+		}
+		l.migrate_objects(globflag, chain)
+	}
+} // end check_params
+
+// a count of the database should be the one recorded in t_params
+func (l *LoaderMo) check_count(globflag bool, parname string, count int) {
+	parstr, found := l.params(globflag)[parname]
+	if !found {
+		return
+	}
+	if parstr == strconv.Itoa(count) {
+		return
+	}
+	reason := fmt.Sprintf("recorded %s but found %d", parstr, count)
+	if l.ldreport == nil {
+		log.Printf("loader %s database %s %s\n", databaseName(globflag), parname, reason)
+		return
+	}
+	l.problem(globflag, "t_params", parname, "par_value", reason)
+} // end check_count
+
+// apply the chain of migrations to every row of t_objects; the
+// migrated rows are then used by the fill_* phases of the loader
+func (l *LoaderMo) migrate_objects(globflag bool, chain []migrationMo) {
+	migmap := make(map[string]*ObjectRowMo)
+	err := l.ldstore.ObjectRows(globflag, func(row *ObjectRowMo) {
+		idstr := row.Id
+		for _, mig := range chain {
+			if err := mig.migfun(row, globflag); err != nil {
+				l.problem(globflag, "t_objects", idstr, "ob_jsoncont",
+					fmt.Sprintf("migration from %d to %d failed: %v", mig.migfrom, mig.migto, err))
+				// the object stays empty
+				row = nil
+				break
+			}
+		}
+		migmap[idstr] = row
+	})
+	if err != nil {
+		panic(fmt.Errorf("loader: migrate_objects failure %v", err))
+	}
+	if globflag {
+		l.ldglobmigrated = migmap
+	} else {
+		l.ldusermigrated = migmap
+	}
+	log.Printf("migrate_objects %s database migrated %d rows by %d migrations\n",
+		databaseName(globflag), len(migmap), len(chain))
+} // end migrate_objects
+
+// the migrated row of idstr; found is false if the database was not migrated
+func (l *LoaderMo) migratedRow(globflag bool, idstr string) (row *ObjectRowMo, found bool) {
+	migmap := l.ldglobmigrated
+	if !globflag {
+		migmap = l.ldusermigrated
+	}
+	if migmap == nil {
+		return nil, false
+	}
+	return migmap[idstr], true
+}
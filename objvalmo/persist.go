@@ -4,17 +4,16 @@ package objvalmo  // import "github.com/bstarynk/monimelt/objvalmo"
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	gosqlite "github.com/mattn/go-sqlite3"
 	"log"
 	"os"
-	osexec "os/exec"
 	"regexp"
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"serialmo" // import "github.com/bstarynk/monimelt/serialmo"
 )
@@ -34,9 +33,18 @@ func initPersist() {
 }
 
 type LoaderMo struct {
-	ldglobaldb *sql.DB
-	lduserdb   *sql.DB
+	ldstore    StoreMo
 	ldobjmap   map[serialmo.IdentMo]*ObjectMo
+	ldinterner *ValueInternerMo // optional
+	ldreport   *LoadReportMo    // optional, for LoadFromDirectoryE
+	// the t_params of each database, and its migrated rows if it had an
+	// older format
+	ldglobparams   map[string]string
+	lduserparams   map[string]string
+	ldglobmigrated map[string]*ObjectRowMo
+	ldusermigrated map[string]*ObjectRowMo
+	ldnbworkers    int        // see SetWorkers
+	ldmtx          sync.Mutex // for ldreport, used by the workers
 }
 
 var validpath_regexp *regexp.Regexp
@@ -76,24 +84,23 @@ func OpenLoaderFromFiles(globalpath string, userpath string) *LoaderMo {
 				userpath, err))
 		}
 	}
-	l := new(LoaderMo)
-	db, err := sql.Open("sqlite3", "file:"+globalpath+"?mode=ro")
+	st, err := OpenSqliteStoreFiles(globalpath, userpath)
 	if err != nil {
-		panic(fmt.Errorf("OpenLoaderFromFiles failed to open global db %s - %v",
-			globalpath, err))
+		panic(fmt.Errorf("OpenLoaderFromFiles %v", err))
 	}
-	l.ldglobaldb = db
-	if len(userpath) > 0 {
-		db, err := sql.Open("sqlite3", "file:"+userpath+"?mode=ro")
-		if err != nil {
-			panic(fmt.Errorf("persistmo.OpenLoaderFromFiles failed to open user db %s - %v",
-				userpath, err))
-		}
-		l.lduserdb = db
+	return OpenLoaderFromStore(st)
+} /// end OpenLoaderFromFiles
+
+// the loader owns st, closed by its Close
+func OpenLoaderFromStore(st StoreMo) *LoaderMo {
+	if st == nil {
+		panic("OpenLoaderFromStore nil store")
 	}
+	l := new(LoaderMo)
+	l.ldstore = st
 	l.ldobjmap = make(map[serialmo.IdentMo]*ObjectMo)
 	return l
-} /// end OpenLoaderFromFiles
+} /// end OpenLoaderFromStore
 
 func (l *LoaderMo) ParseObjptr(oidstr string) (*ObjectMo, error) {
 	var pob *ObjectMo
@@ -106,7 +113,8 @@ func (l *LoaderMo) ParseObjptr(oidstr string) (*ObjectMo, error) {
 		return nil, err
 	}
 	pob, ok = l.ldobjmap[oid]
-	log.Printf("loader ParseObjptr oid=%v pob=%v (%T) ok=%t pob:%#v\n", oid, pob, pob, ok, pob)
+	// pob may be filled by another loading worker, so is not dumped with %#v
+	log.Printf("loader ParseObjptr oid=%v pob=%v (%T) ok=%t\n", oid, pob, pob, ok)
 	if !ok {
 		err = fmt.Errorf("loader ParseObjptr not found %q", oidstr)
 		return nil, err
@@ -114,34 +122,32 @@ func (l *LoaderMo) ParseObjptr(oidstr string) (*ObjectMo, error) {
 	return pob, nil
 } // end loader ParseObjptr
 
+// the loaded values would be interned by vi, if not nil
+func (l *LoaderMo) SetInterner(vi *ValueInternerMo) {
+	l.ldinterner = vi
+}
+
+func (l *LoaderMo) InternValue(v ValueMo) ValueMo {
+	if l.ldinterner == nil {
+		return v
+	}
+	return l.ldinterner.Intern(v)
+}
+
 func (l *LoaderMo) create_objects(globflag bool) {
 	var pob *ObjectMo
 	var cnt int
 	log.Printf("create_objects start globflag=%t\n", globflag)
 	defer log.Printf("create_objects end globflag=%t cnt=%d\n\n", globflag, cnt)
-	var qr *sql.Rows
-	var err error
-	const sql_selcreated = "SELECT ob_id FROM t_objects"
-	if globflag {
-		qr, err = l.ldglobaldb.Query(sql_selcreated)
-	} else {
-		qr, err = l.lduserdb.Query(sql_selcreated)
-	}
-	if err != nil {
-		panic(fmt.Errorf("loader: create_objects failure %v", err))
-	}
-	defer qr.Close()
-	for qr.Next() {
+	nbrows := 0
+	err := l.ldstore.ObjectIds(globflag, func(idstr string) {
 		pob = nil
-		var idstr string
-		err = qr.Scan(&idstr)
-		if err != nil {
-			panic(fmt.Errorf("persistmo.create_objects failure %v", err))
-		}
+		nbrows++
 		oid, err := serialmo.IdFromString(idstr)
 		log.Printf("create_objects idstr=%q oid=%#v\n", idstr, oid)
 		if err != nil {
-			panic(fmt.Errorf("persistmo.create_objects bad id %s: %v", idstr, err))
+			l.problem(globflag, "t_objects", idstr, "ob_id", fmt.Sprintf("bad id: %v", err))
+			return
 		}
 		pob = MakeObjectById(oid)
 		l.ldobjmap[oid] = pob
@@ -155,189 +161,243 @@ func (l *LoaderMo) create_objects(globflag bool) {
 		log.Printf("create_objects pob=%v /%T oid=%v\n", pob, pob, oid)
 		cnt++
 		pob = nil
-	}
-	err = qr.Err()
+	})
 	if err != nil {
-		panic(fmt.Errorf("persistmo.create_objects final %v", err))
+		panic(fmt.Errorf("persistmo.create_objects failure %v", err))
 	}
 	if cnt == 0 {
 		log.Printf("create_objects globflag=%t zero count\n", globflag)
 	}
+	l.check_count(globflag, ParNbObjects, nbrows)
 } // end create_objects
 
-func (l *LoaderMo) fill_content_objects(globflag bool) {
+func (l *LoaderMo) fill_content_objects(globflag bool, lp *loadPoolMo) {
 	var cntob int
 	log.Printf("fill_content_objects start globflag=%t\n", globflag)
 	defer log.Printf("fill_content_objects end globflag=%t cntob=%d\n", globflag, cntob)
-	var qr *sql.Rows
-	var err error
-	const sql_selfillcontent = `SELECT ob_id, ob_mtime, ob_jsoncont FROM t_objects`
-	if globflag {
-		qr, err = l.ldglobaldb.Query(sql_selfillcontent)
-	} else {
-		qr, err = l.lduserdb.Query(sql_selfillcontent)
-	}
-	if err != nil {
-		panic(fmt.Errorf("loader: fill_content_objects failure %v", err))
-	}
-	defer qr.Close()
-	for qr.Next() {
-		var idstr string
-		var mtim int64
-		var jcontstr string
-		err = qr.Scan(&idstr, &mtim, &jcontstr)
-		if err != nil {
-			panic(fmt.Errorf("persistmo.fill_content_objects failure %v", err))
-		}
+	err := l.ldstore.ObjectRows(globflag, func(row *ObjectRowMo) {
+		idstr, mtim, jcontstr := row.Id, row.Mtime, row.JsonCont
 		oid, err := serialmo.IdFromString(idstr)
 		if err != nil {
-			panic(fmt.Errorf("persistmo.fill_content_objects bad id %s: %v", idstr, err))
+			// already reported by create_objects
+			return
 		}
 		pob := l.ldobjmap[oid]
 		if pob == nil {
 			panic(fmt.Errorf("persistmo.fill_content_objects unknown id %s: %v", idstr, err))
 		}
-		cntob++
-		pob.UnsyncPutMtime(mtim)
-		var jcont jsonObContent
-		if err := json.Unmarshal(([]byte)(jcontstr), &jcont); err != nil {
-			panic(fmt.Errorf("persistmo.fill_content_objects bad content for id %s: %v", idstr, err))
-		}
-		log.Printf("@@@fill_content_objects pob=%v mtim=%v jcont=%#v %T\n\n", pob, mtim, jcont, jcont)
-		nbat := len(jcont.Jattrs)
-		if pob.obattrs == nil && nbat > 0 {
-			pob.obattrs = make(map[*ObjectMo]ValueMo, (nbat+1)|7)
-		}
-		for atix := 0; atix < nbat; atix++ {
-			curatid := jcont.Jattrs[atix].Jat
-			curjval := jcont.Jattrs[atix].Jva
-			log.Printf("fill_content_objects atix=%d curatid=%v curjval=%v (%T)\n",
-				atix, curatid, curjval, curjval)
-			pobat, err := l.ParseObjptr(curatid)
-			log.Printf("fill_content_objects atix=%d pobat=%v (%T) err=%v curjval=%v (%T)\n",
-				atix, pobat, pobat, err, curjval, curjval)
-			atval, err := JasonParseVal(l, curjval)
-			log.Printf("fill_content_objects pob %v atix=%d pobat=%v atval=%v (%T) err=%v curjval=%v (%T)\n",
-				pob, atix, pobat, atval, atval, err, curjval, curjval)
-			if err == nil {
-				pob.UnsyncPutAttr(pobat, atval)
-			}
+		if row.Problem != "" {
+			l.problem(globflag, "t_objects", idstr, "ob_id", row.Problem)
 		}
-		log.Printf("@@@fill_content_objects pob=%v obattrs=%v (%T)\n", pob, pob.obattrs, pob.obattrs)
-		// do something with jcont
-		nbcomps := len(jcont.Jcomps)
-		if pob.obcomps == nil && nbcomps > 0 {
-			pob.obcomps = make([]ValueMo, 0, (nbcomps+1)|3)
-		}
-		for cix, jcurcomp := range jcont.Jcomps {
-			log.Printf("fill_content_objects pob=%v cix=%d jcurcomp=%v %T\n",
-				pob, cix, jcurcomp, jcurcomp)
-			compval, err := JasonParseVal(l, jcurcomp)
-			log.Printf("fill_content_objects pob=%v cix=%d compval=%v %T err=%v\n",
-				pob, cix, compval, compval, err)
-			if err == nil {
-				pob.UnsyncAppendVal(compval)
+		if mrow, migrated := l.migratedRow(globflag, idstr); migrated {
+			if mrow == nil {
+				// its migration failed
+				return
 			}
+			mtim, jcontstr = mrow.Mtime, mrow.JsonCont
 		}
-		log.Printf("@@@fill_content_objects pob=%v obcomps=%v (%T)\n", pob, pob.obcomps, pob.obcomps)
-		///
-		log.Printf("fill_content_objects pob=%v (%T) done cntob#%d: %#v\n\n", pob, pob, cntob, pob)
-	}
-	if err = qr.Err(); err != nil {
-		panic(fmt.Errorf("persistmo.fill_content_objects err %v", err))
+		cntob++
+		lp.dispatch(pob, func() {
+			l.fill_content_row(globflag, pob, idstr, mtim, jcontstr)
+		})
+	})
+	if err != nil {
+		panic(fmt.Errorf("persistmo.fill_content_objects failure %v", err))
 	}
 } // end fill_content_objects
 
-func (l *LoaderMo) fill_payload_objects(globflag bool) {
+// fill the content of pob, which is not shared with other workers
+func (l *LoaderMo) fill_content_row(globflag bool, pob *ObjectMo, idstr string, mtim int64, jcontstr string) {
+	var jcont jsonObContent
+	if err := json.Unmarshal(([]byte)(jcontstr), &jcont); err != nil {
+		l.problem(globflag, "t_objects", idstr, "ob_jsoncont", fmt.Sprintf("bad JSON content: %v", err))
+		pob.UnsyncPutMtime(mtim)
+		return
+	}
+	log.Printf("@@@fill_content_objects pob=%v mtim=%v jcont=%#v %T\n\n", pob, mtim, jcont, jcont)
+	if jcont.Jclass != "" {
+		pobcla, err := l.ParseObjptr(jcont.Jclass)
+		log.Printf("fill_content_objects pob=%v class %s pobcla=%v err=%v\n",
+			pob, jcont.Jclass, pobcla, err)
+		if err == nil && pobcla != nil && pobcla != pob {
+			pob.UnsyncSetClass(pobcla)
+		} else {
+			l.valueProblem(globflag, idstr, "ob_jsoncont",
+				fmt.Sprintf("bad class %s: %v", jcont.Jclass, err))
+		}
+	}
+	nbat := len(jcont.Jattrs)
+	if pob.obattrs == nil && nbat > 0 {
+		pob.obattrs = make(map[*ObjectMo]ValueMo, (nbat+1)|7)
+	}
+	for atix := 0; atix < nbat; atix++ {
+		curatid := jcont.Jattrs[atix].Jat
+		curjval := jcont.Jattrs[atix].Jva
+		log.Printf("fill_content_objects atix=%d curatid=%v curjval=%v (%T)\n",
+			atix, curatid, curjval, curjval)
+		pobat, err := l.ParseObjptr(curatid)
+		log.Printf("fill_content_objects atix=%d pobat=%v (%T) err=%v curjval=%v (%T)\n",
+			atix, pobat, pobat, err, curjval, curjval)
+		if err != nil || pobat == nil {
+			l.valueProblem(globflag, idstr, "ob_jsoncont",
+				fmt.Sprintf("bad attribute#%d %s: %v", atix, curatid, err))
+			continue
+		}
+		if curjval == nil {
+			// a null value, written by older dumps for non-dumped objects
+			continue
+		}
+		atval, err := JasonParseVal(l, curjval)
+		log.Printf("fill_content_objects pob %v atix=%d pobat=%v atval=%v (%T) err=%v curjval=%v (%T)\n",
+			pob, atix, pobat, atval, atval, err, curjval, curjval)
+		if err != nil || atval == nil {
+			l.valueProblem(globflag, idstr, "ob_jsoncont",
+				fmt.Sprintf("bad value of attribute %s: %v", curatid, err))
+			continue
+		}
+		pob.UnsyncPutAttr(pobat, atval)
+	}
+	log.Printf("@@@fill_content_objects pob=%v obattrs=%v (%T)\n", pob, pob.obattrs, pob.obattrs)
+	// do something with jcont
+	nbcomps := len(jcont.Jcomps)
+	if pob.obcomps == nil && nbcomps > 0 {
+		pob.obcomps = make([]ValueMo, 0, (nbcomps+1)|3)
+	}
+	for cix, jcurcomp := range jcont.Jcomps {
+		log.Printf("fill_content_objects pob=%v cix=%d jcurcomp=%v %T\n",
+			pob, cix, jcurcomp, jcurcomp)
+		compval, err := JasonParseVal(l, jcurcomp)
+		log.Printf("fill_content_objects pob=%v cix=%d compval=%v %T err=%v\n",
+			pob, cix, compval, compval, err)
+		if err != nil {
+			// keep the rank of the next components; a nil component
+			// is dumped again as null
+			l.valueProblem(globflag, idstr, "ob_jsoncont",
+				fmt.Sprintf("bad component#%d, replaced by nil: %v", cix, err))
+			compval = nil
+		}
+		pob.UnsyncAppendVal(compval)
+	}
+	log.Printf("@@@fill_content_objects pob=%v obcomps=%v (%T)\n", pob, pob.obcomps, pob.obcomps)
+	// after filling, since putting attributes or components touches pob
+	pob.UnsyncPutMtime(mtim)
+	///
+	log.Printf("fill_content_objects pob=%v (%T) done: %#v\n\n", pob, pob, pob)
+} // end fill_content_row
+
+func (l *LoaderMo) fill_payload_objects(globflag bool, lp *loadPoolMo) {
 	var cnt int
 	log.Printf("fill_payload_objects start globflag=%t\n", globflag)
 	defer log.Printf("fill_payload_objects end globflag=%t cnt=%d\n", globflag, cnt)
-	var qr *sql.Rows
-	var err error
-	const sql_selfillcontent = `SELECT ob_id, ob_paylkind, ob_paylcont 
-FROM t_objects WHERE ob_paylkind != ""`
-	if globflag {
-		qr, err = l.ldglobaldb.Query(sql_selfillcontent)
-	} else {
-		qr, err = l.lduserdb.Query(sql_selfillcontent)
-	}
-	if err != nil {
-		panic(fmt.Errorf("loader: fill_payload_objects failure %v", err))
-	}
-	defer qr.Close()
-	for qr.Next() {
-		var idstr string
-		var paylkind string
-		var jpaylstr string
-		var jpayl interface{}
-		err = qr.Scan(&idstr, &paylkind, &jpaylstr)
-		if err != nil {
-			panic(fmt.Errorf("persistmo.fill_payload_objects failure %v", err))
+	// a migration may give a payload to objects without one
+	_, migrated := l.migratedRow(globflag, "")
+	err := l.ldstore.ObjectRows(globflag, func(row *ObjectRowMo) {
+		if row.PaylKind == "" && !migrated {
+			return
 		}
+		idstr, paylkind, jpaylstr := row.Id, row.PaylKind, row.PaylCont
 		oid, err := serialmo.IdFromString(idstr)
 		if err != nil {
-			panic(fmt.Errorf("persistmo.fill_payload_objects bad id %s: %v", idstr, err))
+			// already reported by create_objects
+			return
 		}
 		pob := l.ldobjmap[oid]
 		if pob == nil {
 			panic(fmt.Errorf("persistmo.fill_payload_objects unknown id %s: %v", idstr, err))
 		}
-		pl, err := PayloadLoader(paylkind)
-		if pl == nil || err != nil {
-			panic(fmt.Errorf("persistmo.fill_payload_objects pob %v bad paylkind %q - %s",
-				pob, paylkind, err))
-		}
-		if jpaylstr != "" {
-			if err := json.Unmarshal(([]byte)(jpaylstr), &jpayl); err != nil {
-				panic(fmt.Errorf("persistmo.fill_payload_objects id %s bad jpaylstr %s: %v", idstr, jpaylstr, err))
+		if mrow, migrated := l.migratedRow(globflag, idstr); migrated {
+			if mrow == nil || mrow.PaylKind == "" {
+				return
 			}
+			paylkind, jpaylstr = mrow.PaylKind, mrow.PaylCont
 		}
-		payl := pl(paylkind, pob, l, jpayl)
-		pob.obpayl = payl
 		cnt++
+		lp.dispatch(pob, func() {
+			l.fill_payload_row(globflag, pob, idstr, paylkind, jpaylstr)
+		})
+	})
+	if err != nil {
+		panic(fmt.Errorf("persistmo.fill_payload_objects failure %v", err))
 	}
 } // end fill_payload_objects
 
+// fill the payload of pob, which is not shared with other workers
+func (l *LoaderMo) fill_payload_row(globflag bool, pob *ObjectMo, idstr string, paylkind string, jpaylstr string) {
+	var jpayl interface{}
+	pl, err := PayloadLoader(paylkind)
+	if pl == nil || err != nil {
+		l.problem(globflag, "t_objects", idstr, "ob_paylkind",
+			fmt.Sprintf("bad payload kind %q: %v", paylkind, err))
+		return
+	}
+	if jpaylstr != "" {
+		if err := json.Unmarshal(([]byte)(jpaylstr), &jpayl); err != nil {
+			l.problem(globflag, "t_objects", idstr, "ob_paylcont",
+				fmt.Sprintf("bad JSON payload: %v", err))
+			return
+		}
+	}
+	payl := l.loadPayload(pl, paylkind, pob, jpayl)
+	if payl == nil {
+		return
+	}
+	pob.obpayl = payl
+} // end fill_payload_row
+
+// a payload loader may panic on bad content, which is then a problem
+func (l *LoaderMo) loadPayload(pl PayloadLoaderMo, paylkind string, pob *ObjectMo, jpayl interface{}) (payl PayloadMo) {
+	if l.ldreport == nil {
+		return pl(paylkind, pob, l, jpayl)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if _, isabort := r.(loadAbortMo); isabort {
+				panic(r)
+			}
+			payl = nil
+			l.problem(pob.obspace != SpaUser, "t_objects", pob.ToString(), "ob_paylcont",
+				fmt.Sprintf("failed to load %s payload: %v", paylkind, r))
+		}
+	}()
+	return pl(paylkind, pob, l, jpayl)
+} // end loadPayload
+
 func (l *LoaderMo) bind_globals(globflag bool) {
 	var cnt int
 	log.Printf("bind_globals start globflag=%t\n", globflag)
 	defer log.Printf("bind_globals end globflag=%t cnt=%d\n\n", globflag, cnt)
-	var qr *sql.Rows
-	var err error
-	const sql_selglobals = `SELECT glob_name, glob_oid FROM t_globals WHERE glob_oid!=""`
-	if globflag {
-		qr, err = l.ldglobaldb.Query(sql_selglobals)
-	} else {
-		qr, err = l.lduserdb.Query(sql_selglobals)
-	}
-	if err != nil {
-		panic(fmt.Errorf("loader: bind_globals failure %v", err))
-	}
-	defer qr.Close()
-	for qr.Next() {
-		var globname string
-		var globidstr string
-		err = qr.Scan(&globname, &globidstr)
-		if err != nil {
-			panic(fmt.Errorf("persistmo.bind_globals failure %v", err))
-		}
+	nbrows := 0
+	err := l.ldstore.GlobalRows(globflag, func(globname string, globidstr string) {
+		nbrows++
 		log.Printf("bind_globals globflag=%t globname=%q globidstr=%q\n", globflag, globname, globidstr)
 		gloid, err := serialmo.IdFromString(globidstr)
 		if err != nil {
-			panic(fmt.Errorf("persistmo.bind_globals bad id %s: %v", globidstr, err))
+			l.problem(globflag, "t_globals", globname, "glob_oid",
+				fmt.Sprintf("bad id %s: %v", globidstr, err))
+			return
 		}
 		glpob := l.ldobjmap[gloid]
 		if glpob == nil {
-			panic(fmt.Errorf("persistmo.bind_globals unknown id %s: %v", globidstr, err))
+			l.problem(globflag, "t_globals", globname, "glob_oid",
+				fmt.Sprintf("unknown object %s", globidstr))
+			return
 		}
 		pglovar := GlobalVariableAddress(globname)
 		if pglovar == nil {
-			panic(fmt.Errorf("persistmo.bind_globals unknown global %s", globname))
+			l.problem(globflag, "t_globals", globname, "glob_name", "unknown global variable")
+			return
 		}
 		log.Printf("bind_globals globflag=%t globname=%q glpob=%v\n", globflag, globname, glpob)
 		*pglovar = glpob
 		cnt++
+		if l.ldreport != nil {
+			l.ldreport.NbGlobals++
+		}
+	})
+	if err != nil {
+		panic(fmt.Errorf("persistmo.bind_globals failure %v", err))
 	}
+	l.check_count(globflag, ParNbGlobals, nbrows)
 } // end bind_globals
 
 func (ld *LoaderMo) Load() {
@@ -351,26 +411,48 @@ func (ld *LoaderMo) Load() {
 	if ld == nil {
 		return
 	}
+	hasuser := ld.ldstore.HasUser()
+	ld.check_params(GlobalObjects)
+	if hasuser {
+		ld.check_params(UserObjects)
+	}
 	ld.create_objects(GlobalObjects)
-	if ld.lduserdb != nil {
+	if hasuser {
 		ld.create_objects(UserObjects)
 	}
 	log.Printf("Load after create_objects ld=%v\n", ld)
-	ld.fill_content_objects(GlobalObjects)
-	if ld.lduserdb != nil {
-		ld.fill_content_objects(UserObjects)
-	}
+	// every phase waits for its workers before the next one
+	ld.runFillPhase(func(lp *loadPoolMo) {
+		ld.fill_content_objects(GlobalObjects, lp)
+		if hasuser {
+			ld.fill_content_objects(UserObjects, lp)
+		}
+	})
 	log.Printf("Load after fill_content_objects ld=%v\n", ld)
-	ld.fill_payload_objects(GlobalObjects)
-	if ld.lduserdb != nil {
-		ld.fill_payload_objects(UserObjects)
-	}
+	ld.runFillPhase(func(lp *loadPoolMo) {
+		ld.fill_payload_objects(GlobalObjects, lp)
+		if hasuser {
+			ld.fill_payload_objects(UserObjects, lp)
+		}
+	})
 	log.Printf("Load after fill_payload_objects ld=%v\n", ld)
 	ld.bind_globals(GlobalObjects)
-	if ld.lduserdb != nil {
+	if hasuser {
 		ld.bind_globals(UserObjects)
 	}
 	log.Printf("Load after bind_globals ld=%#v\n", ld)
+	if ld.ldinterner != nil {
+		ld.ldinterner.LogStats("Load")
+	}
+	// the loaded objects are not changed since their dump
+	for _, pob := range ld.ldobjmap {
+		UnmarkDirtyObjects(pob)
+	}
+	if ld.ldreport != nil {
+		ld.ldreport.NbObjects = len(ld.ldobjmap)
+	}
+	ld.ldglobmigrated = nil
+	ld.ldusermigrated = nil
 } // end Load
 
 func (ld *LoaderMo) Close() {
@@ -383,19 +465,27 @@ func (ld *LoaderMo) Close() {
 	if ld == nil {
 		return
 	}
-	if ud := ld.lduserdb; ud != nil {
-		ld.lduserdb = nil
-		ud.Close()
-	}
-	if gd := ld.ldglobaldb; gd != nil {
-		ld.ldglobaldb = nil
-		gd.Close()
+	if st := ld.ldstore; st != nil {
+		ld.ldstore = nil
+		if err := st.Close(); err != nil {
+			log.Printf("loader Close failed to close %v - %v\n", st, err)
+		}
 	}
 	/// clear the object map
 	ld.ldobjmap = nil
 } // end Close
 
 func LoadFromDirectory(dirname string) {
+	LoadFromDirectoryInterning(dirname, nil)
+} // end LoadFromDirectory
+
+// load, interning the loaded values with vi if it is not nil
+func LoadFromDirectoryInterning(dirname string, vi *ValueInternerMo) {
+	loadDirectory(dirname, vi, 0, nil)
+} // end LoadFromDirectoryInterning
+
+// without a report rep, any problem panics
+func loadDirectory(dirname string, vi *ValueInternerMo, nbworkers int, rep *LoadReportMo) {
 	defer log.Printf("LoadFromDirectory %s end *****\n\n", dirname)
 	{
 		var stabuf [2048]byte
@@ -440,11 +530,22 @@ func LoadFromDirectory(dirname string) {
 			}
 		}
 	}
-	ld := OpenLoaderFromFiles(glodbpath, usrdbpath)
+	runLoader(OpenLoaderFromFiles(glodbpath, usrdbpath), vi, nbworkers, rep)
+	log.Printf("done LoadFromDirectory %s\n", dirname)
+} // end loadDirectory
+
+// LoadFromStore loads the objects of st, like LoadFromDirectory
+func LoadFromStore(st StoreMo) {
+	runLoader(OpenLoaderFromStore(st), nil, 0, nil)
+} // end LoadFromStore
+
+func runLoader(ld *LoaderMo, vi *ValueInternerMo, nbworkers int, rep *LoadReportMo) {
 	defer ld.Close()
+	ld.SetInterner(vi)
+	ld.ldreport = rep
+	ld.SetWorkers(nbworkers)
 	ld.Load()
-	log.Printf("done LoadFromDirectory %s\n", dirname)
-} // end LoadFromDirectory
+} // end runLoader
 
 ////////////////////////////////////////////////////////////////
 const dump_chunk_len = 7
@@ -463,66 +564,23 @@ const (
 type DumperMo struct {
 	dutime       time.Time
 	dumode       uint
-	dudirname    string
-	dutempsuffix string
-	duglobaldb   *sql.DB
-	duuserdb     *sql.DB
-	dustobuser   *sql.Stmt
-	dustobglob   *sql.Stmt
+	dustore      StoreMo
 	dufirstchk   *dumpChunk
 	dulastchk    *dumpChunk
 	dusetobjects map[*ObjectMo]uint8
+	dusnapshots  map[*ObjectMo]*dumpSnapshotMo // taken by the scan
+	duglobals    map[string]*ObjectMo          // the global variables at scan
+	// for incremental dumps only
+	duincremental bool
+	dudirtyset    map[*ObjectMo]struct{}
+	duoldglobids  map[string]int64          // previous ids and mtimes in global db
+	duolduserids  map[string]int64          // previous ids and mtimes in user db
+	duscanned     *ObjectMo                 // the object being scanned
+	dureferees    map[*ObjectMo][]*ObjectMo // the objects met while scanning each one
+	dunbupserted  int
+	dunbdeleted   int
 }
 
-const sql_create_t_params = `CREATE TABLE IF NOT EXISTS t_params 
- (par_name VARCHAR(35) PRIMARY KEY ASC NOT NULL UNIQUE, 
-  par_value TEXT NOT NULL);`
-
-const sql_create_t_objects = `CREATE TABLE IF NOT EXISTS t_objects
- (ob_id VARCHAR(26) PRIMARY KEY ASC NOT NULL UNIQUE,
-  ob_mtime INT NOT NULL,
-  ob_jsoncont TEXT NOT NULL,
-  ob_paylkind VARCHAR(40) NOT NULL,
-  ob_paylcont TEXT NOT NULL);`
-
-const sql_create_t_globals = `CREATE TABLE IF NOT EXISTS t_globals
- (glob_name VARCHAR(80) PRIMARY KEY ASC NOT NULL UNIQUE,
-  glob_oid VARCHAR(26)  NOT NULL);`
-
-const sql_insert_t_objects = `INSERT INTO t_objects VALUES (?, ?, ?, ?, ?);`
-
-const sql_insert_t_globals = `INSERT INTO t_globals VALUES (?, ?)`
-
-func (du DumperMo) create_tables(globflag bool) {
-	var db *sql.DB
-	log.Printf("create_table globflag=%v dir=%s\n", globflag, du.dudirname)
-	if globflag {
-		db = du.duglobaldb
-	} else {
-		db = du.duuserdb
-	}
-	if db == nil {
-		panic(fmt.Errorf("create_tables no db in directory %s", du.dudirname))
-	}
-	log.Printf("create_table db=%v sql_create_t_params=%q\n", db, sql_create_t_params)
-	rcparam, err := db.Exec(sql_create_t_params)
-	log.Printf("create_table rcparam=%v err=%v\n", rcparam, err)
-	if err != nil {
-		panic(fmt.Errorf("create_tables failure in directory %s for t_params creation %v",
-			du.dudirname, err))
-	}
-	_, err = db.Exec(sql_create_t_objects)
-	if err != nil {
-		panic(fmt.Errorf("create_tables failure in directory %s for t_objects creation %v",
-			du.dudirname, err))
-	}
-	_, err = db.Exec(sql_create_t_globals)
-	if err != nil {
-		panic(fmt.Errorf("create_tables failure in directory %s for t_globals creation %v",
-			du.dudirname, err))
-	}
-} // end create_tables
-
 func (du *DumperMo) AddDumpedObject(pob *ObjectMo) {
 	log.Printf("AddDumpedObject start pob=%v\n", pob)
 	defer log.Printf("AddDumpedObject end pob=%v\n", pob)
@@ -532,7 +590,11 @@ func (du *DumperMo) AddDumpedObject(pob *ObjectMo) {
 	if pob == nil {
 		return
 	}
-	spo := pob.UnsyncSpaceNum() /// should be unsync
+	if du.duincremental && du.duscanned != nil {
+		// even a transient pob, which could become persistent later
+		du.dureferees[du.duscanned] = append(du.dureferees[du.duscanned], pob)
+	}
+	spo := pob.SpaceNum()
 	if spo == SpaTransient {
 		return
 	}
@@ -569,7 +631,8 @@ func (du *DumperMo) AddDumpedObject(pob *ObjectMo) {
 	log.Printf("AddDumpedObject pob=%v nchk=%#v", pob, nchk)
 } // end AddDumpedObject
 
-func OpenDumperDirectory(dirpath string) *DumperMo {
+// check dirpath for a dump, making it if needed
+func prepareDumpDirectory(dirpath string) string {
 	if !validpath(dirpath) {
 		panic(fmt.Errorf("OpenDumperDirectory invalid dirpath %q", dirpath))
 	}
@@ -589,42 +652,46 @@ func OpenDumperDirectory(dirpath string) *DumperMo {
 	} else if !di.Mode().IsDir() {
 		panic(fmt.Errorf("OpenDumperDirectory dirpath %s is not a directory", dirpath))
 	}
-	dtempsuf := fmt.Sprintf("+%s_p%d.tmp", serialmo.RandomSerial().ToString(), os.Getpid())
-	log.Printf("OpenDumperDirectory dirpath=%s dtempsuf=%s\n", dirpath, dtempsuf)
-	globtemppath := fmt.Sprintf("%s/%s.sqlite%s", dirpath, DefaultGlobalDbname, dtempsuf)
-	usertemppath := fmt.Sprintf("%s/%s.sqlite%s", dirpath, DefaultUserDbname, dtempsuf)
-	glodb, err := sql.Open("sqlite3", "file:"+globtemppath+"?mode=rwc&cache=private")
-	if err != nil {
-		panic(fmt.Errorf("OpenDumperDirectory failed to open global db %s - %v", globtemppath, err))
-	}
-	usrdb, err := sql.Open("sqlite3", "file:"+usertemppath+"?mode=rwc&cache=private")
-	if err != nil {
-		glodb.Close()
-		os.Remove(globtemppath)
-		panic(fmt.Errorf("OpenDumperDirectory failed to open user db %s - %v", usertemppath, err))
+	return dirpath
+} // end prepareDumpDirectory
+
+func OpenDumperDirectory(dirpath string) *DumperMo {
+	return OpenDumper(NewSqliteStore(prepareDumpDirectory(dirpath)), false, nil)
+} // end OpenDumperDirectory
+
+// open a dumper writing into st; an incremental one updates the
+// previous dump of st, where dirtyobjs are the objects modified since
+func OpenDumper(st StoreMo, incremental bool, dirtyobjs []*ObjectMo) *DumperMo {
+	if st == nil {
+		panic("OpenDumper nil store")
 	}
 	du := new(DumperMo)
 	du.dutime = time.Now()
-	du.dudirname = dirpath
-	du.dutempsuffix = dtempsuf
-	du.duglobaldb = glodb
-	du.duuserdb = usrdb
+	du.dustore = st
 	du.dusetobjects = make(map[*ObjectMo]uint8)
-	du.create_tables(GlobalObjects)
-	du.create_tables(UserObjects)
-	du.dustobglob, err = glodb.Prepare(sql_insert_t_objects)
-	if err != nil {
-		// this should never happen
-		panic(fmt.Errorf("OpenDumperDirectory failed to prepare global %s t_object insertion - %v", globtemppath, err))
-	}
-	du.dustobuser, err = usrdb.Prepare(sql_insert_t_objects)
-	if err != nil {
-		// this should never happen
-		panic(fmt.Errorf("OpenDumperDirectory failed to prepare global %s t_object insertion - %v", usertemppath, err))
+	du.dusnapshots = make(map[*ObjectMo]*dumpSnapshotMo)
+	if err := st.BeginDump(incremental, du.dutime); err != nil {
+		panic(fmt.Errorf("OpenDumper failed to begin dump in %v - %v", st, err))
+	}
+	if incremental {
+		du.duincremental = true
+		du.dudirtyset = make(map[*ObjectMo]struct{}, len(dirtyobjs))
+		du.dureferees = make(map[*ObjectMo][]*ObjectMo)
+		for _, pob := range dirtyobjs {
+			du.dudirtyset[pob] = struct{}{}
+		}
+		var err error
+		if du.duoldglobids, err = st.ObjectMtimes(GlobalObjects); err == nil {
+			du.duolduserids, err = st.ObjectMtimes(UserObjects)
+		}
+		if err != nil {
+			du.abort()
+			panic(fmt.Errorf("OpenDumper failed to read the previous objects of %v - %v", st, err))
+		}
 	}
-	log.Printf("OpenDumperDirectory result du=%#v\n", du)
+	log.Printf("OpenDumper result du=%#v\n", du)
 	return du
-} // end OpenDumperDirectory
+} // end OpenDumper
 
 func (du *DumperMo) StartDumpScan() {
 	log.Printf("StartDumpScan begin du=%#v\n", du)
@@ -649,16 +716,14 @@ func (du *DumperMo) LoopDumpScan() {
 	if du == nil || du.dumode != dumod_Scan {
 		panic("LoopDumpScan on non-scanning dumper")
 	}
-	var chk *dumpChunk
-	var nchk *dumpChunk
-	for chk = du.dufirstchk; chk != nil; chk = nchk {
+	// scanning objects may add new chunks, even after the last one, so
+	// the next chunk is fetched from du after the current one is scanned
+	for du.dufirstchk != nil {
+		chk := du.dufirstchk
 		log.Printf("LoopDumpScan chk=%#v\n", chk)
-		nchk = chk.dchnext
+		du.dufirstchk = chk.dchnext
 		if chk == du.dulastchk {
-			du.dufirstchk = nil
 			du.dulastchk = nil
-		} else {
-			du.dufirstchk = nchk
 		}
 		chk.dchnext = nil
 		for vix := 0; vix < dump_chunk_len; vix++ {
@@ -666,7 +731,9 @@ func (du *DumperMo) LoopDumpScan() {
 			chk.dchobjects[vix] = nil
 			if curpob != nil {
 				log.Printf("LoopDumpScan vix=%d curpob=%v\n", vix, curpob)
+				du.duscanned = curpob
 				curpob.DumpScanInsideObject(du)
+				du.duscanned = nil
 			}
 		}
 	}
@@ -678,6 +745,7 @@ type jsonAttrEntry struct {
 }
 
 type jsonObContent struct {
+	Jclass string          `json:"class,omitempty"`
 	Jattrs []jsonAttrEntry `json:"attrs"`
 	Jcomps []interface{}   `json:"comps"`
 }
@@ -695,15 +763,14 @@ func (du *DumperMo) emitDumpedObject(pob *ObjectMo, spa uint8) {
 		panic("emitDumpedObject bad spa")
 	}
 	pobidstr := pob.ToString()
-	pob.obmtx.Lock()
-	defer pob.obmtx.Unlock()
+	snap := du.scannedSnapshot(pob)
 	/// dump the attributes
-	nbat := len(pob.obattrs)
+	nbat := len(snap.snattrs)
 	log.Printf("emitDumpedObject pob=%v nbat=%d\n", pob, nbat)
 	/// collect the dumpable attributes
 	var attrvec []*ObjectMo
 	attrvec = make([]*ObjectMo, 0, nbat+1)
-	for atob, atva := range pob.obattrs {
+	for atob, atva := range snap.snattrs {
 		if atva == nil {
 			continue
 		}
@@ -722,20 +789,25 @@ func (du *DumperMo) emitDumpedObject(pob *ObjectMo, spa uint8) {
 	var jattrs []jsonAttrEntry
 	jattrs = make([]jsonAttrEntry, 0, nbdumpat)
 	for _, atob := range attrvec {
-		atva := pob.obattrs[atob]
+		atva := snap.snattrs[atob]
 		log.Printf("emitDumpedObject pob=%v atob=%v atva=%v\n", pob, atob, atva)
-		jpair := jsonAttrEntry{Jat: atob.ToString(), Jva: ValToJson(du, atva)}
+		jva := ValToJson(du, atva)
+		if jva == nil {
+			// e.g. a reference to a transient object, not dumped
+			continue
+		}
+		jpair := jsonAttrEntry{Jat: atob.ToString(), Jva: jva}
 		log.Printf("emitDumpedObject pob=%v atob=%v atva=%v jpair=%v\n",
 			pob, atob, atva, jpair)
 		jattrs = append(jattrs, jpair)
 	}
 	log.Printf("emitDumpedObject pob=%v jattrs=%v\n\n", pob, jattrs)
 	/// dump the components
-	nbcomp := len(pob.obcomps)
+	nbcomp := len(snap.sncomps)
 	log.Printf("emitDumpedObject pob=%v nbcomp=%d\n", pob, nbcomp)
 	var jcomps []interface{}
 	jcomps = make([]interface{}, 0, nbcomp)
-	for cix, cva := range pob.obcomps {
+	for cix, cva := range snap.sncomps {
 		jva := ValToJson(du, cva)
 		log.Printf("emitDumpedObject pob=%v cix=%d cva=%v jva=%v\n",
 			pob, cix, cva, jva)
@@ -744,6 +816,9 @@ func (du *DumperMo) emitDumpedObject(pob *ObjectMo, spa uint8) {
 	log.Printf("emitDumpedObject pob=%v jcomps=%v\n\n", pob, jcomps)
 	/// construct and encode the content
 	jcontent := jsonObContent{Jattrs: jattrs, Jcomps: jcomps}
+	if snap.snclass != nil && du.EmitObjptr(snap.snclass) {
+		jcontent.Jclass = snap.snclass.ToString()
+	}
 	log.Printf("emitDumpedObject pob=%v jcontent=%v\n", pob, jcontent)
 	var contbuf bytes.Buffer
 	contenc := json.NewEncoder(&contbuf)
@@ -755,8 +830,15 @@ func (du *DumperMo) emitDumpedObject(pob *ObjectMo, spa uint8) {
 	/// encode the payload
 	var paylkindstr string
 	var jpayljson interface{}
-	if pob.obpayl != nil {
-		paylkindstr, jpayljson = (pob.obpayl).DumpEmitPayl(pob, du)
+	if snap.snpayl != nil {
+		if !snap.snpaylcp {
+			// a live payload is emitted in its current state
+			pob.obmtx.Lock()
+			paylkindstr, jpayljson = (snap.snpayl).DumpEmitPayl(pob, du)
+			pob.obmtx.Unlock()
+		} else {
+			paylkindstr, jpayljson = (snap.snpayl).DumpEmitPayl(pob, du)
+		}
 	}
 	var paylbuf bytes.Buffer
 	if len(paylkindstr) > 0 {
@@ -767,18 +849,12 @@ func (du *DumperMo) emitDumpedObject(pob *ObjectMo, spa uint8) {
 		//paylbuf.WriteByte('\n')
 	}
 	/// should now insert in the appropriate database
-	var stmt *sql.Stmt
-	if spa == SpaUser {
-		stmt = du.dustobuser
-	} else {
-		stmt = du.dustobglob
-	}
-	var err error
-	_, err = stmt.Exec(pobidstr,
-		fmt.Sprintf("%d", pob.UnsyncMtime()),
-		contbuf.String(),
-		paylkindstr,
-		paylbuf.String())
+	err := du.dustore.PutObjectRow(spa != SpaUser, &ObjectRowMo{
+		Id:       pobidstr,
+		Mtime:    snap.snmtime,
+		JsonCont: contbuf.String(),
+		PaylKind: paylkindstr,
+		PaylCont: paylbuf.String()})
 	if err != nil {
 		panic(fmt.Errorf("emitDumpedObject insertion failed for %s - %v", pobidstr, err))
 	}
@@ -796,16 +872,14 @@ func (du *DumperMo) DumpEmit() {
 		panic("DumpEmit on non-scanning dumper")
 	}
 	du.dumode = dumod_Emit
-	globstmt, err := du.duglobaldb.Prepare(sql_insert_t_globals)
-	if err != nil {
-		panic(fmt.Errorf("DumpEmit failed to prepare t_globals insertion %v", err))
-	}
-	defer globstmt.Close()
-	usrglobstmt, err := du.duuserdb.Prepare(sql_insert_t_globals)
-	if err != nil {
-		panic(fmt.Errorf("DumpEmit failed to prepare user t_globals insertion %v", err))
+	if du.duincremental {
+		if err := du.dustore.ClearGlobals(GlobalObjects); err != nil {
+			panic(fmt.Errorf("DumpEmit failed to delete t_globals %v", err))
+		}
+		if err := du.dustore.ClearGlobals(UserObjects); err != nil {
+			panic(fmt.Errorf("DumpEmit failed to delete user t_globals %v", err))
+		}
 	}
-	defer usrglobstmt.Close()
 	// emit all objects
 	dso := du.dusetobjects
 	if dso == nil {
@@ -825,52 +899,223 @@ func (du *DumperMo) DumpEmit() {
 	// emit the dumped objects in good order
 	for _, pob := range dumpvec {
 		sp := dso[pob]
+		if du.duincremental && !du.needsEmit(pob, sp) {
+			continue
+		}
 		du.emitDumpedObject(pob, sp)
+		du.dunbupserted++
+	}
+	if du.duincremental {
+		du.deleteStaleObjects(dumpvec)
 	}
 	/// emit the global variables
-	globnames := NamesGlobalVariables()
+	var nbglobglobals, nbuserglobals int
+	globnames := make([]string, 0, len(du.duglobals))
+	for gname := range du.duglobals {
+		globnames = append(globnames, gname)
+	}
+	sort.Strings(globnames)
 	for _, gname := range globnames {
-		gad := GlobalVariableAddress(gname)
-		if gad == nil {
-			continue
-		}
-		gpob := *gad
-		if gpob == nil {
-			continue
-		}
+		gpob := du.duglobals[gname]
 		gsp := du.dusetobjects[gpob]
 		if gsp == SpaGlobal || gsp == SpaPredefined {
-			_, err := globstmt.Exec(gname, gpob.ToString())
+			err := du.dustore.PutGlobal(GlobalObjects, gname, gpob.ToString())
 			if err != nil {
 				panic(fmt.Errorf("DumpEmit failed to insert global %s - %v", gname, err))
 			}
+			nbglobglobals++
 		} else if gsp == SpaUser {
-			_, err := usrglobstmt.Exec(gname, gpob.ToString())
+			err := du.dustore.PutGlobal(UserObjects, gname, gpob.ToString())
 			if err != nil {
 				panic(fmt.Errorf("DumpEmit failed to insert global %s - %v", gname, err))
 			}
+			nbuserglobals++
 		}
 	}
+	/// emit the parameters
+	var nbspaobj [Spa_Last]int
+	for _, sp := range dso {
+		nbspaobj[sp]++
+	}
+	du.emitParams(GlobalObjects, nbspaobj, nbglobglobals)
+	du.emitParams(UserObjects, nbspaobj, nbuserglobals)
 } // end DumpEmit
 
-func (du *DumperMo) renameWithBackup(fpath string) {
-	log.Printf("renameWithBackup fpath=%s tempsuffix=%s\n", fpath, du.dutempsuffix)
-	if du == nil {
-		panic(fmt.Errorf("renameWithBackup nil du fpath=%q\n", fpath))
+//// incremental dumps update in place the previous dump of the store.
+//// Only the rows of objects which are dirty, or new, or moved to
+//// another space, or whose mtime changed, or which refer to an object
+//// becoming persistent or transient, are upserted, and the rows of
+//// objects which are no longer dumped are deleted.
+
+// CanDumpIncrementally is true if the dirpath contains both databases,
+// in the current format (older ones need a full dump)
+func CanDumpIncrementally(dirpath string) bool {
+	st := NewSqliteStore(dirpath)
+	defer st.Close()
+	return canDumpIncrementally(st)
+}
+
+// open an incremental dumper on the existing databases of dirpath;
+// dirtyobjs are the objects modified since the previous dump
+func OpenIncrementalDumperDirectory(dirpath string, dirtyobjs []*ObjectMo) *DumperMo {
+	if !validpath(dirpath) {
+		panic(fmt.Errorf("OpenIncrementalDumperDirectory invalid dirpath %q", dirpath))
 	}
-	tmpath := du.dudirname + "/" + fpath + du.dutempsuffix
-	newpath := du.dudirname + "/" + fpath
-	backupath := newpath + "~"
-	if _, err := os.Stat(backupath); err == nil {
-		os.Rename(backupath, backupath+"~")
+	if dirpath == "" {
+		dirpath = "."
 	}
-	if _, err := os.Stat(newpath); err == nil {
-		os.Rename(newpath, backupath)
+	if !CanDumpIncrementally(dirpath) {
+		panic(fmt.Errorf("OpenIncrementalDumperDirectory no previous dump in %s", dirpath))
 	}
-	if err := os.Rename(tmpath, newpath); err != nil {
-		panic(fmt.Errorf("renameWithBackup dumpdir %s failed for %s  -> %s - %v", du.dudirname, tmpath, newpath, err))
+	log.Printf("OpenIncrementalDumperDirectory dirpath=%s nbdirty=%d\n", dirpath, len(dirtyobjs))
+	return OpenDumper(NewSqliteStore(dirpath), true, dirtyobjs)
+} // end OpenIncrementalDumperDirectory
+
+// should the already dumped pob be emitted again in space sp?
+func (du *DumperMo) needsEmit(pob *ObjectMo, sp uint8) bool {
+	oldids := du.duoldglobids
+	if sp == SpaUser {
+		oldids = du.duolduserids
+	}
+	oldmtim, found := oldids[pob.ToString()]
+	if !found {
+		return true
+	}
+	if _, dirty := du.dudirtyset[pob]; dirty {
+		return true
+	}
+	if oldmtim != du.scannedSnapshot(pob).snmtime {
+		return true
+	}
+	// a reference to a transient object is not dumped, so the row of pob
+	// is stale when some object it refers to changed persistence
+	for _, refob := range du.dureferees[pob] {
+		if du.persistenceChanged(refob) {
+			return true
+		}
+	}
+	return false
+} // end needsEmit
+
+// is pob dumped now, but was not in the previous dump, or conversely?
+func (du *DumperMo) persistenceChanged(pob *ObjectMo) bool {
+	idstr := pob.ToString()
+	_, wasglob := du.duoldglobids[idstr]
+	_, wasuser := du.duolduserids[idstr]
+	return (wasglob || wasuser) != du.IsDumpedObject(pob)
+} // end persistenceChanged
+
+// delete the rows of previously dumped objects not in dumpvec, or
+// dumped now in the other database
+func (du *DumperMo) deleteStaleObjects(dumpvec []*ObjectMo) {
+	globids := make(map[string]bool, len(dumpvec))
+	userids := make(map[string]bool, len(dumpvec))
+	for _, pob := range dumpvec {
+		if du.dusetobjects[pob] == SpaUser {
+			userids[pob.ToString()] = true
+		} else {
+			globids[pob.ToString()] = true
+		}
+	}
+	delfun := func(globflag bool, oldids map[string]int64, newids map[string]bool) {
+		staleids := make([]string, 0, 8)
+		for idstr := range oldids {
+			if !newids[idstr] {
+				staleids = append(staleids, idstr)
+			}
+		}
+		sort.Strings(staleids)
+		for _, idstr := range staleids {
+			log.Printf("deleteStaleObjects deleting %s\n", idstr)
+			if err := du.dustore.DeleteObjectRow(globflag, idstr); err != nil {
+				panic(fmt.Errorf("deleteStaleObjects failed to delete %s - %v", idstr, err))
+			}
+			du.dunbdeleted++
+		}
 	}
-} // end renameWithBackup
+	delfun(GlobalObjects, du.duoldglobids, globids)
+	delfun(UserObjects, du.duolduserids, userids)
+} // end deleteStaleObjects
+
+// abort a failed dumper, leaving the previous dump of its store
+func (du *DumperMo) abort() {
+	log.Printf("dumper abort du=%v\n", du)
+	if du.dustore != nil {
+		du.dustore.AbortDump()
+		du.dustore = nil
+	}
+	du.dusetobjects = nil
+	du.dusnapshots = nil
+	du.duglobals = nil
+	du.dulastchk = nil
+	du.dufirstchk = nil
+	du.dudirtyset = nil
+	du.dureferees = nil
+} // end abort
+
+// DumpIncrementallyIntoDirectory updates the previous dump in dirname,
+// or makes a full dump if there is none; it gives the number of
+// upserted and deleted objects.
+func DumpIncrementallyIntoDirectory(dirname string) (nbupserted int, nbdeleted int) {
+	log.Printf("DumpIncrementallyIntoDirectory start dirname=%s\n\n", dirname)
+	defer log.Printf("DumpIncrementallyIntoDirectory ended dirname=%s\n\n", dirname)
+	return DumpIncrementallyIntoStore(NewSqliteStore(prepareDumpDirectory(dirname)))
+} // end DumpIncrementallyIntoDirectory
+
+// DumpIncrementallyIntoStore updates the previous dump of st, or makes
+// a full dump if there is none, giving -1 upserted objects.
+func DumpIncrementallyIntoStore(st StoreMo) (nbupserted int, nbdeleted int) {
+	if !canDumpIncrementally(st) {
+		log.Printf("DumpIncrementallyIntoStore no previous dump in %v\n", st)
+		// the next incremental dumps of st start from this full one
+		dumpIntoStore(st, false, true)
+		return -1, 0
+	}
+	du := dumpIntoStore(st, true, true)
+	return du.dunbupserted, du.dunbdeleted
+} // end DumpIncrementallyIntoStore
+
+// DumpIntoStore makes a full dump into st, keeping the dirty objects
+// for the next incremental dump, maybe into another store
+func DumpIntoStore(st StoreMo) {
+	dumpIntoStore(st, false, false)
+} // end DumpIntoStore
+
+// dump_mtx serializes the dumps, e.g. the final one and the autosaves
+var dump_mtx sync.Mutex
+
+// takedirty is true for the dumps into the store of the incremental
+// dumps; a failed dump is aborted, and its dirty objects stay dirty
+func dumpIntoStore(st StoreMo, incremental bool, takedirty bool) *DumperMo {
+	dump_mtx.Lock()
+	defer dump_mtx.Unlock()
+	// the objects modified since the previous incremental dump
+	var dirtyobjs []*ObjectMo
+	if takedirty {
+		dirtyobjs = TakeDirtyObjects()
+	}
+	log.Printf("dumpIntoStore %v incremental=%t %d dirty objects\n", st, incremental, len(dirtyobjs))
+	var du *DumperMo
+	defer func() {
+		if r := recover(); r != nil {
+			if du != nil {
+				du.abort()
+			}
+			MarkDirtyObjects(dirtyobjs...)
+			panic(r)
+		}
+	}()
+	du = OpenDumper(st, incremental, dirtyobjs)
+	log.Printf("==== dumpIntoStore before StartDumpScan du=%#v\n\n", du)
+	du.StartDumpScan()
+	log.Printf("==== dumpIntoStore before LoopDumpScan du=%#v\n\n", du)
+	du.LoopDumpScan()
+	log.Printf("==== dumpIntoStore before DumpEmit du=%#v\n\n", du)
+	du.DumpEmit()
+	log.Printf("==== dumpIntoStore final du=%#v\n\n", du)
+	du.Close()
+	return du
+} // end dumpIntoStore
 
 func (du *DumperMo) Close() {
 	{
@@ -888,77 +1133,30 @@ func (du *DumperMo) Close() {
 		nbob = len(du.dusetobjects)
 	}
 	du.dusetobjects = nil
+	du.dusnapshots = nil
+	du.duglobals = nil
 	du.dulastchk = nil
 	du.dufirstchk = nil
-	du.dustobglob.Close()
-	du.dustobglob = nil
-	if du.dustobuser != nil {
-		du.dustobuser.Close()
-		du.dustobuser = nil
+	du.dudirtyset = nil
+	du.dureferees = nil
+	st := du.dustore
+	if st == nil {
+		return
 	}
-	if du.duuserdb != nil {
-		du.duuserdb.Close()
-		du.duuserdb = nil
+	du.dustore = nil
+	if err := st.CommitDump(); err != nil {
+		panic(fmt.Errorf("dumper Close failed to commit into %v - %v", st, err))
 	}
-	if du.duglobaldb != nil {
-		du.duglobaldb.Close()
-		du.duglobaldb = nil
+	if du.duincremental {
+		log.Printf("done incremental dump of %d objects in %v, %d upserted, %d deleted\n",
+			nbob, st, du.dunbupserted, du.dunbdeleted)
+	} else {
+		log.Printf("done dump of %d objects in %v\n", nbob, st)
 	}
-	var err error
-	globtempdb := fmt.Sprintf("%s/%s.sqlite%s", du.dudirname,
-		DefaultGlobalDbname, du.dutempsuffix)
-	globtempsql := fmt.Sprintf("%s/%s.sql%s", du.dudirname,
-		DefaultGlobalDbname, du.dutempsuffix)
-	globoutput := fmt.Sprintf(".output %s", globtempsql)
-	globstacmt := fmt.Sprintf("-- generated monimelt global dumpfile %s.sql", DefaultGlobalDbname)
-	globstaprint := fmt.Sprintf(".print %q", globstacmt)
-	globendcmt := fmt.Sprintf("-- end of monimelt global dumpfile %s.sql", DefaultGlobalDbname)
-	globendprint := fmt.Sprintf(".print %q", globendcmt)
-	var cmd *osexec.Cmd
-	cmd = osexec.Command(SqliteProgram, globtempdb, globoutput, globstaprint, ".dump", globendprint)
-	if err = cmd.Run(); err != nil {
-		panic(fmt.Errorf("dumper Close failed to run global dump %s - %v",
-			cmd, err))
-	}
-	cmd = nil
-	usertempdb := fmt.Sprintf("%s/%s.sqlite%s", du.dudirname,
-		DefaultUserDbname, du.dutempsuffix)
-	usertempsql := fmt.Sprintf("%s/%s.sql%s", du.dudirname,
-		DefaultUserDbname, du.dutempsuffix)
-	useroutput := fmt.Sprintf(".output %s", usertempsql)
-	userstacmt := fmt.Sprintf("-- generated monimelt user dumpfile %s.sql", DefaultUserDbname)
-	userstaprint := fmt.Sprintf(".print %q", userstacmt)
-	userendcmt := fmt.Sprintf("-- end of monimelt user dumpfile %s.sql", DefaultUserDbname)
-	userendprint := fmt.Sprintf(".print %q", userendcmt)
-	cmd = osexec.Command(SqliteProgram, usertempdb, useroutput, userstaprint, ".dump", userendprint)
-	if err = cmd.Run(); err != nil {
-		panic(fmt.Errorf("dumper Close failed to run user dump %s - %v",
-			cmd, err))
-	}
-	cmd = nil
-	nowt := du.dutime
-	os.Chtimes(globtempdb, nowt, nowt)
-	os.Chtimes(globtempsql, nowt, nowt)
-	os.Chtimes(usertempdb, nowt, nowt)
-	os.Chtimes(usertempsql, nowt, nowt)
-	du.renameWithBackup(DefaultGlobalDbname + ".sql")
-	du.renameWithBackup(DefaultUserDbname + ".sql")
-	du.renameWithBackup(DefaultGlobalDbname + ".sqlite")
-	du.renameWithBackup(DefaultUserDbname + ".sqlite")
-	log.Printf("done dump of %d objects in %s\n", nbob, du.dudirname)
 } // end dumper Close
 
 func DumpIntoDirectory(dirname string) {
 	log.Printf("DumpIntoDirectory start dirname=%s\n\n", dirname)
 	defer log.Printf("DumpIntoDirectory ended dirname=%s\n\n", dirname)
-	var du *DumperMo
-	du = OpenDumperDirectory(dirname)
-	defer du.Close()
-	log.Printf("==== DumpIntoDirectory before StartDumpScan du=%#v\n\n", du)
-	du.StartDumpScan()
-	log.Printf("==== DumpIntoDirectory before LoopDumpScan du=%#v\n\n", du)
-	du.LoopDumpScan()
-	log.Printf("==== DumpIntoDirectory before DumpEmit du=%#v\n\n", du)
-	du.DumpEmit()
-	log.Printf("==== DumpIntoDirectory final du=%#v\n\n", du)
+	DumpIntoStore(NewSqliteStore(prepareDumpDirectory(dirname)))
 } // end DumpIntoDirectory
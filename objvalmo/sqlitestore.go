@@ -0,0 +1,536 @@
+// file objvalmo/sqlitestore.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"serialmo" // import "github.com/bstarynk/monimelt/serialmo"
+)
+
+//// the Sqlite store of a dump directory, with the monimelt_global and
+//// monimelt_user databases and their .sql text. A full dump writes
+//// temporary databases, renamed (keeping a backup) when committed; an
+//// incremental dump updates the databases in place. While dumping, the
+//// user database is attached to the connection of the global one, so
+//// both are written in a single transaction, committed atomically; their
+//// .sql files are regenerated at commit.
+
+type SqliteStoreMo struct {
+	ssdirname    string
+	ssglobalpath string
+	ssuserpath   string // "" if there is no user database to read
+	ssglobaldb   *sql.DB
+	ssuserdb     *sql.DB
+	// while dumping
+	ssdumping     bool
+	ssincremental bool
+	sstempsuffix  string
+	ssdumptime    time.Time
+	ssdumptx      *sql.Tx // of both databases, the user one being attached
+	ssstobglob    *sql.Stmt
+	ssstobuser    *sql.Stmt
+}
+
+// both *sql.DB and *sql.Tx are executors
+type sqlExecutorMo interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// the schema of the user database attached while dumping
+const sql_user_schema = "userdb"
+
+// qualify the tables of the queries by the attached user schema
+var sql_user_replacer = strings.NewReplacer(
+	"t_params", sql_user_schema+".t_params",
+	"t_objects", sql_user_schema+".t_objects",
+	"t_globals", sql_user_schema+".t_globals")
+
+// an executor on the tables of the attached user database
+type sqlUserExecutorMo struct {
+	sqlex sqlExecutorMo
+}
+
+func (ux sqlUserExecutorMo) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return ux.sqlex.Exec(sql_user_replacer.Replace(query), args...)
+}
+
+func (ux sqlUserExecutorMo) Prepare(query string) (*sql.Stmt, error) {
+	return ux.sqlex.Prepare(sql_user_replacer.Replace(query))
+}
+
+func (ux sqlUserExecutorMo) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return ux.sqlex.Query(sql_user_replacer.Replace(query), args...)
+}
+
+const sql_create_t_params = `CREATE TABLE IF NOT EXISTS t_params
+ (par_name VARCHAR(35) PRIMARY KEY ASC NOT NULL UNIQUE,
+  par_value TEXT NOT NULL);`
+
+const sql_create_t_objects = `CREATE TABLE IF NOT EXISTS t_objects
+ (ob_id VARCHAR(26) PRIMARY KEY ASC NOT NULL UNIQUE,
+  ob_mtime INT NOT NULL,
+  ob_jsoncont TEXT NOT NULL,
+  ob_paylkind VARCHAR(40) NOT NULL,
+  ob_paylcont TEXT NOT NULL);`
+
+const sql_create_t_globals = `CREATE TABLE IF NOT EXISTS t_globals
+ (glob_name VARCHAR(80) PRIMARY KEY ASC NOT NULL UNIQUE,
+  glob_oid VARCHAR(26)  NOT NULL);`
+
+const sql_insert_t_objects = `INSERT INTO t_objects VALUES (?, ?, ?, ?, ?);`
+
+const sql_insert_t_globals = `INSERT INTO t_globals VALUES (?, ?)`
+
+const sql_upsert_t_objects = `INSERT OR REPLACE INTO t_objects VALUES (?, ?, ?, ?, ?);`
+
+const sql_delete_t_objects = `DELETE FROM t_objects WHERE ob_id = ?;`
+
+const sql_delete_t_globals = `DELETE FROM t_globals;`
+
+const sql_select_t_objects_ids = `SELECT ob_id FROM t_objects`
+
+const sql_select_t_objects_rows = `SELECT ob_id, ob_mtime, ob_jsoncont, ob_paylkind, ob_paylcont FROM t_objects`
+
+const sql_select_t_objects_mtimes = `SELECT ob_id, ob_mtime FROM t_objects`
+
+const sql_select_t_globals = `SELECT glob_name, glob_oid FROM t_globals WHERE glob_oid!=""`
+
+const sql_upsert_t_params = `INSERT OR REPLACE INTO t_params VALUES (?, ?);`
+
+const sql_select_t_params = `SELECT par_name, par_value FROM t_params`
+
+// NewSqliteStore gives the store of the dump directory dirname,
+// without opening its databases yet
+func NewSqliteStore(dirname string) *SqliteStoreMo {
+	if dirname == "" {
+		dirname = "."
+	}
+	ss := &SqliteStoreMo{ssdirname: dirname}
+	ss.ssglobalpath = ss.dbPath(DefaultGlobalDbname)
+	ss.ssuserpath = ss.dbPath(DefaultUserDbname)
+	return ss
+}
+
+// OpenSqliteStoreFiles opens for reading the global database in
+// globalpath, and the user one in userpath if not empty
+func OpenSqliteStoreFiles(globalpath string, userpath string) (*SqliteStoreMo, error) {
+	ss := &SqliteStoreMo{ssglobalpath: globalpath, ssuserpath: userpath}
+	db, err := sql.Open("sqlite3", "file:"+globalpath+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open global db %s - %v", globalpath, err)
+	}
+	ss.ssglobaldb = db
+	if len(userpath) > 0 {
+		db, err := sql.Open("sqlite3", "file:"+userpath+"?mode=ro")
+		if err != nil {
+			ss.ssglobaldb.Close()
+			return nil, fmt.Errorf("failed to open user db %s - %v", userpath, err)
+		}
+		ss.ssuserdb = db
+	}
+	return ss, nil
+} // end OpenSqliteStoreFiles
+
+func (ss *SqliteStoreMo) String() string {
+	if ss.ssdirname != "" {
+		return "SqliteStore:" + ss.ssdirname
+	}
+	return "SqliteStore:" + ss.ssglobalpath
+}
+
+func (ss *SqliteStoreMo) Dirname() string {
+	return ss.ssdirname
+}
+
+func (ss *SqliteStoreMo) dbPath(dbname string) string {
+	return fmt.Sprintf("%s/%s.sqlite", ss.ssdirname, dbname)
+}
+
+func isRegularFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func (ss *SqliteStoreMo) HasDump() bool {
+	return isRegularFile(ss.ssglobalpath) && ss.ssuserpath != "" && isRegularFile(ss.ssuserpath)
+}
+
+func (ss *SqliteStoreMo) HasUser() bool {
+	if ss.ssuserdb != nil {
+		return true
+	}
+	return ss.ssuserpath != "" && isRegularFile(ss.ssuserpath)
+}
+
+// the executor to read a database: its transaction while dumping, or
+// else its read-only handle, opened on demand
+func (ss *SqliteStoreMo) reader(globflag bool) (sqlExecutorMo, error) {
+	if ss.ssdumping {
+		return ss.executor(globflag), nil
+	}
+	pdb, path := &ss.ssglobaldb, ss.ssglobalpath
+	if !globflag {
+		pdb, path = &ss.ssuserdb, ss.ssuserpath
+	}
+	if *pdb != nil {
+		return *pdb, nil
+	}
+	if path == "" || !isRegularFile(path) {
+		return nil, fmt.Errorf("SqliteStore no %s database %q", databaseName(globflag), path)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&cache=private")
+	if err != nil {
+		return nil, err
+	}
+	*pdb = db
+	return db, nil
+} // end reader
+
+func (ss *SqliteStoreMo) executor(globflag bool) sqlExecutorMo {
+	if globflag {
+		return ss.ssdumptx
+	}
+	return sqlUserExecutorMo{ss.ssdumptx}
+}
+
+func (ss *SqliteStoreMo) Params(globflag bool) (map[string]string, error) {
+	params := make(map[string]string)
+	ex, err := ss.reader(globflag)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := ex.Query(sql_select_t_params)
+	if err != nil {
+		// an old database may have no t_params
+		log.Printf("SqliteStore %v no t_params - %v\n", ss, err)
+		return params, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		params[name] = value
+	}
+	return params, rows.Err()
+} // end Params
+
+func (ss *SqliteStoreMo) ObjectIds(globflag bool, fn func(idstr string)) error {
+	ex, err := ss.reader(globflag)
+	if err != nil {
+		return err
+	}
+	rows, err := ex.Query(sql_select_t_objects_ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var idstr string
+		if err := rows.Scan(&idstr); err != nil {
+			return err
+		}
+		fn(idstr)
+	}
+	return rows.Err()
+} // end ObjectIds
+
+func (ss *SqliteStoreMo) ObjectRows(globflag bool, fn func(row *ObjectRowMo)) error {
+	ex, err := ss.reader(globflag)
+	if err != nil {
+		return err
+	}
+	rows, err := ex.Query(sql_select_t_objects_rows)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := new(ObjectRowMo)
+		if err := rows.Scan(&row.Id, &row.Mtime, &row.JsonCont, &row.PaylKind, &row.PaylCont); err != nil {
+			return err
+		}
+		fn(row)
+	}
+	return rows.Err()
+} // end ObjectRows
+
+func (ss *SqliteStoreMo) GlobalRows(globflag bool, fn func(globname string, idstr string)) error {
+	ex, err := ss.reader(globflag)
+	if err != nil {
+		return err
+	}
+	rows, err := ex.Query(sql_select_t_globals)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var globname, idstr string
+		if err := rows.Scan(&globname, &idstr); err != nil {
+			return err
+		}
+		fn(globname, idstr)
+	}
+	return rows.Err()
+} // end GlobalRows
+
+func (ss *SqliteStoreMo) ObjectMtimes(globflag bool) (map[string]int64, error) {
+	idmap := make(map[string]int64)
+	ex, err := ss.reader(globflag)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := ex.Query(sql_select_t_objects_mtimes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var idstr string
+		var mtim int64
+		if err := rows.Scan(&idstr, &mtim); err != nil {
+			return nil, err
+		}
+		idmap[idstr] = mtim
+	}
+	return idmap, rows.Err()
+} // end ObjectMtimes
+
+func create_tables(db sqlExecutorMo) error {
+	log.Printf("create_table db=%v sql_create_t_params=%q\n", db, sql_create_t_params)
+	if _, err := db.Exec(sql_create_t_params); err != nil {
+		return fmt.Errorf("t_params creation %v", err)
+	}
+	if _, err := db.Exec(sql_create_t_objects); err != nil {
+		return fmt.Errorf("t_objects creation %v", err)
+	}
+	if _, err := db.Exec(sql_create_t_globals); err != nil {
+		return fmt.Errorf("t_globals creation %v", err)
+	}
+	return nil
+} // end create_tables
+
+// open for writing the global database of the dump, attach its user
+// database, make their tables and begin their single transaction
+func (ss *SqliteStoreMo) openWrite(globpath string, userpath string, mode string) error {
+	db, err := sql.Open("sqlite3", "file:"+globpath+"?mode="+mode+"&cache=private")
+	if err != nil {
+		return fmt.Errorf("failed to open global db %s - %v", globpath, err)
+	}
+	// the attached database belongs to one connection, so only one is used
+	db.SetMaxOpenConns(1)
+	ss.ssglobaldb = db
+	if err = create_tables(db); err != nil {
+		return fmt.Errorf("create_tables failure in %s - %v", globpath, err)
+	}
+	// a database cannot be attached inside a transaction
+	if _, err = db.Exec("ATTACH DATABASE ? AS "+sql_user_schema,
+		"file:"+userpath+"?mode="+mode+"&cache=private"); err != nil {
+		return fmt.Errorf("failed to attach user db %s - %v", userpath, err)
+	}
+	if err = create_tables(sqlUserExecutorMo{db}); err != nil {
+		return fmt.Errorf("create_tables failure in %s - %v", userpath, err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction of %s and %s - %v", globpath, userpath, err)
+	}
+	ss.ssdumptx = tx
+	insertsql := sql_insert_t_objects
+	if ss.ssincremental {
+		insertsql = sql_upsert_t_objects
+	}
+	if ss.ssstobglob, err = tx.Prepare(insertsql); err != nil {
+		// this should never happen
+		return fmt.Errorf("failed to prepare %s t_objects insertion - %v", globpath, err)
+	}
+	if ss.ssstobuser, err = (sqlUserExecutorMo{tx}).Prepare(insertsql); err != nil {
+		return fmt.Errorf("failed to prepare %s t_objects insertion - %v", userpath, err)
+	}
+	return nil
+} // end openWrite
+
+func (ss *SqliteStoreMo) BeginDump(incremental bool, dumptime time.Time) error {
+	if ss.ssdumping {
+		return fmt.Errorf("SqliteStore %v already dumping", ss)
+	}
+	if ss.ssdirname == "" {
+		return fmt.Errorf("SqliteStore %v without directory cannot dump", ss)
+	}
+	ss.closeRead()
+	ss.ssincremental = incremental
+	ss.ssdumptime = dumptime
+	ss.sstempsuffix = fmt.Sprintf("+%s_p%d.tmp", serialmo.RandomSerial().ToString(), os.Getpid())
+	globpath, userpath, mode := ss.ssglobalpath, ss.ssuserpath, "rw"
+	if !incremental {
+		globpath += ss.sstempsuffix
+		userpath += ss.sstempsuffix
+		mode = "rwc"
+	}
+	log.Printf("SqliteStore BeginDump %v incremental=%t globpath=%s userpath=%s\n",
+		ss, incremental, globpath, userpath)
+	ss.ssdumping = true
+	if err := ss.openWrite(globpath, userpath, mode); err != nil {
+		ss.AbortDump()
+		return err
+	}
+	return nil
+} // end BeginDump
+
+func (ss *SqliteStoreMo) PutObjectRow(globflag bool, row *ObjectRowMo) error {
+	stmt := ss.ssstobuser
+	if globflag {
+		stmt = ss.ssstobglob
+	}
+	_, err := stmt.Exec(row.Id, fmt.Sprintf("%d", row.Mtime), row.JsonCont, row.PaylKind, row.PaylCont)
+	return err
+}
+
+func (ss *SqliteStoreMo) DeleteObjectRow(globflag bool, idstr string) error {
+	_, err := ss.executor(globflag).Exec(sql_delete_t_objects, idstr)
+	return err
+}
+
+func (ss *SqliteStoreMo) ClearGlobals(globflag bool) error {
+	_, err := ss.executor(globflag).Exec(sql_delete_t_globals)
+	return err
+}
+
+func (ss *SqliteStoreMo) PutGlobal(globflag bool, globname string, idstr string) error {
+	_, err := ss.executor(globflag).Exec(sql_insert_t_globals, globname, idstr)
+	return err
+}
+
+func (ss *SqliteStoreMo) PutParam(globflag bool, parname string, parvalue string) error {
+	_, err := ss.executor(globflag).Exec(sql_upsert_t_params, parname, parvalue)
+	return err
+}
+
+// rollback the dump, and remove the temporary databases of a full dump
+func (ss *SqliteStoreMo) AbortDump() {
+	log.Printf("SqliteStore AbortDump %v\n", ss)
+	for _, stmt := range []*sql.Stmt{ss.ssstobglob, ss.ssstobuser} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	ss.ssstobglob, ss.ssstobuser = nil, nil
+	if ss.ssdumptx != nil {
+		ss.ssdumptx.Rollback()
+		ss.ssdumptx = nil
+	}
+	ss.closeRead()
+	if !ss.ssincremental && ss.sstempsuffix != "" {
+		os.Remove(ss.ssglobalpath + ss.sstempsuffix)
+		os.Remove(ss.ssuserpath + ss.sstempsuffix)
+	}
+	ss.ssdumping = false
+} // end AbortDump
+
+func (ss *SqliteStoreMo) CommitDump() error {
+	if !ss.ssdumping {
+		return fmt.Errorf("SqliteStore %v CommitDump without dump", ss)
+	}
+	ss.ssstobglob.Close()
+	ss.ssstobglob = nil
+	ss.ssstobuser.Close()
+	ss.ssstobuser = nil
+	// both databases are committed atomically, or none is
+	if err := ss.ssdumptx.Commit(); err != nil {
+		ss.AbortDump()
+		return fmt.Errorf("failed to commit dump in %s - %v", ss.ssdirname, err)
+	}
+	ss.ssdumptx = nil
+	ss.closeRead()
+	ss.ssdumping = false
+	globdb, userdb := ss.ssglobalpath, ss.ssuserpath
+	if !ss.ssincremental {
+		globdb += ss.sstempsuffix
+		userdb += ss.sstempsuffix
+	}
+	globtempsql := fmt.Sprintf("%s/%s.sql%s", ss.ssdirname, DefaultGlobalDbname, ss.sstempsuffix)
+	if err := ss.dumpSqlText(globdb, globtempsql, "global", DefaultGlobalDbname); err != nil {
+		return err
+	}
+	usertempsql := fmt.Sprintf("%s/%s.sql%s", ss.ssdirname, DefaultUserDbname, ss.sstempsuffix)
+	if err := ss.dumpSqlText(userdb, usertempsql, "user", DefaultUserDbname); err != nil {
+		return err
+	}
+	nowt := ss.ssdumptime
+	os.Chtimes(globdb, nowt, nowt)
+	os.Chtimes(globtempsql, nowt, nowt)
+	os.Chtimes(userdb, nowt, nowt)
+	os.Chtimes(usertempsql, nowt, nowt)
+	fpaths := []string{DefaultGlobalDbname + ".sql", DefaultUserDbname + ".sql"}
+	if !ss.ssincremental {
+		fpaths = append(fpaths, DefaultGlobalDbname+".sqlite", DefaultUserDbname+".sqlite")
+	}
+	for _, fpath := range fpaths {
+		if err := ss.renameWithBackup(fpath); err != nil {
+			return err
+		}
+	}
+	log.Printf("SqliteStore CommitDump done in %s incremental=%t\n", ss.ssdirname, ss.ssincremental)
+	return nil
+} // end CommitDump
+
+func (ss *SqliteStoreMo) renameWithBackup(fpath string) error {
+	log.Printf("renameWithBackup fpath=%s tempsuffix=%s\n", fpath, ss.sstempsuffix)
+	tmpath := ss.ssdirname + "/" + fpath + ss.sstempsuffix
+	newpath := ss.ssdirname + "/" + fpath
+	backupath := newpath + "~"
+	if _, err := os.Stat(backupath); err == nil {
+		os.Rename(backupath, backupath+"~")
+	}
+	if _, err := os.Stat(newpath); err == nil {
+		os.Rename(newpath, backupath)
+	}
+	if err := os.Rename(tmpath, newpath); err != nil {
+		return fmt.Errorf("renameWithBackup dumpdir %s failed for %s  -> %s - %v", ss.ssdirname, tmpath, newpath, err)
+	}
+	return nil
+} // end renameWithBackup
+
+// the first and last comments of the .sql file of a database
+func sqlTextComments(kind string, dbname string) (stacmt string, endcmt string) {
+	stacmt = fmt.Sprintf("generated monimelt %s dumpfile %s.sql", kind, dbname)
+	endcmt = fmt.Sprintf("end of monimelt %s dumpfile %s.sql", kind, dbname)
+	return stacmt, endcmt
+}
+
+// write into sqlpath the SQL text of database dbpath
+func (ss *SqliteStoreMo) dumpSqlText(dbpath string, sqlpath string, kind string, dbname string) error {
+	stacmt, endcmt := sqlTextComments(kind, dbname)
+	if err := DumpSqlTextFile(dbpath, sqlpath, stacmt, endcmt); err != nil {
+		return fmt.Errorf("failed to write %s dump %s of %s - %v", kind, sqlpath, dbpath, err)
+	}
+	return nil
+} // end dumpSqlText
+
+func (ss *SqliteStoreMo) closeRead() {
+	if ss.ssuserdb != nil {
+		ss.ssuserdb.Close()
+		ss.ssuserdb = nil
+	}
+	if ss.ssglobaldb != nil {
+		ss.ssglobaldb.Close()
+		ss.ssglobaldb = nil
+	}
+}
+
+func (ss *SqliteStoreMo) Close() error {
+	if ss.ssdumping {
+		ss.AbortDump()
+	}
+	ss.closeRead()
+	return nil
+}
@@ -0,0 +1,188 @@
+// file objvalmo/sqltext.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+//// native SQL text dump and restore of our Sqlite databases, so the
+//// sqlite3 command line program is not needed. The SQL text is
+//// deterministic: tables are sorted by name and their rows by their
+//// first column (the primary key, e.g. ob_id), and values are quoted
+//// by Sqlite's quote() function. So it is byte-stable across dumps of
+//// the same data, and can be read back by sqlite3 or RestoreSqlText.
+
+const sql_select_tables = `SELECT name, sql FROM sqlite_master
+ WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`
+
+func quoteSqlName(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func sqlTableColumns(db *sql.DB, tabname string) ([]string, error) {
+	rows, err := db.Query("PRAGMA table_info(" + quoteSqlName(tabname) + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	colnames := make([]string, 0, 8)
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		colnames = append(colnames, name)
+	}
+	return colnames, rows.Err()
+} // end sqlTableColumns
+
+func writeSqlTableRows(db *sql.DB, bw *bufio.Writer, tabname string) error {
+	colnames, err := sqlTableColumns(db, tabname)
+	if err != nil {
+		return err
+	}
+	if len(colnames) == 0 {
+		return fmt.Errorf("no columns in table %s", tabname)
+	}
+	quotedcols := make([]string, len(colnames))
+	for ix, cname := range colnames {
+		quotedcols[ix] = "quote(" + quoteSqlName(cname) + ")"
+	}
+	rows, err := db.Query("SELECT " + strings.Join(quotedcols, ", ") +
+		" FROM " + quoteSqlName(tabname) + " ORDER BY 1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	vals := make([]string, len(colnames))
+	valptrs := make([]interface{}, len(colnames))
+	for ix := range vals {
+		valptrs[ix] = &vals[ix]
+	}
+	for rows.Next() {
+		if err := rows.Scan(valptrs...); err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "INSERT INTO %s VALUES(%s);\n", tabname, strings.Join(vals, ","))
+	}
+	return rows.Err()
+} // end writeSqlTableRows
+
+// WriteSqlText writes the SQL text of db, between two comment lines
+func WriteSqlText(db *sql.DB, w io.Writer, startcomment string, endcomment string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "-- %s\n", startcomment)
+	bw.WriteString("PRAGMA foreign_keys=OFF;\n")
+	bw.WriteString("BEGIN TRANSACTION;\n")
+	rows, err := db.Query(sql_select_tables)
+	if err != nil {
+		return err
+	}
+	var tabnames, tabsqls []string
+	for rows.Next() {
+		var tabname, tabsql string
+		if err := rows.Scan(&tabname, &tabsql); err != nil {
+			rows.Close()
+			return err
+		}
+		tabnames = append(tabnames, tabname)
+		tabsqls = append(tabsqls, tabsql)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for tix, tabname := range tabnames {
+		fmt.Fprintf(bw, "%s;\n", tabsqls[tix])
+		if err := writeSqlTableRows(db, bw, tabname); err != nil {
+			return fmt.Errorf("WriteSqlText failed for table %s - %v", tabname, err)
+		}
+	}
+	bw.WriteString("COMMIT;\n")
+	fmt.Fprintf(bw, "-- %s\n", endcomment)
+	return bw.Flush()
+} // end WriteSqlText
+
+// DumpSqlTextFile writes into sqlpath the SQL text of the database in dbpath
+func DumpSqlTextFile(dbpath string, sqlpath string, startcomment string, endcomment string) error {
+	db, err := sql.Open("sqlite3", "file:"+dbpath+"?mode=ro&cache=private")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	sqlf, err := os.Create(sqlpath)
+	if err != nil {
+		return err
+	}
+	if err = WriteSqlText(db, sqlf, startcomment, endcomment); err != nil {
+		sqlf.Close()
+		os.Remove(sqlpath)
+		return err
+	}
+	return sqlf.Close()
+} // end DumpSqlTextFile
+
+// RestoreSqlTextFile makes the database dbpath from the SQL text in
+// sqlpath, keeping a backup of the previous database. Like the
+// monimelt-restore-state.sh script, the database gets the
+// modification time of the SQL file.
+func RestoreSqlTextFile(sqlpath string, dbpath string) error {
+	log.Printf("RestoreSqlTextFile sqlpath=%s dbpath=%s\n", sqlpath, dbpath)
+	sqlinf, err := os.Stat(sqlpath)
+	if err != nil {
+		return err
+	}
+	sqltext, err := ioutil.ReadFile(sqlpath)
+	if err != nil {
+		return err
+	}
+	tmpath := fmt.Sprintf("%s+restore_p%d.tmp", dbpath, os.Getpid())
+	os.Remove(tmpath)
+	db, err := sql.Open("sqlite3", "file:"+tmpath+"?mode=rwc&cache=private")
+	if err != nil {
+		return err
+	}
+	if _, err = db.Exec(string(sqltext)); err != nil {
+		db.Close()
+		os.Remove(tmpath)
+		return fmt.Errorf("RestoreSqlTextFile failed to run %s - %v", sqlpath, err)
+	}
+	if err = db.Close(); err != nil {
+		os.Remove(tmpath)
+		return err
+	}
+	if _, err := os.Stat(dbpath); err == nil {
+		os.Rename(dbpath, dbpath+"~")
+	}
+	if err = os.Rename(tmpath, dbpath); err != nil {
+		return err
+	}
+	mtim := sqlinf.ModTime()
+	return os.Chtimes(dbpath, mtim, mtim)
+} // end RestoreSqlTextFile
+
+// RestoreDirectoryFromSql remakes the databases of a dump directory
+// from their .sql files; the user one is optional.
+func RestoreDirectoryFromSql(dirname string) error {
+	for _, dbname := range []string{DefaultGlobalDbname, DefaultUserDbname} {
+		sqlpath := dirname + "/" + dbname + ".sql"
+		if _, err := os.Stat(sqlpath); err != nil && dbname == DefaultUserDbname {
+			continue
+		}
+		if err := RestoreSqlTextFile(sqlpath, dirname+"/"+dbname+".sqlite"); err != nil {
+			return err
+		}
+	}
+	return nil
+} // end RestoreDirectoryFromSql
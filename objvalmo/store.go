@@ -0,0 +1,60 @@
+// file objvalmo/store.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"time"
+)
+
+//// storage backends: the loader and the dumper only see a StoreMo,
+//// made of two databases, the global one (for predefined and global
+//// objects) and the user one, each with rows of objects, of global
+//// variables and of parameters. SqliteStoreMo keeps them in the
+//// Sqlite files of a dump directory, MemoryStoreMo keeps them in
+//// memory, e.g. for tests.
+
+type StoreMo interface {
+	/// reading the last committed dump (or the dump being written)
+	// HasDump is true if a previous dump was committed
+	HasDump() bool
+	// HasUser is true if there is a user database to load
+	HasUser() bool
+	Params(globflag bool) (map[string]string, error)
+	ObjectIds(globflag bool, fn func(idstr string)) error
+	// fn is given a fresh row, which it may keep or change
+	ObjectRows(globflag bool, fn func(row *ObjectRowMo)) error
+	GlobalRows(globflag bool, fn func(globname string, idstr string)) error
+	/// writing a dump, between BeginDump and CommitDump or AbortDump;
+	/// an incremental dump updates the previous one in place, a full
+	/// dump starts from empty databases.
+	BeginDump(incremental bool, dumptime time.Time) error
+	// the ids and mtimes of the objects already in the dumped database,
+	// so those of the previous dump when incremental
+	ObjectMtimes(globflag bool) (map[string]int64, error)
+	PutObjectRow(globflag bool, row *ObjectRowMo) error
+	DeleteObjectRow(globflag bool, idstr string) error
+	ClearGlobals(globflag bool) error
+	PutGlobal(globflag bool, globname string, idstr string) error
+	PutParam(globflag bool, parname string, parvalue string) error
+	CommitDump() error
+	AbortDump()
+	// Close releases the resources for reading
+	Close() error
+} // end StoreMo
+
+// an incremental dump needs a previous dump in the current format
+func canDumpIncrementally(st StoreMo) bool {
+	if !st.HasDump() {
+		return false
+	}
+	for _, globflag := range []bool{GlobalObjects, UserObjects} {
+		params, err := st.Params(globflag)
+		if err != nil {
+			return false
+		}
+		if version, err := paramsFormatVersion(params); err != nil || version != DumpFormatVersion {
+			return false
+		}
+	}
+	return true
+} // end canDumpIncrementally
@@ -0,0 +1,533 @@
+// file objvalmo/textstore.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"serialmo" // import "github.com/bstarynk/monimelt/serialmo"
+)
+
+//// the textual store, friendly to git: a dump directory with one
+//// indented JSON file per object, in global/ or user/ then in a
+//// subdirectory named by the bucket number of its id, e.g.
+//// user/042/_7T9U1eXmVmB_2xkG4a3TfkAg.json, plus a globals.json file
+//// for the global variables and a manifest.json file with the
+//// parameters of both databases. A dump is kept in memory until
+//// committed; then only the files whose content changed are written,
+//// the files of objects not dumped anymore are removed, and the
+//// manifest is written last.
+
+const TextDumpFormat = "monimelt-text"
+const TextManifestName = "manifest.json"
+const TextGlobalsName = "globals.json"
+
+// the file of an object; its content and payload are the JSON of
+// the ob_jsoncont and ob_paylcont columns of Sqlite
+type textObjectFileMo struct {
+	Id       string          `json:"id"`
+	Mtime    int64           `json:"mtime"`
+	Content  json.RawMessage `json:"content"`
+	PaylKind string          `json:"paylkind,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+type textManifestMo struct {
+	Format string            `json:"format"`
+	Global map[string]string `json:"global"`
+	User   map[string]string `json:"user,omitempty"`
+}
+
+type textGlobalsMo struct {
+	Global map[string]string `json:"global"`
+	User   map[string]string `json:"user"`
+}
+
+// what a dump writes into a database
+type textDatabaseMo struct {
+	tdrows    map[string]*ObjectRowMo
+	tddeleted map[string]bool
+	tdglobals map[string]string
+	tdparams  map[string]string
+}
+
+type TextStoreMo struct {
+	tsdirname     string
+	tsdumping     bool
+	tsincremental bool
+	tstempsuffix  string
+	tsglobal      *textDatabaseMo
+	tsuser        *textDatabaseMo
+}
+
+// NewTextStore gives the textual store of dirname
+func NewTextStore(dirname string) *TextStoreMo {
+	if dirname == "" {
+		dirname = "."
+	}
+	return &TextStoreMo{tsdirname: dirname}
+}
+
+func (ts *TextStoreMo) String() string {
+	return "TextStore:" + ts.tsdirname
+}
+
+func (ts *TextStoreMo) Dirname() string {
+	return ts.tsdirname
+}
+
+func (ts *TextStoreMo) dbDir(globflag bool) string {
+	return filepath.Join(ts.tsdirname, databaseName(globflag))
+}
+
+// the path of the file of the object idstr
+func (ts *TextStoreMo) objectPath(globflag bool, idstr string) (string, error) {
+	oid, err := serialmo.IdFromString(idstr)
+	if err != nil {
+		return "", fmt.Errorf("%v bad object id %q - %v", ts, idstr, err)
+	}
+	return filepath.Join(ts.dbDir(globflag), fmt.Sprintf("%03d", oid.BucketNum()), idstr+".json"), nil
+}
+
+func (ts *TextStoreMo) readJson(name string, pval interface{}) error {
+	data, err := ioutil.ReadFile(filepath.Join(ts.tsdirname, name))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, pval); err != nil {
+		return fmt.Errorf("%v bad %s - %v", ts, name, err)
+	}
+	return nil
+}
+
+func (ts *TextStoreMo) readManifest() (*textManifestMo, error) {
+	var man textManifestMo
+	if err := ts.readJson(TextManifestName, &man); err != nil {
+		return nil, err
+	}
+	if man.Format != TextDumpFormat {
+		return nil, fmt.Errorf("%v unexpected format %q in %s", ts, man.Format, TextManifestName)
+	}
+	return &man, nil
+}
+
+func (ts *TextStoreMo) HasDump() bool {
+	man, err := ts.readManifest()
+	return err == nil && man.Global != nil && man.User != nil
+}
+
+func (ts *TextStoreMo) HasUser() bool {
+	man, err := ts.readManifest()
+	return err == nil && man.User != nil
+}
+
+func (ts *TextStoreMo) Params(globflag bool) (map[string]string, error) {
+	man, err := ts.readManifest()
+	if err != nil {
+		return nil, err
+	}
+	params := man.Global
+	if !globflag {
+		params = man.User
+	}
+	if params == nil {
+		return nil, fmt.Errorf("%v has no %s database", ts, databaseName(globflag))
+	}
+	return params, nil
+}
+
+// the paths of the object files of a database, sorted by id
+func (ts *TextStoreMo) objectPaths(globflag bool) ([]string, error) {
+	dbdir := ts.dbDir(globflag)
+	buckents, err := ioutil.ReadDir(dbdir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, bent := range buckents {
+		if !bent.IsDir() {
+			continue
+		}
+		bdir := filepath.Join(dbdir, bent.Name())
+		fents, err := ioutil.ReadDir(bdir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fent := range fents {
+			if fent.Mode().IsRegular() && strings.HasSuffix(fent.Name(), ".json") {
+				paths = append(paths, filepath.Join(bdir, fent.Name()))
+			}
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return filepath.Base(paths[i]) < filepath.Base(paths[j])
+	})
+	return paths, nil
+} // end objectPaths
+
+func pathObjectId(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), ".json")
+}
+
+// read the file of an object; an unparsable file, e.g. after a bad
+// merge, gives a row with its text as content, so the loader reports it
+func readTextObjectFile(path string) (*ObjectRowMo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var obf textObjectFileMo
+	if err := json.Unmarshal(data, &obf); err != nil {
+		log.Printf("readTextObjectFile bad %s - %v\n", path, err)
+		return &ObjectRowMo{Id: pathObjectId(path), JsonCont: string(data)}, nil
+	}
+	// the object of a file is named by its path, as in ObjectIds
+	row := &ObjectRowMo{Id: pathObjectId(path), Mtime: obf.Mtime, JsonCont: string(obf.Content), PaylKind: obf.PaylKind}
+	if obf.Id != row.Id {
+		log.Printf("readTextObjectFile %s has id %s\n", path, obf.Id)
+		row.Problem = fmt.Sprintf("file %s has id %s", filepath.Base(path), obf.Id)
+	}
+	if obf.PaylKind != "" {
+		row.PaylCont = string(obf.Payload)
+	}
+	return row, nil
+} // end readTextObjectFile
+
+func encodeTextObjectFile(row *ObjectRowMo) ([]byte, error) {
+	obf := textObjectFileMo{Id: row.Id, Mtime: row.Mtime, Content: json.RawMessage(row.JsonCont), PaylKind: row.PaylKind}
+	if row.PaylKind != "" && strings.TrimSpace(row.PaylCont) != "" {
+		obf.Payload = json.RawMessage(row.PaylCont)
+	}
+	return encodeTextJson(obf)
+}
+
+func encodeTextJson(val interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", " ")
+	if err := enc.Encode(val); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ts *TextStoreMo) ObjectIds(globflag bool, fn func(idstr string)) error {
+	paths, err := ts.objectPaths(globflag)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		fn(pathObjectId(path))
+	}
+	return nil
+}
+
+func (ts *TextStoreMo) ObjectRows(globflag bool, fn func(row *ObjectRowMo)) error {
+	paths, err := ts.objectPaths(globflag)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		row, err := readTextObjectFile(path)
+		if err != nil {
+			return err
+		}
+		fn(row)
+	}
+	return nil
+}
+
+func (ts *TextStoreMo) readGlobals() (*textGlobalsMo, error) {
+	var globs textGlobalsMo
+	if err := ts.readJson(TextGlobalsName, &globs); err != nil {
+		return nil, err
+	}
+	return &globs, nil
+}
+
+func (ts *TextStoreMo) GlobalRows(globflag bool, fn func(globname string, idstr string)) error {
+	globs, err := ts.readGlobals()
+	if err != nil {
+		return err
+	}
+	gmap := globs.Global
+	if !globflag {
+		gmap = globs.User
+	}
+	for _, name := range sortedKeys(gmap) {
+		if gmap[name] != "" {
+			fn(name, gmap[name])
+		}
+	}
+	return nil
+}
+
+func newTextDatabase() *textDatabaseMo {
+	return &textDatabaseMo{
+		tdrows:    make(map[string]*ObjectRowMo),
+		tddeleted: make(map[string]bool),
+		tdglobals: make(map[string]string),
+		tdparams:  make(map[string]string),
+	}
+}
+
+func (ts *TextStoreMo) database(globflag bool) *textDatabaseMo {
+	if globflag {
+		return ts.tsglobal
+	}
+	return ts.tsuser
+}
+
+func (ts *TextStoreMo) BeginDump(incremental bool, dumptime time.Time) error {
+	if ts.tsdumping {
+		return fmt.Errorf("%v already dumping", ts)
+	}
+	ts.tsglobal = newTextDatabase()
+	ts.tsuser = newTextDatabase()
+	if incremental {
+		// keep the previous globals and parameters
+		globs, err := ts.readGlobals()
+		if err != nil {
+			return err
+		}
+		man, err := ts.readManifest()
+		if err != nil {
+			return err
+		}
+		for _, globflag := range []bool{GlobalObjects, UserObjects} {
+			td := ts.database(globflag)
+			gmap, params := globs.Global, man.Global
+			if !globflag {
+				gmap, params = globs.User, man.User
+			}
+			for name, idstr := range gmap {
+				td.tdglobals[name] = idstr
+			}
+			for name, val := range params {
+				td.tdparams[name] = val
+			}
+		}
+	}
+	ts.tsdumping = true
+	ts.tsincremental = incremental
+	ts.tstempsuffix = fmt.Sprintf("+%s_p%d.tmp", serialmo.RandomSerial().ToString(), os.Getpid())
+	log.Printf("TextStore BeginDump %v incremental=%t\n", ts, incremental)
+	return nil
+} // end BeginDump
+
+func (ts *TextStoreMo) ObjectMtimes(globflag bool) (map[string]int64, error) {
+	idmap := make(map[string]int64)
+	if ts.tsdumping && !ts.tsincremental {
+		// a full dump starts empty
+		return idmap, nil
+	}
+	err := ts.ObjectRows(globflag, func(row *ObjectRowMo) {
+		idmap[row.Id] = row.Mtime
+	})
+	return idmap, err
+}
+
+func (ts *TextStoreMo) dumpDatabase(globflag bool) (*textDatabaseMo, error) {
+	if !ts.tsdumping {
+		return nil, fmt.Errorf("%v is not dumping", ts)
+	}
+	return ts.database(globflag), nil
+}
+
+func (ts *TextStoreMo) PutObjectRow(globflag bool, row *ObjectRowMo) error {
+	td, err := ts.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	if _, err := serialmo.IdFromString(row.Id); err != nil {
+		return fmt.Errorf("%v bad object id %q - %v", ts, row.Id, err)
+	}
+	rowcp := *row
+	td.tdrows[row.Id] = &rowcp
+	delete(td.tddeleted, row.Id)
+	return nil
+}
+
+func (ts *TextStoreMo) DeleteObjectRow(globflag bool, idstr string) error {
+	td, err := ts.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	delete(td.tdrows, idstr)
+	td.tddeleted[idstr] = true
+	return nil
+}
+
+func (ts *TextStoreMo) ClearGlobals(globflag bool) error {
+	td, err := ts.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	td.tdglobals = make(map[string]string)
+	return nil
+}
+
+func (ts *TextStoreMo) PutGlobal(globflag bool, globname string, idstr string) error {
+	td, err := ts.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	td.tdglobals[globname] = idstr
+	return nil
+}
+
+func (ts *TextStoreMo) PutParam(globflag bool, parname string, parvalue string) error {
+	td, err := ts.dumpDatabase(globflag)
+	if err != nil {
+		return err
+	}
+	td.tdparams[parname] = parvalue
+	return nil
+}
+
+// write data into path, through a temporary file, unless path has
+// already that content
+func (ts *TextStoreMo) writeFile(path string, data []byte) (bool, error) {
+	if olddata, err := ioutil.ReadFile(path); err == nil && bytes.Equal(olddata, data) {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return false, err
+	}
+	tmpath := path + ts.tstempsuffix
+	if err := ioutil.WriteFile(tmpath, data, 0640); err != nil {
+		os.Remove(tmpath)
+		return false, err
+	}
+	if err := os.Rename(tmpath, path); err != nil {
+		os.Remove(tmpath)
+		return false, err
+	}
+	return true, nil
+} // end writeFile
+
+// write the object files of a database, and remove the stale ones
+func (ts *TextStoreMo) commitObjects(globflag bool) (nbwritten int, nbremoved int, err error) {
+	td := ts.database(globflag)
+	oldpaths, err := ts.objectPaths(globflag)
+	if err != nil {
+		return 0, 0, err
+	}
+	newpaths := make(map[string]bool, len(td.tdrows))
+	ids := make([]string, 0, len(td.tdrows))
+	for idstr := range td.tdrows {
+		ids = append(ids, idstr)
+	}
+	sort.Strings(ids)
+	for _, idstr := range ids {
+		path, err := ts.objectPath(globflag, idstr)
+		if err != nil {
+			return nbwritten, nbremoved, err
+		}
+		newpaths[path] = true
+		data, err := encodeTextObjectFile(td.tdrows[idstr])
+		if err != nil {
+			return nbwritten, nbremoved, fmt.Errorf("%v failed to encode %s - %v", ts, idstr, err)
+		}
+		written, err := ts.writeFile(path, data)
+		if err != nil {
+			return nbwritten, nbremoved, err
+		}
+		if written {
+			nbwritten++
+		}
+	}
+	for _, path := range oldpaths {
+		if newpaths[path] {
+			continue
+		}
+		// an incremental dump keeps the objects it did not delete
+		if ts.tsincremental && !td.tddeleted[pathObjectId(path)] {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return nbwritten, nbremoved, err
+		}
+		nbremoved++
+		// remove the bucket directory once empty
+		if ents, err := ioutil.ReadDir(filepath.Dir(path)); err == nil && len(ents) == 0 {
+			os.Remove(filepath.Dir(path))
+		}
+	}
+	return nbwritten, nbremoved, nil
+} // end commitObjects
+
+func (ts *TextStoreMo) CommitDump() error {
+	if !ts.tsdumping {
+		return fmt.Errorf("%v CommitDump without dump", ts)
+	}
+	defer ts.AbortDump()
+	var nbwritten, nbremoved int
+	for _, globflag := range []bool{GlobalObjects, UserObjects} {
+		nbw, nbr, err := ts.commitObjects(globflag)
+		nbwritten += nbw
+		nbremoved += nbr
+		if err != nil {
+			return fmt.Errorf("%v failed to commit %s objects - %v", ts, databaseName(globflag), err)
+		}
+	}
+	globsdata, err := encodeTextJson(textGlobalsMo{Global: ts.tsglobal.tdglobals, User: ts.tsuser.tdglobals})
+	if err != nil {
+		return err
+	}
+	if _, err := ts.writeFile(filepath.Join(ts.tsdirname, TextGlobalsName), globsdata); err != nil {
+		return err
+	}
+	mandata, err := encodeTextJson(textManifestMo{Format: TextDumpFormat, Global: ts.tsglobal.tdparams, User: ts.tsuser.tdparams})
+	if err != nil {
+		return err
+	}
+	if _, err := ts.writeFile(filepath.Join(ts.tsdirname, TextManifestName), mandata); err != nil {
+		return err
+	}
+	log.Printf("TextStore CommitDump %v wrote %d and removed %d object files\n", ts, nbwritten, nbremoved)
+	return nil
+} // end CommitDump
+
+// forget the current dump; nothing is written before CommitDump
+func (ts *TextStoreMo) AbortDump() {
+	ts.tsdumping = false
+	ts.tsglobal = nil
+	ts.tsuser = nil
+}
+
+func (ts *TextStoreMo) Close() error {
+	if ts.tsdumping {
+		ts.AbortDump()
+	}
+	return nil
+}
+
+// DumpIntoTextDirectory dumps into the textual store of dirname,
+// rewriting only the changed files
+func DumpIntoTextDirectory(dirname string) {
+	log.Printf("DumpIntoTextDirectory start dirname=%s\n", dirname)
+	DumpIntoStore(NewTextStore(prepareDumpDirectory(dirname)))
+	log.Printf("DumpIntoTextDirectory ended dirname=%s\n", dirname)
+} // end DumpIntoTextDirectory
+
+// LoadFromTextDirectory loads the textual store of dirname, like
+// LoadFromDirectory
+func LoadFromTextDirectory(dirname string) {
+	ts := NewTextStore(dirname)
+	if _, err := ts.readManifest(); err != nil {
+		panic(fmt.Errorf("LoadFromTextDirectory bad dirname %s - %v", dirname, err))
+	}
+	LoadFromStore(ts)
+} // end LoadFromTextDirectory
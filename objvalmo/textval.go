@@ -0,0 +1,328 @@
+// file objvalmo/textval.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//// reader for the textual syntax of values, as printed by their
+//// String() or ToString() methods:
+////    ~                       the nil value
+////    -12  123456789012345678901234567890   integers, maybe big
+////    3.140000  -1e+20  +Inf  floats (with a dot, an exponent or Inf)
+////    "a\nb"                  strings, Go quoted
+////    #"AAEC"                 byte blobs, in base64
+////    _02hL3RuX4x6_6y6PTK9vZs7    object references
+////    [ob1 ob2]  {ob1 ob2}    tuples and sets of objects
+////    %col+12  %col"str"  %col/ob  colored integers, strings, references
+////    *conn(son1 son2)        nodes
+
+type ValueTextError struct {
+	Offset int // in bytes
+	Line   int // starting from 1
+	Col    int // in runes, starting from 1
+	Msg    string
+}
+
+func (e *ValueTextError) Error() string {
+	return fmt.Sprintf("objvalmo.ParseValueText at %d:%d (offset %d): %s",
+		e.Line, e.Col, e.Offset, e.Msg)
+}
+
+type valueTextParser struct {
+	vtsrc string
+	vtpos int
+	vtvpm JsonValParserMo
+}
+
+func (vt *valueTextParser) errorAt(pos int, format string, args ...interface{}) *ValueTextError {
+	line := 1 + strings.Count(vt.vtsrc[:pos], "\n")
+	linestart := strings.LastIndexByte(vt.vtsrc[:pos], '\n') + 1
+	col := 1 + utf8.RuneCountInString(vt.vtsrc[linestart:pos])
+	return &ValueTextError{Offset: pos, Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (vt *valueTextParser) skipSpaces() {
+	for vt.vtpos < len(vt.vtsrc) {
+		switch vt.vtsrc[vt.vtpos] {
+		case ' ', '\t', '\n', '\r', '\f', '\v':
+			vt.vtpos++
+		default:
+			return
+		}
+	}
+}
+
+func (vt *valueTextParser) atEnd() bool {
+	return vt.vtpos >= len(vt.vtsrc)
+}
+
+func (vt *valueTextParser) peek() byte {
+	if vt.vtpos >= len(vt.vtsrc) {
+		return 0
+	}
+	return vt.vtsrc[vt.vtpos]
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (vt *valueTextParser) parseObject() (*ObjectMo, error) {
+	startpos := vt.vtpos
+	if vt.peek() != '_' {
+		return nil, vt.errorAt(startpos, "expecting object id")
+	}
+	for vt.vtpos < len(vt.vtsrc) && isIdentByte(vt.vtsrc[vt.vtpos]) {
+		vt.vtpos++
+	}
+	idstr := vt.vtsrc[startpos:vt.vtpos]
+	pob, err := vt.vtvpm.ParseObjptr(idstr)
+	if err != nil {
+		return nil, vt.errorAt(startpos, "bad object id %s: %v", idstr, err)
+	}
+	if pob == nil {
+		return nil, vt.errorAt(startpos, "nil object %s", idstr)
+	}
+	return pob, nil
+}
+
+func (vt *valueTextParser) parseQuoted() (string, error) {
+	startpos := vt.vtpos
+	qs, err := strconv.QuotedPrefix(vt.vtsrc[startpos:])
+	if err != nil {
+		return "", vt.errorAt(startpos, "bad quoted string")
+	}
+	str, err := strconv.Unquote(qs)
+	if err != nil {
+		return "", vt.errorAt(startpos, "bad quoted string %s: %v", qs, err)
+	}
+	vt.vtpos += len(qs)
+	return str, nil
+}
+
+func (vt *valueTextParser) parseNumber() (ValueMo, error) {
+	startpos := vt.vtpos
+	src := vt.vtsrc
+	pos := startpos
+	if pos < len(src) && (src[pos] == '+' || src[pos] == '-') {
+		pos++
+	}
+	if strings.HasPrefix(src[pos:], "Inf") {
+		vt.vtpos = pos + len("Inf")
+		if src[startpos] == '-' {
+			return MakeFloatV(math.Inf(-1)), nil
+		}
+		return MakeFloatV(math.Inf(+1)), nil
+	}
+	isfloat := false
+	digstart := pos
+	for pos < len(src) && src[pos] >= '0' && src[pos] <= '9' {
+		pos++
+	}
+	if pos == digstart {
+		return nil, vt.errorAt(startpos, "expecting number")
+	}
+	if pos < len(src) && src[pos] == '.' {
+		isfloat = true
+		pos++
+		for pos < len(src) && src[pos] >= '0' && src[pos] <= '9' {
+			pos++
+		}
+	}
+	if pos < len(src) && (src[pos] == 'e' || src[pos] == 'E') {
+		isfloat = true
+		pos++
+		if pos < len(src) && (src[pos] == '+' || src[pos] == '-') {
+			pos++
+		}
+		expstart := pos
+		for pos < len(src) && src[pos] >= '0' && src[pos] <= '9' {
+			pos++
+		}
+		if pos == expstart {
+			return nil, vt.errorAt(pos, "bad float exponent")
+		}
+	}
+	numstr := src[startpos:pos]
+	vt.vtpos = pos
+	if isfloat {
+		f, err := strconv.ParseFloat(numstr, 64)
+		if err != nil {
+			return nil, vt.errorAt(startpos, "bad float %s: %v", numstr, err)
+		}
+		return MakeFloatV(f), nil
+	}
+	iv, err := ParseIntegerV10(strings.TrimPrefix(numstr, "+"))
+	if err != nil {
+		return nil, vt.errorAt(startpos, "bad integer %s", numstr)
+	}
+	return iv, nil
+} // end parseNumber
+
+// parse the objects of a set or tuple, till endc
+func (vt *valueTextParser) parseObjectSequence(endc byte) ([]*ObjectMo, error) {
+	objs := make([]*ObjectMo, 0, 4)
+	for {
+		vt.skipSpaces()
+		if vt.atEnd() {
+			return nil, vt.errorAt(vt.vtpos, "missing %c", endc)
+		}
+		if vt.peek() == endc {
+			vt.vtpos++
+			return objs, nil
+		}
+		pob, err := vt.parseObject()
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, pob)
+	}
+}
+
+func (vt *valueTextParser) parseColored() (ValueMo, error) {
+	startpos := vt.vtpos
+	vt.vtpos++ // skip the %
+	colpob, err := vt.parseObject()
+	if err != nil {
+		return nil, err
+	}
+	switch vt.peek() {
+	case '+', '-':
+		intpos := vt.vtpos
+		pos := intpos + 1
+		for pos < len(vt.vtsrc) && vt.vtsrc[pos] >= '0' && vt.vtsrc[pos] <= '9' {
+			pos++
+		}
+		i, err := strconv.ParseInt(vt.vtsrc[intpos:pos], 10, 64)
+		if err != nil {
+			return nil, vt.errorAt(intpos, "bad colored integer %s: %v", vt.vtsrc[intpos:pos], err)
+		}
+		vt.vtpos = pos
+		return MakeColInt(colpob, i), nil
+	case '"':
+		str, err := vt.parseQuoted()
+		if err != nil {
+			return nil, err
+		}
+		return MakeColString(colpob, str), nil
+	case '/':
+		vt.vtpos++
+		pob, err := vt.parseObject()
+		if err != nil {
+			return nil, err
+		}
+		return MakeColRef(colpob, pob), nil
+	}
+	return nil, vt.errorAt(startpos, "bad colored value")
+} // end parseColored
+
+func (vt *valueTextParser) parseNode() (ValueMo, error) {
+	vt.vtpos++ // skip the *
+	connpob, err := vt.parseObject()
+	if err != nil {
+		return nil, err
+	}
+	if vt.peek() != '(' {
+		return nil, vt.errorAt(vt.vtpos, "expecting ( after node connective")
+	}
+	vt.vtpos++
+	sons := make([]ValueMo, 0, 4)
+	for {
+		vt.skipSpaces()
+		if vt.atEnd() {
+			return nil, vt.errorAt(vt.vtpos, "missing ) of node")
+		}
+		if vt.peek() == ')' {
+			vt.vtpos++
+			return MakeNodeSliceV(connpob, sons), nil
+		}
+		son, err := vt.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		sons = append(sons, son)
+	}
+} // end parseNode
+
+func (vt *valueTextParser) parseValue() (ValueMo, error) {
+	vt.skipSpaces()
+	if vt.atEnd() {
+		return nil, vt.errorAt(vt.vtpos, "missing value")
+	}
+	startpos := vt.vtpos
+	c := vt.peek()
+	switch {
+	case c == '~':
+		vt.vtpos++
+		return nil, nil
+	case c == '_':
+		pob, err := vt.parseObject()
+		if err != nil {
+			return nil, err
+		}
+		return MakeRefobV(pob), nil
+	case c == '"':
+		str, err := vt.parseQuoted()
+		if err != nil {
+			return nil, err
+		}
+		return MakeStringV(str), nil
+	case c == '#':
+		vt.vtpos++
+		if vt.peek() != '"' {
+			return nil, vt.errorAt(vt.vtpos, "expecting quoted base64 after #")
+		}
+		b64str, err := vt.parseQuoted()
+		if err != nil {
+			return nil, err
+		}
+		bydata, err := base64.StdEncoding.DecodeString(b64str)
+		if err != nil {
+			return nil, vt.errorAt(startpos, "bad base64 bytes: %v", err)
+		}
+		return MakeBytesV(bydata), nil
+	case c == '[':
+		vt.vtpos++
+		objs, err := vt.parseObjectSequence(']')
+		if err != nil {
+			return nil, err
+		}
+		return MakeTupleSliceV(objs), nil
+	case c == '{':
+		vt.vtpos++
+		objs, err := vt.parseObjectSequence('}')
+		if err != nil {
+			return nil, err
+		}
+		return MakeSetSliceV(objs), nil
+	case c == '%':
+		return vt.parseColored()
+	case c == '*':
+		return vt.parseNode()
+	case c == '+' || c == '-' || (c >= '0' && c <= '9'):
+		return vt.parseNumber()
+	}
+	return nil, vt.errorAt(startpos, "unexpected character %q", c)
+} // end parseValue
+
+// ParseValueText reads a single value in the syntax of its String()
+// method; object ids are given to vpm
+func ParseValueText(src string, vpm JsonValParserMo) (ValueMo, error) {
+	vt := &valueTextParser{vtsrc: src, vtpos: 0, vtvpm: vpm}
+	v, err := vt.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	vt.skipSpaces()
+	if !vt.atEnd() {
+		return nil, vt.errorAt(vt.vtpos, "unexpected trailing text")
+	}
+	return v, nil
+} // end ParseValueText
@@ -0,0 +1,258 @@
+// file objvalmo/transact.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+//// locking several objects together, always in LessObptr order, so
+//// two goroutines locking the same objects cannot deadlock; and
+//// transactions on such locked objects, whose attribute, component
+//// and class changes are undone on failure. The change events of a
+//// transaction are sent to the watchers only once it is committed.
+
+// sorted slice of the distinct non-nil objects in objs
+func sortedDistinctObjects(objs []*ObjectMo) []*ObjectMo {
+	sobjs := make([]*ObjectMo, 0, len(objs))
+	for _, pob := range objs {
+		if pob != nil {
+			sobjs = append(sobjs, pob)
+		}
+	}
+	sort.Slice(sobjs, func(i, j int) bool {
+		return LessObptr(sobjs[i], sobjs[j])
+	})
+	nbob := 0
+	for ix, pob := range sobjs {
+		if ix > 0 && pob == sobjs[ix-1] {
+			continue
+		}
+		sobjs[nbob] = pob
+		nbob++
+	}
+	return sobjs[:nbob]
+}
+
+// LockObjects locks every given object in LessObptr order, ignoring
+// nil and duplicates, and gives the function to unlock them all.
+func LockObjects(objs ...*ObjectMo) (unlock func()) {
+	sobjs := sortedDistinctObjects(objs)
+	for _, pob := range sobjs {
+		pob.obmtx.Lock()
+	}
+	return func() {
+		for ix := len(sobjs) - 1; ix >= 0; ix-- {
+			sobjs[ix].obmtx.Unlock()
+		}
+	}
+} // end LockObjects
+
+// what is needed to restore an object modified in a transaction
+type trObjectSave struct {
+	tsmtime   int64
+	tsmodcnt  uint64
+	tsdirty   bool // was in the dirty set
+	tsclass   *ObjectMo
+	tscompsok bool // true once tscomps is saved
+	tscomps   []ValueMo
+}
+
+type trAttrUndo struct {
+	tupob    *ObjectMo
+	tuattr   *ObjectMo
+	tuoldval ValueMo
+	tufound  bool
+}
+
+type TransactionMo struct {
+	trsaves  map[*ObjectMo]*trObjectSave // keyed by the locked objects
+	trattrs  []trAttrUndo
+	trevents []ChangeEventMo // sent after the commit
+	trdone   bool
+}
+
+// RunTransaction locks the objects and runs fn on them. If fn
+// returns an error or panics, the changes made thru the transaction
+// are rolled back, then the error is returned or the panic goes on.
+func RunTransaction(fn func(tr *TransactionMo) error, objs ...*ObjectMo) (err error) {
+	unlock := LockObjects(objs...)
+	defer unlock()
+	tr := &TransactionMo{trsaves: make(map[*ObjectMo]*trObjectSave, len(objs))}
+	for _, pob := range objs {
+		if pob != nil {
+			tr.trsaves[pob] = nil
+		}
+	}
+	committed := false
+	defer func() {
+		tr.trdone = true
+		if committed {
+			// the objects are still locked, as notifyChange wants
+			for _, ev := range tr.trevents {
+				notifyChange(ev)
+			}
+			tr.trevents = nil
+			return
+		}
+		if r := recover(); r != nil {
+			log.Printf("RunTransaction rollback after panic %v\n", r)
+			tr.rollback()
+			panic(r)
+		}
+		log.Printf("RunTransaction rollback after error %v\n", err)
+		tr.rollback()
+	}()
+	err = fn(tr)
+	committed = err == nil
+	return err
+} // end RunTransaction
+
+// the save of a locked object about to be changed
+func (tr *TransactionMo) saveOf(pob *ObjectMo, msg string) *trObjectSave {
+	if tr == nil || tr.trdone {
+		panic(fmt.Errorf("TransactionMo.%s outside of transaction", msg))
+	}
+	sav, found := tr.trsaves[pob]
+	if !found {
+		panic(fmt.Errorf("TransactionMo.%s pob=%v not locked in transaction", msg, pob))
+	}
+	if sav == nil {
+		sav = &trObjectSave{tsmtime: pob.obmtime, tsmodcnt: pob.obmodcount,
+			tsdirty: pob.IsDirty(), tsclass: pob.obclass}
+		tr.trsaves[pob] = sav
+	}
+	return sav
+}
+
+func (sav *trObjectSave) saveComps(pob *ObjectMo) {
+	if sav.tscompsok {
+		return
+	}
+	sav.tscompsok = true
+	if pob.obcomps != nil {
+		sav.tscomps = make([]ValueMo, len(pob.obcomps))
+		copy(sav.tscomps, pob.obcomps)
+	}
+}
+
+func (tr *TransactionMo) rollback() {
+	for ix := len(tr.trattrs) - 1; ix >= 0; ix-- {
+		au := tr.trattrs[ix]
+		if au.tufound {
+			au.tupob.obattrs[au.tuattr] = au.tuoldval
+		} else {
+			delete(au.tupob.obattrs, au.tuattr)
+		}
+	}
+	tr.trattrs = nil
+	tr.trevents = nil
+	for pob, sav := range tr.trsaves {
+		if sav == nil {
+			continue
+		}
+		if sav.tscompsok {
+			pob.obcomps = sav.tscomps
+		}
+		pob.obclass = sav.tsclass
+		pob.obmtime = sav.tsmtime
+		// a rolled back object looks unchanged, e.g. to incremental dumps
+		pob.obmodcount = sav.tsmodcnt
+		if !sav.tsdirty {
+			UnmarkDirtyObjects(pob)
+		}
+	}
+} // end rollback
+
+func (tr *TransactionMo) GetAttr(pob *ObjectMo, pobat *ObjectMo) ValueMo {
+	if _, found := tr.trsaves[pob]; !found {
+		panic(fmt.Errorf("TransactionMo.GetAttr pob=%v not locked in transaction", pob))
+	}
+	return pob.UnsyncGetAttr(pobat)
+}
+
+func (tr *TransactionMo) recordAttr(pob *ObjectMo, pobat *ObjectMo, msg string) {
+	tr.saveOf(pob, msg)
+	oldval, found := pob.obattrs[pobat]
+	tr.trattrs = append(tr.trattrs, trAttrUndo{tupob: pob, tuattr: pobat, tuoldval: oldval, tufound: found})
+}
+
+// queue the change event ev, like the one of the synchronized mutator
+func (tr *TransactionMo) queueEvent(ev ChangeEventMo) {
+	tr.trevents = append(tr.trevents, ev)
+}
+
+func (tr *TransactionMo) PutAttr(pob *ObjectMo, pobat *ObjectMo, val ValueMo) *TransactionMo {
+	tr.recordAttr(pob, pobat, "PutAttr")
+	oldval := pob.obattrs[pobat]
+	pob.UnsyncPutAttr(pobat, val)
+	tr.queueEvent(ChangeEventMo{Object: pob, Kind: ChgPutAttr, Attr: pobat, OldVal: oldval, NewVal: val})
+	return tr
+}
+
+func (tr *TransactionMo) RemoveAttr(pob *ObjectMo, pobat *ObjectMo) *TransactionMo {
+	tr.recordAttr(pob, pobat, "RemoveAttr")
+	oldval, found := pob.obattrs[pobat]
+	pob.UnsyncRemoveAttr(pobat)
+	if found {
+		tr.queueEvent(ChangeEventMo{Object: pob, Kind: ChgRemoveAttr, Attr: pobat, OldVal: oldval})
+	}
+	return tr
+}
+
+func (tr *TransactionMo) SetClass(pob *ObjectMo, pobcla *ObjectMo) *TransactionMo {
+	tr.saveOf(pob, "SetClass")
+	oldcla := pob.obclass
+	pob.UnsyncSetClass(pobcla)
+	if oldcla != pobcla {
+		ev := ChangeEventMo{Object: pob, Kind: ChgClass}
+		if oldcla != nil {
+			ev.OldVal = MakeRefobV(oldcla)
+		}
+		if pobcla != nil {
+			ev.NewVal = MakeRefobV(pobcla)
+		}
+		tr.queueEvent(ev)
+	}
+	return tr
+}
+
+func (tr *TransactionMo) AppendVal(pob *ObjectMo, val ValueMo) *TransactionMo {
+	tr.saveOf(pob, "AppendVal").saveComps(pob)
+	pob.UnsyncAppendVal(val)
+	tr.queueEvent(ChangeEventMo{Object: pob, Kind: ChgAppendComp, Index: len(pob.obcomps) - 1, NewVal: val})
+	return tr
+}
+
+func (tr *TransactionMo) SetCompAt(pob *ObjectMo, rk int, val ValueMo) *TransactionMo {
+	tr.saveOf(pob, "SetCompAt").saveComps(pob)
+	oldval := pob.UnsyncCompAt(rk)
+	if rk < 0 {
+		rk += len(pob.obcomps)
+	}
+	pob.UnsyncSetCompAt(rk, val)
+	tr.queueEvent(ChangeEventMo{Object: pob, Kind: ChgSetComp, Index: rk, OldVal: oldval, NewVal: val})
+	return tr
+}
+
+func (tr *TransactionMo) InsertCompAt(pob *ObjectMo, rk int, val ValueMo) *TransactionMo {
+	tr.saveOf(pob, "InsertCompAt").saveComps(pob)
+	pob.UnsyncInsertCompAt(rk, val)
+	if rk < 0 {
+		rk += len(pob.obcomps) - 1
+	}
+	tr.queueEvent(ChangeEventMo{Object: pob, Kind: ChgInsertComp, Index: rk, NewVal: val})
+	return tr
+}
+
+func (tr *TransactionMo) TruncateComps(pob *ObjectMo, nbc int) *TransactionMo {
+	tr.saveOf(pob, "TruncateComps").saveComps(pob)
+	oldnbc := len(pob.obcomps)
+	pob.UnsyncTruncateComps(nbc)
+	if nbc != oldnbc {
+		tr.queueEvent(ChangeEventMo{Object: pob, Kind: ChgTruncateComps, Index: nbc})
+	}
+	return tr
+}
@@ -0,0 +1,153 @@
+// file objvalmo/valcompare.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//// total order on values: nil is first, then values are ordered by
+//// their TypeV, then by their content. Objects are ordered by their
+//// id, like LessObptr does.
+
+func compareObptr(pol *ObjectMo, por *ObjectMo) int {
+	if pol == por {
+		return 0
+	}
+	if LessObptr(pol, por) {
+		return -1
+	}
+	return 1
+}
+
+func compareSequences(sql SequenceV, sqr SequenceV) int {
+	ll := len(sql.scomps)
+	lr := len(sqr.scomps)
+	for ix := 0; ix < ll && ix < lr; ix++ {
+		if c := compareObptr(sql.scomps[ix], sqr.scomps[ix]); c != 0 {
+			return c
+		}
+	}
+	if ll < lr {
+		return -1
+	} else if ll > lr {
+		return 1
+	}
+	return 0
+}
+
+func compareInt64(il int64, ir int64) int {
+	if il < ir {
+		return -1
+	} else if il > ir {
+		return 1
+	}
+	return 0
+}
+
+// CompareValues returns -1, 0 or +1 if vl is less, equal or greater than vr
+func CompareValues(vl ValueMo, vr ValueMo) int {
+	if vl == nil {
+		if vr == nil {
+			return 0
+		}
+		return -1
+	}
+	if vr == nil {
+		return 1
+	}
+	tl := vl.TypeV()
+	tr := vr.TypeV()
+	if tl < tr {
+		return -1
+	} else if tl > tr {
+		return 1
+	}
+	switch tl {
+	case TyIntV:
+		return compareInt64(int64(vl.(IntV)), int64(vr.(IntV)))
+	case TyFloatV:
+		fl := vl.(FloatV).Float()
+		fr := vr.(FloatV).Float()
+		if fl < fr {
+			return -1
+		} else if fl > fr {
+			return 1
+		}
+		return 0
+	case TyStringV:
+		return strings.Compare(vl.(StringV).str, vr.(StringV).str)
+	case TyRefobV:
+		return compareObptr(vl.(RefobV).roptr, vr.(RefobV).roptr)
+	case TyColIntV:
+		cil := vl.(ColIntV)
+		cir := vr.(ColIntV)
+		if c := compareObptr(cil.colroptr, cir.colroptr); c != 0 {
+			return c
+		}
+		return compareInt64(cil.colint, cir.colint)
+	case TyColStringV:
+		csl := vl.(ColStringV)
+		csr := vr.(ColStringV)
+		if c := compareObptr(csl.colroptr, csr.colroptr); c != 0 {
+			return c
+		}
+		return strings.Compare(csl.colstr, csr.colstr)
+	case TyColRefV:
+		crl := vl.(ColRefV)
+		crr := vr.(ColRefV)
+		if c := compareObptr(crl.colroptr, crr.colroptr); c != 0 {
+			return c
+		}
+		return compareObptr(crl.obroptr, crr.obroptr)
+	case TySetV:
+		return compareSequences(vl.(SetV).SequenceV, vr.(SetV).SequenceV)
+	case TyTupleV:
+		return compareSequences(vl.(TupleV).SequenceV, vr.(TupleV).SequenceV)
+	case TyBigIntV:
+		return vl.(BigIntV).bint.Cmp(vr.(BigIntV).bint)
+	case TyBytesV:
+		return bytes.Compare(vl.(BytesV).bydata, vr.(BytesV).bydata)
+	case TyNodeV:
+		ndl := vl.(NodeV)
+		ndr := vr.(NodeV)
+		if c := compareObptr(ndl.nconn, ndr.nconn); c != 0 {
+			return c
+		}
+		ll := len(ndl.nsons)
+		lr := len(ndr.nsons)
+		for ix := 0; ix < ll && ix < lr; ix++ {
+			if c := CompareValues(ndl.nsons[ix], ndr.nsons[ix]); c != 0 {
+				return c
+			}
+		}
+		return compareInt64(int64(ll), int64(lr))
+	}
+	panic(fmt.Errorf("objvalmo.CompareValues incomplete vl=%v vr=%v", vl, vr))
+} // end CompareValues
+
+// EqualValues is true iff both values are structurally equal, so
+// also have the same Hash
+func EqualValues(vl ValueMo, vr ValueMo) bool {
+	if vl == nil || vr == nil {
+		return vl == nil && vr == nil
+	}
+	if vl.TypeV() != vr.TypeV() || vl.Hash() != vr.Hash() {
+		return false
+	}
+	return CompareValues(vl, vr) == 0
+} // end EqualValues
+
+func LessValues(vl ValueMo, vr ValueMo) bool {
+	return CompareValues(vl, vr) < 0
+}
+
+// SortValues sorts in place a slice of values using CompareValues
+func SortValues(vals []ValueMo) {
+	sort.SliceStable(vals, func(i, j int) bool {
+		return CompareValues(vals[i], vals[j]) < 0
+	})
+}
@@ -0,0 +1,170 @@
+// file objvalmo/watch.go
+
+package objvalmo // import "github.com/bstarynk/monimelt/objvalmo"
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+//// change notification: the synchronized mutators of objects (PutAttr,
+//// RemoveAttr, SetCompAt, ... but not the Unsync* ones) send change
+//// events to the watchers of that object and to the global watchers.
+//// Delivery never blocks: each watcher has a bounded channel, and
+//// events are dropped (and counted) when it is full.
+
+const (
+	ChgPutAttr = iota
+	ChgRemoveAttr
+	ChgSetComp
+	ChgInsertComp
+	ChgAppendComp
+	ChgTruncateComps
+	ChgClass
+	ChgPayload
+	Chg_Last
+)
+
+var chgkind_names = [Chg_Last]string{
+	ChgPutAttr:       "PutAttr",
+	ChgRemoveAttr:    "RemoveAttr",
+	ChgSetComp:       "SetComp",
+	ChgInsertComp:    "InsertComp",
+	ChgAppendComp:    "AppendComp",
+	ChgTruncateComps: "TruncateComps",
+	ChgClass:         "Class",
+	ChgPayload:       "Payload",
+}
+
+// the capacity of the channel of every watcher
+const WatchChanLen = 64
+
+type ChangeEventMo struct {
+	Object  *ObjectMo
+	Kind    uint8
+	Attr    *ObjectMo // the attribute, for ChgPutAttr and ChgRemoveAttr
+	Index   int       // the component rank, or the new count for ChgTruncateComps
+	OldVal  ValueMo   // the class as a RefobV, or nil, for ChgClass
+	NewVal  ValueMo
+	OldPayl PayloadMo // for ChgPayload
+	NewPayl PayloadMo
+}
+
+func (ev ChangeEventMo) String() string {
+	kindstr := fmt.Sprintf("?chg%d", ev.Kind)
+	if ev.Kind < Chg_Last {
+		kindstr = chgkind_names[ev.Kind]
+	}
+	return fmt.Sprintf("%s{%v at:%v ix:%d old:%s new:%s}", kindstr, ev.Object,
+		ev.Attr, ev.Index, ValueString(ev.OldVal), ValueString(ev.NewVal))
+}
+
+// a filter is called with the changed object locked, so should be
+// quick and should not lock any object; a nil filter accepts all.
+type ChangeFilterMo func(ev *ChangeEventMo) bool
+
+type watcherMo struct {
+	wch      chan ChangeEventMo
+	wobj     *ObjectMo // nil for global watchers
+	wfilter  ChangeFilterMo
+	wdropped uint64
+}
+
+var watch_mtx sync.Mutex
+var watch_count int32 // updated atomically, for a quick test in notifyChange
+var watch_objmap map[*ObjectMo][]*watcherMo = make(map[*ObjectMo][]*watcherMo)
+var watch_all []*watcherMo
+
+func addWatcher(pob *ObjectMo, filter ChangeFilterMo) <-chan ChangeEventMo {
+	w := &watcherMo{wch: make(chan ChangeEventMo, WatchChanLen), wobj: pob, wfilter: filter}
+	watch_mtx.Lock()
+	defer watch_mtx.Unlock()
+	if pob != nil {
+		watch_objmap[pob] = append(watch_objmap[pob], w)
+	} else {
+		watch_all = append(watch_all, w)
+	}
+	atomic.AddInt32(&watch_count, 1)
+	return w.wch
+}
+
+// Watch gives a channel receiving the changes of pob accepted by filter
+func Watch(pob *ObjectMo, filter ChangeFilterMo) <-chan ChangeEventMo {
+	if pob == nil {
+		panic("objvalmo.Watch nil pob")
+	}
+	return addWatcher(pob, filter)
+}
+
+// WatchAll gives a channel receiving the changes of every object
+// accepted by filter
+func WatchAll(filter ChangeFilterMo) <-chan ChangeEventMo {
+	return addWatcher(nil, filter)
+}
+
+func removeWatcher(ws []*watcherMo, ch <-chan ChangeEventMo) ([]*watcherMo, *watcherMo) {
+	for ix, w := range ws {
+		if (<-chan ChangeEventMo)(w.wch) == ch {
+			return append(ws[:ix:ix], ws[ix+1:]...), w
+		}
+	}
+	return ws, nil
+}
+
+// Unwatch stops and closes a channel given by Watch or WatchAll, and
+// gives the number of events dropped because it was full
+func Unwatch(ch <-chan ChangeEventMo) uint64 {
+	watch_mtx.Lock()
+	defer watch_mtx.Unlock()
+	var w *watcherMo
+	watch_all, w = removeWatcher(watch_all, ch)
+	if w == nil {
+		for pob, ws := range watch_objmap {
+			if ws, w = removeWatcher(ws, ch); w != nil {
+				if len(ws) == 0 {
+					delete(watch_objmap, pob)
+				} else {
+					watch_objmap[pob] = ws
+				}
+				break
+			}
+		}
+	}
+	if w == nil {
+		panic("objvalmo.Unwatch unknown channel")
+	}
+	atomic.AddInt32(&watch_count, -1)
+	close(w.wch)
+	if w.wdropped > 0 {
+		log.Printf("Unwatch pob=%v dropped %d events\n", w.wobj, w.wdropped)
+	}
+	return w.wdropped
+} // end Unwatch
+
+func (w *watcherMo) deliver(ev *ChangeEventMo) {
+	if w.wfilter != nil && !w.wfilter(ev) {
+		return
+	}
+	select {
+	case w.wch <- *ev:
+	default:
+		w.wdropped++
+	}
+}
+
+// called by the synchronized mutators, with ev.Object locked
+func notifyChange(ev ChangeEventMo) {
+	if atomic.LoadInt32(&watch_count) == 0 {
+		return
+	}
+	watch_mtx.Lock()
+	defer watch_mtx.Unlock()
+	for _, w := range watch_objmap[ev.Object] {
+		w.deliver(&ev)
+	}
+	for _, w := range watch_all {
+		w.deliver(&ev)
+	}
+} // end notifyChange
@@ -121,6 +121,12 @@ func (sy *SymbolPy) DumpScanPayl(pob *ObjectMo, du *DumperMo) {
 	}
 } // end symbol's DumpScanPayl
 
+// the copy is only used to dump the symbol, so is not registered
+func (sy *SymbolPy) SnapshotPayl(pob *ObjectMo) PayloadMo {
+	syc := *sy
+	return &syc
+} // end symbol's SnapshotPayl
+
 func (sy *SymbolPy) DumpEmitPayl(pob *ObjectMo, du *DumperMo) (pykind string, pjson interface{}) {
 	var jsy jsonSymbol
 	jsy.Jsyname = sy.syname
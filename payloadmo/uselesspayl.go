@@ -18,6 +18,10 @@ func (sy *UselessPy) DestroyPayl(pob *ObjectMo) {
 func (sy *UselessPy) DumpScanPayl(pob *ObjectMo, du *DumperMo) {
 } // end useless's DumpScanPayl
 
+func (sy *UselessPy) SnapshotPayl(pob *ObjectMo) PayloadMo {
+	return sy
+} // end useless's SnapshotPayl
+
 func (sy *UselessPy) DumpEmitPayl(pob *ObjectMo, du *DumperMo) (pykind string, json interface{}) {
 	return "useless", nil
 } // end useless's DumpEmitPayl
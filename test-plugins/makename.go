@@ -19,4 +19,6 @@ func DoMonimelt() {
 	log.Printf("makename DoMonimelt namob=%v\n", namob)
 	sy := payloadmo.AddNewSymbol("name", namob)
 	log.Printf("makename namob=%v sy=%v\n", namob, sy)
+	log.Printf("makename namob=%v attributes %v, %d components\n",
+		namob, namob.AttrKeys(), namob.NbComps())
 }